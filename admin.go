@@ -0,0 +1,178 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/heptiolabs/eventrouter/sinks"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+)
+
+// version is the build version, set with -ldflags "-X main.version=..."
+var version = "dev"
+
+// secretKeyFragments are the fragments of config keys whose values must not be
+// shown on /debug/status. They are matched against keys lowercased and
+// stripped of dashes and underscores.
+var secretKeyFragments = []string{
+	"password",
+	"pwd",
+	"secret",
+	"token",
+	"apikey",
+	"routingkey",
+	"hmackey",
+	"accesskey",
+	"connectionstring",
+}
+
+// redactedValue replaces the value of secret config keys.
+const redactedValue = "<redacted>"
+
+// statusResponse is the body served on /debug/status
+type statusResponse struct {
+	Version string                 `json:"version"`
+	Synced  bool                   `json:"synced"`
+	Sinks   []sinks.SinkStatus     `json:"sinks"`
+	Config  map[string]interface{} `json:"config"`
+}
+
+// newAdminMux builds the handler for the eventrouter HTTP endpoints. The
+// /metrics endpoint is only served when prometheus is enabled.
+func newAdminMux(er *EventRouter) *http.ServeMux {
+	mux := http.NewServeMux()
+	if viper.GetBool("enable-prometheus") {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+
+	// healthz only tells whether the process is alive and serving
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !er.eListerSynched() {
+			http.Error(w, "event informer not synced", http.StatusServiceUnavailable)
+			return
+		}
+		for _, st := range er.sinkStatuses() {
+			if !st.Healthy {
+				http.Error(w, "sink "+st.Name+" is unhealthy: "+st.LastError, http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/debug/status", func(w http.ResponseWriter, r *http.Request) {
+		resp := statusResponse{
+			Version: version,
+			Synced:  er.eListerSynched(),
+			Sinks:   er.sinkStatuses(),
+			Config:  redactConfig(viper.AllSettings()),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(resp); err != nil {
+			glog.Warningf("Failed to write status response: %v", err)
+		}
+	})
+	return mux
+}
+
+// redactConfig returns a copy of the given settings with the values of secret
+// keys replaced, descending into nested maps. The passwords of URLs are
+// replaced whatever their key.
+func redactConfig(settings map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(settings))
+	for k, v := range settings {
+		if isSecretKey(k) {
+			out[k] = redactedValue
+			continue
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			out[k] = redactConfig(v)
+		case string:
+			out[k] = redactURLs(v)
+		case []string:
+			values := make([]string, len(v))
+			for i := range v {
+				values[i] = redactURLs(v[i])
+			}
+			out[k] = values
+		case []interface{}:
+			values := make([]interface{}, len(v))
+			for i := range v {
+				if s, ok := v[i].(string); ok {
+					values[i] = redactURLs(s)
+				} else {
+					values[i] = v[i]
+				}
+			}
+			out[k] = values
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// redactURLs replaces the passwords of the URLs in a comma separated list.
+// Values that aren't URLs are returned as is, but URLs that can't be parsed
+// are replaced as a whole.
+func redactURLs(value string) string {
+	if !strings.Contains(value, "@") {
+		return value
+	}
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		u, err := url.Parse(strings.TrimSpace(part))
+		if err != nil {
+			if strings.Contains(part, "://") {
+				parts[i] = redactedValue
+			}
+			continue
+		}
+		if u.User == nil {
+			continue
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "redacted")
+			parts[i] = u.String()
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// isSecretKey returns true if the config key looks like it holds a secret
+func isSecretKey(key string) bool {
+	key = strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(key))
+	for _, f := range secretKeyFragments {
+		if strings.Contains(key, f) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/heptiolabs/eventrouter/sinks"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Annotations set on rolled up events. They are only added when more than one
+// update was aggregated.
+const (
+	rollupFirstTimestampKey = "eventrouter.heptio.com/rollup-first-timestamp"
+	rollupLastTimestampKey  = "eventrouter.heptio.com/rollup-last-timestamp"
+	rollupCountDeltaKey     = "eventrouter.heptio.com/rollup-count-delta"
+	rollupUpdatesKey        = "eventrouter.heptio.com/rollup-updates"
+	rollupMessagesKey       = "eventrouter.heptio.com/rollup-messages"
+)
+
+const (
+	// aggregateKeyUID and aggregateKeyMessage may be used in the aggregation
+	// key on top of the event label names
+	aggregateKeyUID     = "uid"
+	aggregateKeyMessage = "message"
+
+	// defaultRollupMaxMessages is the number of distinct messages kept per
+	// rollup when none is configured
+	defaultRollupMaxMessages = 10
+)
+
+// rollup accumulates the updates seen for one key during a window
+type rollup struct {
+	// first is the old event of the first update of the window, and latest
+	// the new event of the last one
+	first  *v1.Event
+	latest *v1.Event
+
+	firstTimestamp time.Time
+	updates        int
+	countDelta     int32
+	messages       []string
+}
+
+/*
+eventAggregator buffers event updates per key over a window and, when the window
+closes, forwards a single UPDATED record per key. The record carries the last
+version of the event as the new event and the version before the window as the
+old one. When more than one update was aggregated, the new event is annotated
+with the first and last timestamps of the window, the sum of the Count
+increments, the number of updates and the distinct messages seen.
+
+The key is the event UID by default, or any combination of the event label
+values and the message. Added events are forwarded immediately.
+*/
+type eventAggregator struct {
+	sink        sinks.EventSinkInterface
+	key         []string
+	window      time.Duration
+	maxMessages int
+
+	mu      sync.Mutex
+	rollups map[string]*rollup
+	order   []string
+}
+
+// newEventAggregator wraps sink in an eventAggregator. An empty key aggregates
+// by event UID.
+func newEventAggregator(sink sinks.EventSinkInterface, key []string, window time.Duration, maxMessages int) (*eventAggregator, error) {
+	for _, k := range key {
+		if k == aggregateKeyUID || k == aggregateKeyMessage {
+			continue
+		}
+		if _, ok := eventLabelValues[k]; !ok {
+			return nil, fmt.Errorf("unknown aggregation key %q", k)
+		}
+	}
+	if len(key) == 0 {
+		key = []string{aggregateKeyUID}
+	}
+	if maxMessages <= 0 {
+		maxMessages = defaultRollupMaxMessages
+	}
+	return &eventAggregator{
+		sink:        sink,
+		key:         key,
+		window:      window,
+		maxMessages: maxMessages,
+		rollups:     map[string]*rollup{},
+	}, nil
+}
+
+// keyFor builds the aggregation key of an event
+func (a *eventAggregator) keyFor(e *v1.Event) string {
+	parts := make([]string, len(a.key))
+	for i, k := range a.key {
+		switch k {
+		case aggregateKeyUID:
+			parts[i] = string(e.UID)
+		case aggregateKeyMessage:
+			parts[i] = e.Message
+		default:
+			parts[i] = eventLabelValues[k](e)
+		}
+	}
+	return strings.Join(parts, "\xff")
+}
+
+// UpdateEvents implements the EventSinkInterface. Updates are buffered until
+// the end of the window, added events go straight to the sink.
+func (a *eventAggregator) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	if eOld == nil {
+		a.sink.UpdateEvents(eNew, nil)
+		return
+	}
+
+	key := a.keyFor(eNew)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r, ok := a.rollups[key]
+	if !ok {
+		r = &rollup{
+			first:          eOld,
+			firstTimestamp: eNew.FirstTimestamp.Time,
+		}
+		if r.firstTimestamp.IsZero() {
+			r.firstTimestamp = eNew.LastTimestamp.Time
+		}
+		a.rollups[key] = r
+		a.order = append(a.order, key)
+	}
+	r.latest = eNew
+	r.updates++
+	r.countDelta += eNew.Count - eOld.Count
+	if len(r.messages) < a.maxMessages && !containsString(r.messages, eNew.Message) {
+		r.messages = append(r.messages, eNew.Message)
+	}
+}
+
+// Status implements the StatusReporter interface. Buffered rollups are
+// included in the buffer depth of the wrapped sink.
+func (a *eventAggregator) Status() sinks.SinkStatus {
+	st := sinks.SinkStatus{Healthy: true}
+	if r, ok := a.sink.(sinks.StatusReporter); ok {
+		st = r.Status()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st.BufferDepth += len(a.rollups)
+	return st
+}
+
+// Run flushes the buffered updates at the end of every window, and once more
+// when stopCh is closed.
+func (a *eventAggregator) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(a.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+		case <-stopCh:
+			a.flush()
+			return
+		}
+	}
+}
+
+// flush forwards one record per key buffered during the window, in the order
+// the keys were first seen
+func (a *eventAggregator) flush() {
+	a.mu.Lock()
+	rollups, order := a.rollups, a.order
+	a.rollups, a.order = map[string]*rollup{}, nil
+	a.mu.Unlock()
+
+	for _, key := range order {
+		r := rollups[key]
+		if r.updates == 1 {
+			a.sink.UpdateEvents(r.latest, r.first)
+			continue
+		}
+		a.sink.UpdateEvents(r.annotate(), r.first)
+	}
+	if len(order) > 0 {
+		glog.V(4).Infof("Flushed %d aggregated events", len(order))
+	}
+}
+
+// annotate returns a copy of the latest event annotated with the rollup
+func (r *rollup) annotate() *v1.Event {
+	e := r.latest.DeepCopy()
+	if e.Annotations == nil {
+		e.Annotations = map[string]string{}
+	}
+
+	messages, err := json.Marshal(r.messages)
+	if err != nil {
+		glog.Warningf("Failed to json serialize rollup messages: %v", err)
+	}
+	e.Annotations[rollupFirstTimestampKey] = r.firstTimestamp.UTC().Format(time.RFC3339)
+	e.Annotations[rollupLastTimestampKey] = r.latest.LastTimestamp.UTC().Format(time.RFC3339)
+	e.Annotations[rollupCountDeltaKey] = strconv.Itoa(int(r.countDelta))
+	e.Annotations[rollupUpdatesKey] = strconv.Itoa(r.updates)
+	e.Annotations[rollupMessagesKey] = string(messages)
+	return e
+}
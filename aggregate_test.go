@@ -0,0 +1,101 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recordingSink keeps every event pair it receives
+type recordingSink struct {
+	news []*v1.Event
+	olds []*v1.Event
+}
+
+func (r *recordingSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	r.news = append(r.news, eNew)
+	r.olds = append(r.olds, eOld)
+}
+
+func TestEventAggregator(t *testing.T) {
+	sink := &recordingSink{}
+	a, err := newEventAggregator(sink, nil, time.Minute, 2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	start := time.Now()
+	evt := &v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{UID: "abc"},
+		Reason:         "BackOff",
+		Message:        "back-off 10s",
+		Count:          1,
+		FirstTimestamp: metav1.NewTime(start.Add(-time.Hour)),
+		LastTimestamp:  metav1.NewTime(start),
+	}
+	a.UpdateEvents(evt, nil)
+	if len(sink.news) != 1 {
+		t.Fatalf("Added events should be forwarded immediately")
+	}
+
+	prev := evt
+	for i, msg := range []string{"back-off 20s", "back-off 40s", "back-off 40s", "back-off 80s"} {
+		next := prev.DeepCopy()
+		next.Count++
+		next.Message = msg
+		next.LastTimestamp = metav1.NewTime(start.Add(time.Duration(i+1) * time.Second))
+		a.UpdateEvents(next, prev)
+		prev = next
+	}
+	if len(sink.news) != 1 {
+		t.Fatalf("Updates should be buffered until the window closes")
+	}
+
+	a.flush()
+	if len(sink.news) != 2 {
+		t.Fatalf("Got %v records after flushing, expected 2", len(sink.news))
+	}
+	got, old := sink.news[1], sink.olds[1]
+	if old != evt || got.Count != 5 {
+		t.Errorf("Rollup should go from the first old event to the last new one, got counts %v -> %v", old.Count, got.Count)
+	}
+	if got.Annotations[rollupCountDeltaKey] != "4" || got.Annotations[rollupUpdatesKey] != "4" {
+		t.Errorf("Unexpected rollup annotations: %v", got.Annotations)
+	}
+	if want := start.Add(-time.Hour).UTC().Format(time.RFC3339); got.Annotations[rollupFirstTimestampKey] != want {
+		t.Errorf("Got first timestamp %v, expected %v", got.Annotations[rollupFirstTimestampKey], want)
+	}
+	if got.Annotations[rollupMessagesKey] != `["back-off 20s","back-off 40s"]` {
+		t.Errorf("Got messages %v, expected the first 2 distinct ones", got.Annotations[rollupMessagesKey])
+	}
+	if prev.Annotations != nil {
+		t.Errorf("The original event should not be modified")
+	}
+
+	// A single update is forwarded untouched.
+	next := prev.DeepCopy()
+	next.Count++
+	a.UpdateEvents(next, prev)
+	a.flush()
+	if sink.news[2] != next || sink.olds[2] != prev {
+		t.Errorf("A single update should be forwarded as is")
+	}
+}
@@ -18,10 +18,11 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/heptiolabs/eventrouter/sinks"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/viper"
 
 	v1 "k8s.io/api/core/v1"
@@ -32,49 +33,6 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
-var (
-	kubernetesWarningEventCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "heptio_eventrouter_warnings_total",
-		Help: "Total number of warning events in the kubernetes cluster",
-	}, []string{
-		"involved_object_kind",
-		"involved_object_name",
-		"involved_object_namespace",
-		"reason",
-		"source",
-	})
-	kubernetesNormalEventCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "heptio_eventrouter_normal_total",
-		Help: "Total number of normal events in the kubernetes cluster",
-	}, []string{
-		"involved_object_kind",
-		"involved_object_name",
-		"involved_object_namespace",
-		"reason",
-		"source",
-	})
-	kubernetesInfoEventCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "heptio_eventrouter_info_total",
-		Help: "Total number of info events in the kubernetes cluster",
-	}, []string{
-		"involved_object_kind",
-		"involved_object_name",
-		"involved_object_namespace",
-		"reason",
-		"source",
-	})
-	kubernetesUnknownEventCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "heptio_eventrouter_unknown_total",
-		Help: "Total number of events of unknown type in the kubernetes cluster",
-	}, []string{
-		"involved_object_kind",
-		"involved_object_name",
-		"involved_object_namespace",
-		"reason",
-		"source",
-	})
-)
-
 // EventRouter is responsible for maintaining a stream of kubernetes
 // system Events and pushing them to another channel for storage
 type EventRouter struct {
@@ -88,22 +46,110 @@ type EventRouter struct {
 	eListerSynched cache.InformerSynced
 
 	// event sink
-	// TODO: Determine if we want to support multiple sinks.
 	eSink sinks.EventSinkInterface
+
+	// name of the configured sink, as reported on the admin endpoints
+	sinkName string
+
+	// routing table dispatching events to named sinks, nil when a single
+	// sink is configured
+	routes *eventRoutes
+
+	// prometheus event counters, nil when prometheus is disabled
+	counters *eventCounters
+
+	// rate limiter applied before events reach the sink, nil when rate
+	// limiting is disabled
+	limiter *eventRateLimiter
+
+	// aggregator rolling up updates before they reach the sink, nil when
+	// aggregation is disabled
+	aggregator *eventAggregator
+
+	// redactor scrubbing events before they reach the sink, nil when no
+	// redaction is configured
+	redactor *eventRedactor
 }
 
 // NewEventRouter will create a new event router using the input params
 func NewEventRouter(kubeClient kubernetes.Interface, eventsInformer coreinformers.EventInformer) *EventRouter {
-	if viper.GetBool("enable-prometheus") {
-		prometheus.MustRegister(kubernetesWarningEventCounterVec)
-		prometheus.MustRegister(kubernetesNormalEventCounterVec)
-		prometheus.MustRegister(kubernetesInfoEventCounterVec)
-		prometheus.MustRegister(kubernetesUnknownEventCounterVec)
-	}
-
 	er := &EventRouter{
 		kubeClient: kubeClient,
-		eSink:      sinks.ManufactureSink(),
+	}
+	if err := sinks.LoadFormats(); err != nil {
+		panic(err.Error())
+	}
+	if viper.IsSet("routes") {
+		var routes []*eventRoute
+		if err := viper.UnmarshalKey("routes", &routes); err != nil {
+			panic(err.Error())
+		}
+		named := map[string]sinks.EventSinkInterface{}
+		for name := range viper.GetStringMap("sinks") {
+			sub := viper.Sub("sinks." + name)
+			if sub == nil {
+				panic(fmt.Sprintf("sink %q is not an object", name))
+			}
+			named[name] = wrapSink(sinks.ManufactureSinkFromConfig(sub), name)
+		}
+		routeTable, err := newEventRoutes(routes, viper.GetString("route-mode"), named)
+		if err != nil {
+			panic(err.Error())
+		}
+		if viper.GetBool("enable-prometheus") {
+			routeTable.register()
+		}
+		er.routes = routeTable
+		er.eSink = routeTable
+	} else {
+		er.eSink = wrapSink(sinks.ManufactureSink(), "")
+		er.sinkName = viper.GetString("sink")
+	}
+	if viper.GetBool("aggregate") {
+		aggregator, err := newEventAggregator(er.eSink, viper.GetStringSlice("aggregate-key"),
+			viper.GetDuration("aggregate-window"), viper.GetInt("aggregate-max-messages"))
+		if err != nil {
+			panic(err.Error())
+		}
+		er.aggregator = aggregator
+		er.eSink = aggregator
+	}
+	if viper.GetBool("enable-prometheus") {
+		counters, err := newEventCounters(viper.GetStringSlice("prometheus-labels"), viper.GetInt("prometheus-max-series"))
+		if err != nil {
+			panic(err.Error())
+		}
+		counters.register()
+		er.counters = counters
+	}
+	if viper.GetBool("rate-limit") {
+		var rules []rateLimitRule
+		if err := viper.UnmarshalKey("rate-limit-rules", &rules); err != nil {
+			panic(err.Error())
+		}
+		defaultRule := rateLimitRule{
+			Rate:  viper.GetFloat64("rate-limit-rate"),
+			Burst: viper.GetInt("rate-limit-burst"),
+		}
+		limiter, err := newEventRateLimiter(viper.GetStringSlice("rate-limit-keys"), rules, defaultRule,
+			viper.GetInt("rate-limit-sample-ratio"), viper.GetInt("rate-limit-max-keys"))
+		if err != nil {
+			panic(err.Error())
+		}
+		er.limiter = limiter
+	}
+	var redactRules []redactRule
+	if err := viper.UnmarshalKey("redact-message-rules", &redactRules); err != nil {
+		panic(err.Error())
+	}
+	dropFields := viper.GetStringSlice("redact-drop-fields")
+	hashFields := viper.GetStringSlice("redact-hash-fields")
+	if len(redactRules) > 0 || len(dropFields) > 0 || len(hashFields) > 0 {
+		redactor, err := newEventRedactor(redactRules, dropFields, hashFields, viper.GetString("redact-hmac-key"))
+		if err != nil {
+			panic(err.Error())
+		}
+		er.redactor = redactor
 	}
 	eventsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    er.addEvent,
@@ -115,6 +161,35 @@ func NewEventRouter(kubeClient kubernetes.Interface, eventsInformer coreinformer
 	return er
 }
 
+// wrapSink puts a sink behind the circuit breaker and the disk queue when they
+// are enabled, and leaves old events out with redact-omit-old-event. Named
+// sinks get their own queue directory under disk-queue-dir.
+func wrapSink(sink sinks.EventSinkInterface, name string) sinks.EventSinkInterface {
+	if _, ok := sink.(sinks.HealthChecker); ok && viper.GetBool("circuit-breaker") {
+		cb := sinks.NewCircuitBreaker(sink,
+			viper.GetDuration("circuit-breaker-probe-interval"),
+			viper.GetInt("circuit-breaker-failure-threshold"),
+			viper.GetInt("circuit-breaker-buffer-size"))
+		go cb.Run(make(chan bool))
+		sink = cb
+	}
+	if dir := viper.GetString("disk-queue-dir"); dir != "" {
+		q, err := sinks.NewDiskQueue(sink, filepath.Join(dir, name),
+			viper.GetInt64("disk-queue-max-bytes"),
+			viper.GetInt64("disk-queue-segment-bytes"),
+			viper.GetInt("disk-queue-batch-size"))
+		if err != nil {
+			panic(err.Error())
+		}
+		go q.Run(make(chan bool))
+		sink = q
+	}
+	if viper.GetBool("redact-omit-old-event") {
+		sink = &oldEventOmitter{sink}
+	}
+	return sink
+}
+
 // Run starts the EventRouter/Controller.
 func (er *EventRouter) Run(stopCh <-chan struct{}) {
 	defer utilruntime.HandleCrash()
@@ -127,73 +202,82 @@ func (er *EventRouter) Run(stopCh <-chan struct{}) {
 		utilruntime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
 		return
 	}
+	if er.limiter != nil {
+		go er.reportSuppressed(viper.GetDuration("rate-limit-summary-interval"), stopCh)
+	}
+	if er.aggregator != nil {
+		go er.aggregator.Run(stopCh)
+	}
 	<-stopCh
 }
 
 // addEvent is called when an event is created, or during the initial list
 func (er *EventRouter) addEvent(obj interface{}) {
 	e := obj.(*v1.Event)
-	prometheusEvent(e)
-	er.eSink.UpdateEvents(e, nil)
+	er.prometheusEvent(e)
+	if er.limiter != nil && !er.limiter.allow(e) {
+		return
+	}
+	er.sendEvent(e, nil)
 }
 
 // updateEvent is called any time there is an update to an existing event
 func (er *EventRouter) updateEvent(objOld interface{}, objNew interface{}) {
 	eOld := objOld.(*v1.Event)
 	eNew := objNew.(*v1.Event)
-	prometheusEvent(eNew)
+	er.prometheusEvent(eNew)
+	if er.limiter != nil && !er.limiter.allow(eNew) {
+		return
+	}
+	er.sendEvent(eNew, eOld)
+}
+
+// sendEvent hands an event to the sink, redacting it first if configured
+func (er *EventRouter) sendEvent(eNew *v1.Event, eOld *v1.Event) {
+	if er.redactor != nil {
+		eNew, eOld = er.redactor.redact(eNew), er.redactor.redact(eOld)
+	}
 	er.eSink.UpdateEvents(eNew, eOld)
 }
 
+// reportSuppressed periodically sends a summary event to the sink for every
+// rate limiting key that had events suppressed
+func (er *EventRouter) reportSuppressed(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, e := range er.limiter.summaries(interval) {
+				glog.V(2).Infof("%s", e.Message)
+				er.sendEvent(e, nil)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
 // prometheusEvent is called when an event is added or updated
-func prometheusEvent(event *v1.Event) {
-	if !viper.GetBool("enable-prometheus") {
+func (er *EventRouter) prometheusEvent(event *v1.Event) {
+	if er.counters == nil {
 		return
 	}
-	var counter prometheus.Counter
-	var err error
-
-	switch event.Type {
-	case "Normal":
-		counter, err = kubernetesNormalEventCounterVec.GetMetricWithLabelValues(
-			event.InvolvedObject.Kind,
-			event.InvolvedObject.Name,
-			event.InvolvedObject.Namespace,
-			event.Reason,
-			event.Source.Host,
-		)
-	case "Warning":
-		counter, err = kubernetesWarningEventCounterVec.GetMetricWithLabelValues(
-			event.InvolvedObject.Kind,
-			event.InvolvedObject.Name,
-			event.InvolvedObject.Namespace,
-			event.Reason,
-			event.Source.Host,
-		)
-	case "Info":
-		counter, err = kubernetesInfoEventCounterVec.GetMetricWithLabelValues(
-			event.InvolvedObject.Kind,
-			event.InvolvedObject.Name,
-			event.InvolvedObject.Namespace,
-			event.Reason,
-			event.Source.Host,
-		)
-	default:
-		counter, err = kubernetesUnknownEventCounterVec.GetMetricWithLabelValues(
-			event.InvolvedObject.Kind,
-			event.InvolvedObject.Name,
-			event.InvolvedObject.Namespace,
-			event.Reason,
-			event.Source.Host,
-		)
-	}
-
-	if err != nil {
-		// Not sure this is the right place to log this error?
-		glog.Warning(err)
-	} else {
-		counter.Add(1)
+	er.counters.observe(event)
+}
+
+// sinkStatuses reports the state of every sink. Sinks that can't report on
+// themselves are assumed to be healthy.
+func (er *EventRouter) sinkStatuses() []sinks.SinkStatus {
+	if er.routes != nil {
+		return er.routes.statuses()
+	}
+	st := sinks.SinkStatus{Healthy: true}
+	if r, ok := er.eSink.(sinks.StatusReporter); ok {
+		st = r.Status()
 	}
+	st.Name = er.sinkName
+	return []sinks.SinkStatus{st}
 }
 
 // deleteEvent should only occur when the system garbage collects events via TTL expiration
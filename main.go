@@ -26,7 +26,6 @@ import (
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 
 	"k8s.io/client-go/informers"
@@ -35,7 +34,7 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-// addr tells us what address to have the Prometheus metrics listen on.
+// addr tells us what address to have the metrics, health and admin endpoints listen on.
 var addr = flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
 
 // setup a signal hander to gracefully exit
@@ -74,6 +73,29 @@ func loadConfig() kubernetes.Interface {
 	viper.SetDefault("sink", "glog")
 	viper.SetDefault("resync-interval", time.Minute*30)
 	viper.SetDefault("enable-prometheus", true)
+	viper.SetDefault("prometheus-labels", defaultEventLabels)
+	viper.SetDefault("prometheus-max-series", 0)
+	viper.SetDefault("circuit-breaker", false)
+	viper.SetDefault("circuit-breaker-probe-interval", time.Second*10)
+	viper.SetDefault("circuit-breaker-failure-threshold", 3)
+	viper.SetDefault("circuit-breaker-buffer-size", 1500)
+	viper.SetDefault("disk-queue-dir", "")
+	viper.SetDefault("disk-queue-max-bytes", 1<<30)
+	viper.SetDefault("disk-queue-segment-bytes", 16<<20)
+	viper.SetDefault("disk-queue-batch-size", 100)
+	viper.SetDefault("rate-limit", false)
+	viper.SetDefault("rate-limit-keys", []string{"involved_object_namespace", "reason"})
+	viper.SetDefault("rate-limit-rate", 10)
+	viper.SetDefault("rate-limit-burst", 50)
+	viper.SetDefault("rate-limit-sample-ratio", 0)
+	viper.SetDefault("rate-limit-max-keys", 10000)
+	viper.SetDefault("rate-limit-summary-interval", time.Minute)
+	viper.SetDefault("aggregate", false)
+	viper.SetDefault("aggregate-key", []string{"uid"})
+	viper.SetDefault("aggregate-window", time.Minute)
+	viper.SetDefault("aggregate-max-messages", 10)
+	viper.SetDefault("route-mode", "first")
+	viper.SetDefault("redact-omit-old-event", false)
 	if err = viper.ReadInConfig(); err != nil {
 		panic(err.Error())
 	}
@@ -114,14 +136,12 @@ func main() {
 	eventRouter := NewEventRouter(clientset, eventsInformer)
 	stop := sigHandler()
 
-	// Startup the http listener for Prometheus Metrics endpoint.
-	if viper.GetBool("enable-prometheus") {
-		go func() {
-			glog.Info("Starting prometheus metrics.")
-			http.Handle("/metrics", promhttp.Handler())
-			glog.Warning(http.ListenAndServe(*addr, nil))
-		}()
-	}
+	// Startup the http listener for the Prometheus metrics, health and
+	// admin endpoints.
+	go func() {
+		glog.Infof("Starting HTTP server on %s", *addr)
+		glog.Warning(http.ListenAndServe(*addr, newAdminMux(eventRouter)))
+	}()
 
 	// Startup the EventRouter
 	wg.Add(1)
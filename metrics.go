@@ -0,0 +1,169 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// eventLabelValues maps every label the event counters may carry to the
+// event field it is read from.
+var eventLabelValues = map[string]func(*v1.Event) string{
+	"involved_object_kind":      func(e *v1.Event) string { return e.InvolvedObject.Kind },
+	"involved_object_name":      func(e *v1.Event) string { return e.InvolvedObject.Name },
+	"involved_object_namespace": func(e *v1.Event) string { return e.InvolvedObject.Namespace },
+	"reason":                    func(e *v1.Event) string { return e.Reason },
+	"source":                    func(e *v1.Event) string { return e.Source.Host },
+}
+
+// defaultEventLabels is the label set used when prometheus-labels is not
+// configured. involved_object_name and source are unbounded on clusters with
+// churning pods, so large clusters will usually want to drop them.
+var defaultEventLabels = []string{
+	"involved_object_kind",
+	"involved_object_name",
+	"involved_object_namespace",
+	"reason",
+	"source",
+}
+
+// eventCounters holds the per-type event counters along with the optional LRU
+// used to expire stale label combinations.
+type eventCounters struct {
+	labels []string
+
+	warning *prometheus.CounterVec
+	normal  *prometheus.CounterVec
+	info    *prometheus.CounterVec
+	unknown *prometheus.CounterVec
+
+	// unknownType counts events whose Type fell into the unknown bucket,
+	// regardless of the configured labels.
+	unknownType prometheus.Counter
+
+	// series tracks the label combinations currently exported. It is nil
+	// when the number of series is unbounded.
+	series *lru.Cache
+}
+
+// seriesEntry remembers which vector a tracked series belongs to, so it can be
+// deleted when it falls out of the LRU.
+type seriesEntry struct {
+	vec    *prometheus.CounterVec
+	values []string
+}
+
+// newEventCounters builds the event counters for the given label set. If
+// maxSeries is greater than zero, at most that many label combinations are
+// exported at once and the least recently updated ones are deleted.
+func newEventCounters(labels []string, maxSeries int) (*eventCounters, error) {
+	for _, l := range labels {
+		if _, ok := eventLabelValues[l]; !ok {
+			return nil, fmt.Errorf("unknown prometheus label %q", l)
+		}
+	}
+
+	c := &eventCounters{
+		labels: labels,
+		warning: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "heptio_eventrouter_warnings_total",
+			Help: "Total number of warning events in the kubernetes cluster",
+		}, labels),
+		normal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "heptio_eventrouter_normal_total",
+			Help: "Total number of normal events in the kubernetes cluster",
+		}, labels),
+		info: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "heptio_eventrouter_info_total",
+			Help: "Total number of info events in the kubernetes cluster",
+		}, labels),
+		unknown: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "heptio_eventrouter_unknown_total",
+			Help: "Total number of events of unknown type in the kubernetes cluster",
+		}, labels),
+		unknownType: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "heptio_eventrouter_unknown_type_events_total",
+			Help: "Total number of events whose type was not Normal, Warning or Info",
+		}),
+	}
+
+	if maxSeries > 0 {
+		series, err := lru.NewWithEvict(maxSeries, func(key interface{}, value interface{}) {
+			entry := value.(seriesEntry)
+			entry.vec.DeleteLabelValues(entry.values...)
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.series = series
+	}
+	return c, nil
+}
+
+// register registers all counters with the default prometheus registry.
+func (c *eventCounters) register() {
+	prometheus.MustRegister(c.warning)
+	prometheus.MustRegister(c.normal)
+	prometheus.MustRegister(c.info)
+	prometheus.MustRegister(c.unknown)
+	prometheus.MustRegister(c.unknownType)
+}
+
+// observe increments the counter matching the type of the event.
+func (c *eventCounters) observe(event *v1.Event) {
+	var vec *prometheus.CounterVec
+	bucket := event.Type
+	switch event.Type {
+	case "Normal":
+		vec = c.normal
+	case "Warning":
+		vec = c.warning
+	case "Info":
+		vec = c.info
+	default:
+		// All unknown types share one vector, so they must share one
+		// bucket in the series LRU too.
+		bucket = "Unknown"
+		vec = c.unknown
+		c.unknownType.Inc()
+	}
+
+	values := make([]string, len(c.labels))
+	for i, l := range c.labels {
+		values[i] = eventLabelValues[l](event)
+	}
+
+	counter, err := vec.GetMetricWithLabelValues(values...)
+	if err != nil {
+		// Not sure this is the right place to log this error?
+		glog.Warning(err)
+		return
+	}
+	counter.Add(1)
+
+	if c.series != nil {
+		key := bucket + "\xff" + strings.Join(values, "\xff")
+		c.series.Add(key, seriesEntry{vec: vec, values: values})
+	}
+}
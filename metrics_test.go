@@ -0,0 +1,80 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestEventCounters(t *testing.T) {
+	if _, err := newEventCounters([]string{"reason", "bogus"}, 0); err == nil {
+		t.Errorf("Expected an error for an unknown label")
+	}
+
+	c, err := newEventCounters([]string{"involved_object_namespace", "reason"}, 2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	evt := &v1.Event{
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "foo", Namespace: "baz"},
+		Reason:         "BackOff",
+		Type:           "Warning",
+	}
+	c.observe(evt)
+	evt.InvolvedObject.Name = "bar"
+	c.observe(evt)
+
+	// Dropping involved_object_name collapses both pods into a single series.
+	if n := countSeries(c.warning); n != 1 {
+		t.Errorf("Got %v warning series, expected 1", n)
+	}
+	if v := testutil.ToFloat64(c.warning.WithLabelValues("baz", "BackOff")); v != 2 {
+		t.Errorf("Got %v for warning counter, expected 2", v)
+	}
+
+	// Two more series push the least recently updated one out of the LRU.
+	evt.Reason = "Failed"
+	c.observe(evt)
+	evt.Type = "Bogus"
+	c.observe(evt)
+
+	if n := countSeries(c.warning); n != 1 {
+		t.Errorf("Got %v warning series after eviction, expected 1", n)
+	}
+	if v := testutil.ToFloat64(c.unknownType); v != 1 {
+		t.Errorf("Got %v for unknown type counter, expected 1", v)
+	}
+}
+
+func countSeries(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	n := 0
+	for range ch {
+		n++
+	}
+	return n
+}
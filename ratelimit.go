@@ -0,0 +1,216 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/time/rate"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// suppressedEventReason is the reason of the summary events emitted for
+// suppressed events
+const suppressedEventReason = "EventsSuppressed"
+
+// rateLimitRule limits the events of every key whose dimensions match all the
+// glob patterns in Match. Rate is in events per second, a Rate of zero means
+// unlimited.
+type rateLimitRule struct {
+	Match map[string]string `mapstructure:"match"`
+	Rate  float64           `mapstructure:"rate"`
+	Burst int               `mapstructure:"burst"`
+}
+
+// matches returns true if every pattern of the rule matches the dimension
+// values of a key
+func (r *rateLimitRule) matches(values map[string]string) bool {
+	for dim, pattern := range r.Match {
+		if ok, _ := path.Match(pattern, values[dim]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// keyLimiter is the state kept for a single rate limiting key
+type keyLimiter struct {
+	limiter *rate.Limiter
+
+	// overLimit counts events over the limit, for sampling
+	overLimit int
+
+	// suppressed counts events dropped since the last summary, and last is
+	// the last of them
+	suppressed int
+	last       *v1.Event
+}
+
+// eventRateLimiter applies a token bucket per key, where the key is built from
+// the configured dimensions of the event. Events over the limit are dropped,
+// or only one in sampleRatio of them is let through when sampleRatio is
+// greater than one.
+type eventRateLimiter struct {
+	dimensions  []string
+	rules       []rateLimitRule
+	defaultRule rateLimitRule
+	sampleRatio int
+
+	mu       sync.Mutex
+	limiters *lru.Cache
+}
+
+// newEventRateLimiter builds a rate limiter. Rules are tried in order and the
+// first match applies; keys that match no rule use defaultRule. At most maxKeys
+// keys are tracked at once.
+func newEventRateLimiter(dimensions []string, rules []rateLimitRule, defaultRule rateLimitRule, sampleRatio int, maxKeys int) (*eventRateLimiter, error) {
+	for _, d := range dimensions {
+		if _, ok := eventLabelValues[d]; !ok {
+			return nil, fmt.Errorf("unknown rate limit dimension %q", d)
+		}
+	}
+	for _, r := range rules {
+		for d, pattern := range r.Match {
+			if !containsString(dimensions, d) {
+				return nil, fmt.Errorf("rate limit rule matches on %q, which is not one of rate-limit-keys", d)
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid rate limit pattern %q: %v", pattern, err)
+			}
+		}
+	}
+
+	limiters, err := lru.New(maxKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &eventRateLimiter{
+		dimensions:  dimensions,
+		rules:       rules,
+		defaultRule: defaultRule,
+		sampleRatio: sampleRatio,
+		limiters:    limiters,
+	}, nil
+}
+
+// allow returns true if the event should be forwarded to the sink
+func (l *eventRateLimiter) allow(e *v1.Event) bool {
+	values := make(map[string]string, len(l.dimensions))
+	parts := make([]string, len(l.dimensions))
+	for i, d := range l.dimensions {
+		values[d] = eventLabelValues[d](e)
+		parts[i] = d + "=" + values[d]
+	}
+	key := strings.Join(parts, ", ")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var kl *keyLimiter
+	if v, ok := l.limiters.Get(key); ok {
+		kl = v.(*keyLimiter)
+	} else {
+		rule := l.ruleFor(values)
+		limit := rate.Limit(rule.Rate)
+		if rule.Rate <= 0 {
+			limit = rate.Inf
+		}
+		kl = &keyLimiter{limiter: rate.NewLimiter(limit, rule.Burst)}
+		l.limiters.Add(key, kl)
+	}
+
+	if kl.limiter.Allow() {
+		return true
+	}
+	kl.overLimit++
+	if l.sampleRatio > 1 && kl.overLimit%l.sampleRatio == 0 {
+		return true
+	}
+	kl.suppressed++
+	kl.last = e
+	return false
+}
+
+// ruleFor returns the first rule matching the given dimension values
+func (l *eventRateLimiter) ruleFor(values map[string]string) rateLimitRule {
+	for _, r := range l.rules {
+		if r.matches(values) {
+			return r
+		}
+	}
+	return l.defaultRule
+}
+
+// summaries returns one event per key that had events suppressed since the
+// previous call, saying how many were suppressed over the given interval.
+func (l *eventRateLimiter) summaries(interval time.Duration) []*v1.Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := metav1.Now()
+	var events []*v1.Event
+	for _, k := range l.limiters.Keys() {
+		v, ok := l.limiters.Peek(k)
+		if !ok {
+			continue
+		}
+		kl := v.(*keyLimiter)
+		if kl.suppressed == 0 {
+			continue
+		}
+
+		events = append(events, &v1.Event{
+			// Every summary is a new event, so that sinks keyed on the
+			// UID don't merge it with the previous ones
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            fmt.Sprintf("%v.%x", kl.last.InvolvedObject.Name, now.UnixNano()),
+				Namespace:       kl.last.Namespace,
+				UID:             uuid.NewUUID(),
+				ResourceVersion: "1",
+			},
+			InvolvedObject: kl.last.InvolvedObject,
+			Reason:         suppressedEventReason,
+			Message:        fmt.Sprintf("%d events suppressed for %v in the last %v", kl.suppressed, k, interval),
+			Source:         v1.EventSource{Component: "eventrouter"},
+			FirstTimestamp: now,
+			LastTimestamp:  now,
+			Count:          int32(kl.suppressed),
+			Type:           v1.EventTypeNormal,
+		})
+		kl.suppressed = 0
+		kl.last = nil
+	}
+	return events
+}
+
+// containsString returns true if s is in list
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
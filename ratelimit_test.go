@@ -0,0 +1,98 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestEventRateLimiter(t *testing.T) {
+	rules := []rateLimitRule{
+		{Match: map[string]string{"involved_object_namespace": "prod-*", "reason": "BackOff"}, Rate: 0.001, Burst: 2},
+	}
+	l, err := newEventRateLimiter([]string{"involved_object_namespace", "reason"}, rules, rateLimitRule{}, 0, 100)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if _, err := newEventRateLimiter([]string{"reason"}, rules, rateLimitRule{}, 0, 100); err == nil {
+		t.Errorf("Expected an error for a rule on a dimension that is not part of the key")
+	}
+
+	backoff := &v1.Event{
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "foo", Namespace: "prod-web"},
+		Reason:         "BackOff",
+	}
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if l.allow(backoff) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("Got %v events through a limit with a burst of 2", allowed)
+	}
+
+	// Keys that match no rule use the default, which is unlimited here.
+	other := backoff.DeepCopy()
+	other.InvolvedObject.Namespace = "dev"
+	for i := 0; i < 10; i++ {
+		if !l.allow(other) {
+			t.Fatalf("Events matching no rule should not be limited")
+		}
+	}
+
+	summaries := l.summaries(time.Minute)
+	if len(summaries) != 1 {
+		t.Fatalf("Got %v summary events, expected 1", len(summaries))
+	}
+	if summaries[0].Count != 8 || !strings.Contains(summaries[0].Message, "involved_object_namespace=prod-web, reason=BackOff") {
+		t.Errorf("Unexpected summary event: %v (count %v)", summaries[0].Message, summaries[0].Count)
+	}
+	if summaries[0].UID == "" || summaries[0].ResourceVersion == "" {
+		t.Errorf("Expected the summary event to have a UID and a resource version, got %+v", summaries[0].ObjectMeta)
+	}
+	if len(l.summaries(time.Minute)) != 0 {
+		t.Errorf("Suppressed counts should be reset after a summary")
+	}
+
+	// Every summary is a distinct event.
+	l.allow(backoff)
+	next := l.summaries(time.Minute)
+	if len(next) != 1 || next[0].UID == summaries[0].UID {
+		t.Errorf("Expected a summary event with a new UID, got %v", next)
+	}
+
+	// With sampling, one in every 4 events over the limit goes through.
+	l, err = newEventRateLimiter([]string{"reason"}, nil, rateLimitRule{Rate: 0.001, Burst: 1}, 4, 100)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	allowed = 0
+	for i := 0; i < 9; i++ {
+		if l.allow(backoff) {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("Got %v sampled events, expected 3", allowed)
+	}
+}
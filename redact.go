@@ -0,0 +1,191 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	"github.com/heptiolabs/eventrouter/sinks"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// redactRule replaces every match of Pattern in event messages with
+// Replacement, which may refer to submatches as in regexp.ReplaceAllString.
+type redactRule struct {
+	Pattern     string `mapstructure:"pattern"`
+	Replacement string `mapstructure:"replacement"`
+
+	re *regexp.Regexp
+}
+
+// redactField reads and writes one event field that can be dropped or hashed
+type redactField struct {
+	get func(*v1.Event) string
+	set func(*v1.Event, string)
+}
+
+// redactFields are the fields that may be listed in redact-drop-fields and
+// redact-hash-fields. They use the field names of routing expressions.
+var redactFields = map[string]redactField{
+	"Name": {
+		func(e *v1.Event) string { return e.Name },
+		func(e *v1.Event, v string) { e.Name = v },
+	},
+	"Namespace": {
+		func(e *v1.Event) string { return e.Namespace },
+		func(e *v1.Event, v string) { e.Namespace = v },
+	},
+	"Message": {
+		func(e *v1.Event) string { return e.Message },
+		func(e *v1.Event, v string) { e.Message = v },
+	},
+	"InvolvedObject.Name": {
+		func(e *v1.Event) string { return e.InvolvedObject.Name },
+		func(e *v1.Event, v string) { e.InvolvedObject.Name = v },
+	},
+	"InvolvedObject.Namespace": {
+		func(e *v1.Event) string { return e.InvolvedObject.Namespace },
+		func(e *v1.Event, v string) { e.InvolvedObject.Namespace = v },
+	},
+	"InvolvedObject.UID": {
+		func(e *v1.Event) string { return string(e.InvolvedObject.UID) },
+		func(e *v1.Event, v string) { e.InvolvedObject.UID = types.UID(v) },
+	},
+	"InvolvedObject.FieldPath": {
+		func(e *v1.Event) string { return e.InvolvedObject.FieldPath },
+		func(e *v1.Event, v string) { e.InvolvedObject.FieldPath = v },
+	},
+	"Source.Component": {
+		func(e *v1.Event) string { return e.Source.Component },
+		func(e *v1.Event, v string) { e.Source.Component = v },
+	},
+	"Source.Host": {
+		func(e *v1.Event) string { return e.Source.Host },
+		func(e *v1.Event, v string) { e.Source.Host = v },
+	},
+	"ReportingInstance": {
+		func(e *v1.Event) string { return e.ReportingInstance },
+		func(e *v1.Event, v string) { e.ReportingInstance = v },
+	},
+}
+
+/*
+eventRedactor scrubs events before they are handed to the sinks. Message rules
+are applied first, then the listed fields are emptied or replaced with the hex
+HMAC-SHA256 of their value. Hashing with a fixed key keeps values correlatable
+across events without revealing them.
+
+Events are copied before being changed, since the originals belong to the
+informer cache.
+*/
+type eventRedactor struct {
+	rules []redactRule
+	drop  []redactField
+	hash  []redactField
+	key   []byte
+
+	// clearSelfLink is set when the name or namespace of events is dropped
+	// or hashed, since the self link holds both
+	clearSelfLink bool
+}
+
+// newEventRedactor builds a redactor. A key is required when fields are
+// hashed.
+func newEventRedactor(rules []redactRule, dropFields, hashFields []string, key string) (*eventRedactor, error) {
+	r := &eventRedactor{rules: rules, key: []byte(key)}
+	for i := range r.rules {
+		re, err := regexp.Compile(r.rules[i].Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %v", r.rules[i].Pattern, err)
+		}
+		r.rules[i].re = re
+	}
+	for _, name := range dropFields {
+		f, ok := redactFields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction field %q", name)
+		}
+		r.drop = append(r.drop, f)
+		r.clearSelfLink = r.clearSelfLink || name == "Name" || name == "Namespace"
+	}
+	for _, name := range hashFields {
+		f, ok := redactFields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction field %q", name)
+		}
+		r.hash = append(r.hash, f)
+		r.clearSelfLink = r.clearSelfLink || name == "Name" || name == "Namespace"
+	}
+	if len(r.hash) > 0 && key == "" {
+		return nil, fmt.Errorf("redact-hash-fields requires redact-hmac-key")
+	}
+	return r, nil
+}
+
+// redact returns a scrubbed copy of an event, or nil for a nil event
+func (r *eventRedactor) redact(e *v1.Event) *v1.Event {
+	if e == nil {
+		return nil
+	}
+	e = e.DeepCopy()
+	for _, rule := range r.rules {
+		e.Message = rule.re.ReplaceAllString(e.Message, rule.Replacement)
+	}
+	for _, f := range r.drop {
+		f.set(e, "")
+	}
+	for _, f := range r.hash {
+		if v := f.get(e); v != "" {
+			mac := hmac.New(sha256.New, r.key)
+			mac.Write([]byte(v))
+			f.set(e, hex.EncodeToString(mac.Sum(nil)))
+		}
+	}
+	if r.clearSelfLink {
+		e.SelfLink = ""
+	}
+	return e
+}
+
+// oldEventOmitter leaves the previous version of updated events out of what
+// reaches a sink. sinks.OmittedEvent stands in for it, which NewEventData
+// leaves out while keeping the UPDATED verb.
+type oldEventOmitter struct {
+	sink sinks.EventSinkInterface
+}
+
+// UpdateEvents implements the EventSinkInterface
+func (o *oldEventOmitter) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	if eOld != nil {
+		eOld = sinks.OmittedEvent
+	}
+	o.sink.UpdateEvents(eNew, eOld)
+}
+
+// Status implements the StatusReporter interface by reporting the status of
+// the wrapped sink
+func (o *oldEventOmitter) Status() sinks.SinkStatus {
+	if r, ok := o.sink.(sinks.StatusReporter); ok {
+		return r.Status()
+	}
+	return sinks.SinkStatus{Healthy: true}
+}
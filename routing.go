@@ -0,0 +1,164 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/heptiolabs/eventrouter/sinks"
+	"github.com/prometheus/client_golang/prometheus"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// routeModeFirst sends an event to the sinks of the first matching route
+	routeModeFirst = "first"
+
+	// routeModeAll sends an event to the sinks of every matching route
+	routeModeAll = "all"
+)
+
+// eventRoute sends the events matching Expression to the named sinks in Sinks
+type eventRoute struct {
+	Name       string   `mapstructure:"name"`
+	Expression string   `mapstructure:"expression"`
+	Sinks      []string `mapstructure:"sinks"`
+
+	expr *sinks.Expression
+}
+
+/*
+eventRoutes is a routing table dispatching events to named sinks. Routes are
+tried in order; in first mode an event goes to the sinks of the first route it
+matches, in all mode to the sinks of every route it matches. A sink listed by
+several matching routes receives the event only once. Events matching no route
+are dropped.
+*/
+type eventRoutes struct {
+	routes   []*eventRoute
+	matchAll bool
+	sinks    map[string]sinks.EventSinkInterface
+
+	matches   *prometheus.CounterVec
+	unmatched prometheus.Counter
+}
+
+// newEventRoutes builds a routing table over the given named sinks. Sink names
+// are case insensitive.
+func newEventRoutes(routes []*eventRoute, mode string, named map[string]sinks.EventSinkInterface) (*eventRoutes, error) {
+	r := &eventRoutes{
+		routes: routes,
+		sinks:  map[string]sinks.EventSinkInterface{},
+		matches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "heptio_eventrouter_route_matches_total",
+			Help: "Total number of events matched by each route",
+		}, []string{"route"}),
+		unmatched: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "heptio_eventrouter_route_unmatched_total",
+			Help: "Total number of events dropped because they matched no route",
+		}),
+	}
+
+	switch mode {
+	case routeModeFirst:
+	case routeModeAll:
+		r.matchAll = true
+	default:
+		return nil, fmt.Errorf("invalid route mode %q, must be %s or %s", mode, routeModeFirst, routeModeAll)
+	}
+
+	for name, s := range named {
+		r.sinks[strings.ToLower(name)] = s
+	}
+	for i, route := range routes {
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route-%d", i)
+		}
+		var err error
+		if route.expr, err = sinks.ParseExpression(route.Expression); err != nil {
+			return nil, fmt.Errorf("route %q: %v", route.Name, err)
+		}
+		if len(route.Sinks) == 0 {
+			return nil, fmt.Errorf("route %q has no sinks", route.Name)
+		}
+		for j, name := range route.Sinks {
+			route.Sinks[j] = strings.ToLower(name)
+			if _, ok := r.sinks[route.Sinks[j]]; !ok {
+				return nil, fmt.Errorf("route %q refers to unknown sink %q", route.Name, name)
+			}
+		}
+	}
+	return r, nil
+}
+
+// register registers the route counters with prometheus
+func (r *eventRoutes) register() {
+	prometheus.MustRegister(r.matches, r.unmatched)
+}
+
+// UpdateEvents implements the EventSinkInterface by sending the event to the
+// sinks of the matching routes
+func (r *eventRoutes) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	data := sinks.NewEventData(eNew, eOld)
+
+	var sent map[string]bool
+	for _, route := range r.routes {
+		if !route.expr.Match(data) {
+			continue
+		}
+		r.matches.WithLabelValues(route.Name).Inc()
+		for _, name := range route.Sinks {
+			if sent[name] {
+				continue
+			}
+			if sent == nil {
+				sent = map[string]bool{}
+			}
+			sent[name] = true
+			r.sinks[name].UpdateEvents(eNew, eOld)
+		}
+		if !r.matchAll {
+			break
+		}
+	}
+	if sent == nil {
+		r.unmatched.Inc()
+	}
+}
+
+// statuses returns the status of every named sink, sorted by name
+func (r *eventRoutes) statuses() []sinks.SinkStatus {
+	names := make([]string, 0, len(r.sinks))
+	for name := range r.sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statuses := make([]sinks.SinkStatus, len(names))
+	for i, name := range names {
+		st := sinks.SinkStatus{Healthy: true}
+		if sr, ok := r.sinks[name].(sinks.StatusReporter); ok {
+			st = sr.Status()
+		}
+		st.Name = name
+		statuses[i] = st
+	}
+	return statuses
+}
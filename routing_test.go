@@ -0,0 +1,82 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/heptiolabs/eventrouter/sinks"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestEventRoutes(t *testing.T) {
+	newRoutes := func() []*eventRoute {
+		return []*eventRoute{
+			{Name: "prod-warnings", Expression: `Type == Warning && InvolvedObject.Namespace matches "prod-*"`, Sinks: []string{"Kafka"}},
+			{Name: "system", Expression: "InvolvedObject.Namespace == kube-system", Sinks: []string{"s3"}},
+			{Name: "scheduling", Expression: "Reason == FailedScheduling", Sinks: []string{"alert", "kafka"}},
+		}
+	}
+	event := func(ns, typ, reason string) *v1.Event {
+		return &v1.Event{Type: typ, Reason: reason, InvolvedObject: v1.ObjectReference{Namespace: ns}}
+	}
+
+	tests := []struct {
+		mode                 string
+		kafka, s3, alert     int
+		prodMatches, dropped float64
+	}{
+		{routeModeFirst, 1, 1, 0, 1, 1},
+		{routeModeAll, 1, 1, 1, 1, 1},
+	}
+	for _, test := range tests {
+		kafka, s3, alert := &recordingSink{}, &recordingSink{}, &recordingSink{}
+		r, err := newEventRoutes(newRoutes(), test.mode, map[string]sinks.EventSinkInterface{
+			"kafka": kafka, "s3": s3, "alert": alert,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.UpdateEvents(event("prod-web", v1.EventTypeWarning, "FailedScheduling"), nil)
+		r.UpdateEvents(event("kube-system", v1.EventTypeNormal, "Pulled"), nil)
+		r.UpdateEvents(event("dev", v1.EventTypeNormal, "Pulled"), nil)
+
+		if len(kafka.news) != test.kafka || len(s3.news) != test.s3 || len(alert.news) != test.alert {
+			t.Errorf("%s: expected kafka=%d s3=%d alert=%d, got %d %d %d", test.mode,
+				test.kafka, test.s3, test.alert, len(kafka.news), len(s3.news), len(alert.news))
+		}
+		if got := testutil.ToFloat64(r.matches.WithLabelValues("prod-warnings")); got != test.prodMatches {
+			t.Errorf("%s: expected %v prod-warnings matches, got %v", test.mode, test.prodMatches, got)
+		}
+		if got := testutil.ToFloat64(r.unmatched); got != test.dropped {
+			t.Errorf("%s: expected %v unmatched events, got %v", test.mode, test.dropped, got)
+		}
+		if st := r.statuses(); len(st) != 3 || st[0].Name != "alert" || !st[0].Healthy {
+			t.Errorf("%s: unexpected statuses %+v", test.mode, st)
+		}
+	}
+
+	if _, err := newEventRoutes(newRoutes(), routeModeFirst, map[string]sinks.EventSinkInterface{"kafka": &recordingSink{}}); err == nil {
+		t.Errorf("Expected an error for routes to unknown sinks")
+	}
+	if _, err := newEventRoutes(nil, "some", nil); err == nil {
+		t.Errorf("Expected an error for an invalid route mode")
+	}
+}
@@ -0,0 +1,430 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+	"github.com/sethgrid/pester"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// defaultAlertTemplate is used for rules that don't set a template
+	defaultAlertTemplate = `[{{.Severity}}] {{.Event.InvolvedObject.Kind}} {{.Event.InvolvedObject.Namespace}}/{{.Event.InvolvedObject.Name}}: {{.Event.Reason}} - {{.Event.Message}}`
+
+	// defaultAlertKeyTemplate is used for rules that don't set a key
+	defaultAlertKeyTemplate = `{{.Event.InvolvedObject.Kind}}/{{.Event.InvolvedObject.Namespace}}/{{.Event.InvolvedObject.Name}}/{{.Event.Reason}}`
+
+	// defaultAlertSeverity is used for rules that don't set a severity
+	defaultAlertSeverity = "warning"
+)
+
+// alertSeverityColors maps severities to the colors used by Slack and Teams
+var alertSeverityColors = map[string]string{
+	"critical": "#d50200",
+	"error":    "#d50200",
+	"warning":  "#de9e31",
+	"info":     "#2eb886",
+}
+
+// AlertRule selects the events to alert on and how the alert looks.
+type AlertRule struct {
+	// Name identifies the rule in logs and templates
+	Name string `mapstructure:"name"`
+
+	// Expression selects the events, see Expression for the syntax
+	Expression string `mapstructure:"expression"`
+
+	// Namespace is a glob pattern the namespace of the involved object must
+	// match. An empty pattern matches every namespace.
+	Namespace string `mapstructure:"namespace"`
+
+	// Template is a text/template rendered over an Alert to build the message
+	Template string `mapstructure:"template"`
+
+	// Key is a text/template rendered over an Alert. Alerts with the same key
+	// are deduplicated and silenced together.
+	Key string `mapstructure:"key"`
+
+	// DedupWindow is how long further alerts with the same key are dropped
+	// after one was sent
+	DedupWindow time.Duration `mapstructure:"dedupWindow"`
+
+	// Silences drop the alerts whose key matches during a time window
+	Silences []AlertSilence `mapstructure:"silences"`
+
+	// Severity is the severity of the alerts, unless Severities has an entry
+	// for the reason or the type of the event
+	Severity   string            `mapstructure:"severity"`
+	Severities map[string]string `mapstructure:"severities"`
+
+	// Receivers are the names of the receivers to notify
+	Receivers []string `mapstructure:"receivers"`
+
+	expr     *Expression
+	template *template.Template
+	key      *template.Template
+}
+
+// AlertSilence drops the alerts whose key matches the Key glob pattern between
+// Start and End. A zero Start or End leaves that side of the window open. In
+// the pattern, * matches any run of characters including /, so Pod/prod-batch/*
+// covers every reason of every pod of prod-batch, and ? matches a single
+// character.
+type AlertSilence struct {
+	Key   string    `mapstructure:"key"`
+	Start time.Time `mapstructure:"start"`
+	End   time.Time `mapstructure:"end"`
+
+	key *regexp.Regexp
+}
+
+// AlertReceiver is a destination for alerts.
+type AlertReceiver struct {
+	Name string `mapstructure:"name"`
+
+	// Type is one of slack, teams or webhook
+	Type string `mapstructure:"type"`
+
+	// URL is the incoming webhook URL
+	URL string `mapstructure:"url"`
+
+	// Template is a text/template rendered over an Alert to build the body of
+	// webhook requests. Alerts are sent as JSON when it is empty.
+	Template string `mapstructure:"template"`
+
+	// Headers are added to webhook requests
+	Headers map[string]string `mapstructure:"headers"`
+
+	template *template.Template
+}
+
+// Alert is the data that rule and receiver templates are rendered over. The
+// event data is embedded, so templates can refer to .Event and .OldEvent.
+type Alert struct {
+	EventData
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Key      string `json:"key"`
+	Message  string `json:"message"`
+}
+
+// AlertSink evaluates alert rules against the events and sends notifications
+// to Slack incoming webhooks, Microsoft Teams connectors or generic webhooks.
+type AlertSink struct {
+	rules     []*AlertRule
+	receivers map[string]*AlertReceiver
+
+	eventCh    channels.Channel
+	httpClient *pester.Client
+	stats      sinkStats
+
+	// lastSent is when the last alert was sent per rule and key, it is only
+	// used from the Run goroutine
+	lastSent map[string]time.Time
+}
+
+// NewAlertSink constructs a new AlertSink, compiling the expressions and
+// templates of the rules and receivers.
+func NewAlertSink(rules []*AlertRule, receivers []*AlertReceiver, overflow bool, bufferSize int) (*AlertSink, error) {
+	a := &AlertSink{
+		rules:     rules,
+		receivers: map[string]*AlertReceiver{},
+		lastSent:  map[string]time.Time{},
+	}
+
+	for _, r := range receivers {
+		switch r.Type {
+		case "slack", "teams":
+		case "webhook":
+			if r.Template != "" {
+				t, err := template.New(r.Name).Parse(r.Template)
+				if err != nil {
+					return nil, fmt.Errorf("invalid template for alert receiver %q: %v", r.Name, err)
+				}
+				r.template = t
+			}
+		default:
+			return nil, fmt.Errorf("invalid type %q for alert receiver %q, must be slack, teams or webhook", r.Type, r.Name)
+		}
+		if r.URL == "" {
+			return nil, fmt.Errorf("alert receiver %q has no url", r.Name)
+		}
+		a.receivers[r.Name] = r
+	}
+
+	for _, r := range rules {
+		var err error
+		if r.expr, err = ParseExpression(r.Expression); err != nil {
+			return nil, fmt.Errorf("alert rule %q: %v", r.Name, err)
+		}
+		if _, err := path.Match(r.Namespace, ""); err != nil {
+			return nil, fmt.Errorf("alert rule %q: invalid namespace pattern: %v", r.Name, err)
+		}
+		if r.Template == "" {
+			r.Template = defaultAlertTemplate
+		}
+		if r.template, err = template.New(r.Name).Parse(r.Template); err != nil {
+			return nil, fmt.Errorf("alert rule %q: invalid template: %v", r.Name, err)
+		}
+		if r.Key == "" {
+			r.Key = defaultAlertKeyTemplate
+		}
+		if r.key, err = template.New(r.Name).Parse(r.Key); err != nil {
+			return nil, fmt.Errorf("alert rule %q: invalid key: %v", r.Name, err)
+		}
+		for i := range r.Silences {
+			r.Silences[i].key = silenceKeyRegexp(r.Silences[i].Key)
+		}
+		if r.Severity == "" {
+			r.Severity = defaultAlertSeverity
+		}
+		for _, name := range r.Receivers {
+			if _, ok := a.receivers[name]; !ok {
+				return nil, fmt.Errorf("alert rule %q refers to unknown receiver %q", r.Name, name)
+			}
+		}
+	}
+
+	if overflow {
+		a.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		a.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	a.httpClient = pester.New()
+	a.httpClient.Backoff = pester.ExponentialJitterBackoff
+	a.httpClient.MaxRetries = 5
+
+	return a, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, rules are evaluated in Run.
+func (a *AlertSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	a.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Status implements the StatusReporter interface
+func (a *AlertSink) Status() SinkStatus {
+	return a.stats.status(a.eventCh.Len())
+}
+
+// Run sits in a loop, waiting for data to come in through a.eventCh and
+// sending an alert for every rule the events match.
+func (a *AlertSink) Run(stopCh <-chan bool) {
+	prune := time.NewTicker(time.Minute)
+	defer prune.Stop()
+loop:
+	for {
+		select {
+		case e := <-a.eventCh.Out():
+			evt, ok := e.(EventData)
+			if !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+			for _, r := range a.rules {
+				a.evaluate(r, evt, time.Now())
+			}
+		case <-prune.C:
+			a.prune(time.Now())
+		case <-stopCh:
+			break loop
+		}
+	}
+}
+
+// evaluate sends an alert to the receivers of the rule if the event matches it
+// and its key is neither deduplicated nor silenced.
+func (a *AlertSink) evaluate(r *AlertRule, evt EventData, now time.Time) {
+	if ok, _ := path.Match(r.Namespace, evt.Event.InvolvedObject.Namespace); r.Namespace != "" && !ok {
+		return
+	}
+	if !r.expr.Match(evt) {
+		return
+	}
+
+	alert := &Alert{
+		EventData: evt,
+		Rule:      r.Name,
+		Severity:  r.severityFor(evt.Event),
+	}
+	var buf bytes.Buffer
+	if err := r.key.Execute(&buf, alert); err != nil {
+		glog.Warningf("Failed to render key of alert rule %q: %v", r.Name, err)
+		return
+	}
+	alert.Key = buf.String()
+
+	if r.silenced(alert.Key, now) {
+		glog.V(4).Infof("Alert %q for %s is silenced", r.Name, alert.Key)
+		return
+	}
+	dedupKey := r.Name + "\xff" + alert.Key
+	if last, ok := a.lastSent[dedupKey]; ok && now.Sub(last) < r.DedupWindow {
+		glog.V(4).Infof("Alert %q for %s was already sent at %v", r.Name, alert.Key, last)
+		return
+	}
+
+	buf.Reset()
+	if err := r.template.Execute(&buf, alert); err != nil {
+		glog.Warningf("Failed to render template of alert rule %q: %v", r.Name, err)
+		return
+	}
+	alert.Message = buf.String()
+
+	a.lastSent[dedupKey] = now
+	for _, name := range r.Receivers {
+		if err := a.send(a.receivers[name], alert); err != nil {
+			glog.Warningf("Failed to send alert %q to %q: %v", r.Name, name, err)
+			a.stats.sendFailed(err)
+		} else {
+			a.stats.sendSucceeded()
+		}
+	}
+}
+
+// prune forgets the alerts sent longer ago than the dedup window of any rule
+func (a *AlertSink) prune(now time.Time) {
+	var window time.Duration
+	for _, r := range a.rules {
+		if r.DedupWindow > window {
+			window = r.DedupWindow
+		}
+	}
+	for k, last := range a.lastSent {
+		if now.Sub(last) >= window {
+			delete(a.lastSent, k)
+		}
+	}
+}
+
+// severityFor maps the reason or, failing that, the type of the event to a
+// severity
+func (r *AlertRule) severityFor(e *v1.Event) string {
+	if s, ok := r.Severities[e.Reason]; ok {
+		return s
+	}
+	if s, ok := r.Severities[e.Type]; ok {
+		return s
+	}
+	return r.Severity
+}
+
+// silenceKeyRegexp translates the glob pattern of a silence into an anchored
+// regular expression, where * also matches /
+func silenceKeyRegexp(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteByte('.')
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteByte('$')
+	return regexp.MustCompile(b.String())
+}
+
+// silenced returns true if one of the silences of the rule covers the key now
+func (r *AlertRule) silenced(key string, now time.Time) bool {
+	for _, s := range r.Silences {
+		if !s.key.MatchString(key) {
+			continue
+		}
+		if (s.Start.IsZero() || !now.Before(s.Start)) && (s.End.IsZero() || now.Before(s.End)) {
+			return true
+		}
+	}
+	return false
+}
+
+// send posts the alert to a receiver in the format it expects
+func (a *AlertSink) send(r *AlertReceiver, alert *Alert) error {
+	color := alertSeverityColors[strings.ToLower(alert.Severity)]
+
+	var body []byte
+	var err error
+	contentType := "application/json"
+	switch r.Type {
+	case "slack":
+		body, err = json.Marshal(map[string]interface{}{
+			"attachments": []map[string]interface{}{{
+				"color":    color,
+				"fallback": alert.Message,
+				"text":     alert.Message,
+			}},
+		})
+	case "teams":
+		body, err = json.Marshal(map[string]interface{}{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"themeColor": strings.TrimPrefix(color, "#"),
+			"summary":    alert.Message,
+			"title":      alert.Rule,
+			"text":       alert.Message,
+		})
+	default:
+		if r.template == nil {
+			body, err = json.Marshal(alert)
+			break
+		}
+		var buf bytes.Buffer
+		err = r.template.Execute(&buf, alert)
+		body = buf.Bytes()
+		contentType = "text/plain"
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", r.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got HTTP code %v from %v", resp.StatusCode, r.Name)
+	}
+	return nil
+}
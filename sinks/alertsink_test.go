@@ -0,0 +1,162 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestAlertSink(t *testing.T) {
+	var bodies []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		var body map[string]interface{}
+		if err := json.Unmarshal(b, &body); err != nil {
+			t.Errorf("Invalid JSON body %q: %v", b, err)
+		}
+		bodies = append(bodies, body)
+	}))
+	defer srv.Close()
+
+	now := time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)
+	rules := []*AlertRule{{
+		Name:        "oom",
+		Expression:  "Type == Warning && Reason == OOMKilling",
+		Namespace:   "prod-*",
+		DedupWindow: time.Minute,
+		Severities:  map[string]string{"OOMKilling": "critical"},
+		Silences: []AlertSilence{{
+			Key:   "*/prod-web/silenced/*",
+			Start: now.Add(-time.Hour),
+			End:   now.Add(time.Hour),
+		}},
+		Receivers: []string{"slack", "teams"},
+	}}
+	receivers := []*AlertReceiver{
+		{Name: "slack", Type: "slack", URL: srv.URL},
+		{Name: "teams", Type: "teams", URL: srv.URL},
+	}
+	a, err := NewAlertSink(rules, receivers, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := func(ns, name, reason string) EventData {
+		e := &v1.Event{Type: v1.EventTypeWarning, Reason: reason, Message: "out of memory"}
+		e.InvolvedObject = v1.ObjectReference{Kind: "Pod", Namespace: ns, Name: name}
+		return NewEventData(e, nil)
+	}
+
+	a.evaluate(rules[0], event("prod-web", "web-1", "OOMKilling"), now)
+	if len(bodies) != 2 {
+		t.Fatalf("Expected one alert per receiver, got %d", len(bodies))
+	}
+	attachment := bodies[0]["attachments"].([]interface{})[0].(map[string]interface{})
+	if want := "[critical] Pod prod-web/web-1: OOMKilling - out of memory"; attachment["text"] != want {
+		t.Errorf("Expected Slack text %q, got %q", want, attachment["text"])
+	}
+	if bodies[1]["@type"] != "MessageCard" || bodies[1]["title"] != "oom" {
+		t.Errorf("Unexpected Teams card %v", bodies[1])
+	}
+
+	// Deduplicated within the window, sent again after it.
+	a.evaluate(rules[0], event("prod-web", "web-1", "OOMKilling"), now.Add(30*time.Second))
+	if len(bodies) != 2 {
+		t.Errorf("Expected a duplicate alert to be dropped")
+	}
+	a.evaluate(rules[0], event("prod-web", "web-1", "OOMKilling"), now.Add(2*time.Minute))
+	if len(bodies) != 4 {
+		t.Errorf("Expected the alert to be sent again after the dedup window")
+	}
+
+	// Filtered out by the expression, the namespace and the silence.
+	a.evaluate(rules[0], event("prod-web", "web-2", "BackOff"), now)
+	a.evaluate(rules[0], event("dev", "web-2", "OOMKilling"), now)
+	a.evaluate(rules[0], event("prod-web", "silenced", "OOMKilling"), now)
+	if len(bodies) != 4 {
+		t.Errorf("Expected no further alerts, got %d", len(bodies)-4)
+	}
+
+	a.prune(now.Add(time.Hour))
+	if len(a.lastSent) != 0 {
+		t.Errorf("Expected prune to forget old alerts")
+	}
+}
+
+func TestAlertSinkConfigErrors(t *testing.T) {
+	receivers := []*AlertReceiver{{Name: "hook", Type: "webhook", URL: "http://localhost"}}
+	tests := []struct {
+		name      string
+		rule      AlertRule
+		receivers []*AlertReceiver
+	}{
+		{"bad expression", AlertRule{Expression: "Reason ==", Receivers: []string{"hook"}}, receivers},
+		{"bad template", AlertRule{Template: "{{.Nope", Receivers: []string{"hook"}}, receivers},
+		{"unknown receiver", AlertRule{Receivers: []string{"pager"}}, receivers},
+		{"bad receiver type", AlertRule{}, []*AlertReceiver{{Name: "x", Type: "email", URL: "x"}}},
+	}
+	for _, test := range tests {
+		rule := test.rule
+		if _, err := NewAlertSink([]*AlertRule{&rule}, test.receivers, false, 0); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestAlertSinkSilenceDefaultKey(t *testing.T) {
+	sent := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent++
+	}))
+	defer srv.Close()
+
+	now := time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)
+	rules := []*AlertRule{{
+		Name:      "all",
+		Silences:  []AlertSilence{{Key: "Pod/prod-batch/*", End: now.Add(time.Hour)}},
+		Receivers: []string{"hook"},
+	}}
+	a, err := NewAlertSink(rules, []*AlertReceiver{{Name: "hook", Type: "webhook", URL: srv.URL}}, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := func(kind, ns, name string) EventData {
+		e := &v1.Event{Type: v1.EventTypeWarning, Reason: "BackOff"}
+		e.InvolvedObject = v1.ObjectReference{Kind: kind, Namespace: ns, Name: name}
+		return NewEventData(e, nil)
+	}
+
+	// The default key is Kind/Namespace/Name/Reason, * covers the last two
+	a.evaluate(rules[0], event("Pod", "prod-batch", "job-1"), now)
+	if sent != 0 {
+		t.Errorf("Expected the silence to drop the alert for Pod/prod-batch/job-1/BackOff")
+	}
+	a.evaluate(rules[0], event("Job", "prod-batch", "job-1"), now)
+	a.evaluate(rules[0], event("Pod", "prod-web", "web-1"), now)
+	a.evaluate(rules[0], event("Pod", "prod-batch", "job-2"), now.Add(2*time.Hour))
+	if sent != 3 {
+		t.Errorf("Expected 3 alerts outside the silence, got %d", sent)
+	}
+}
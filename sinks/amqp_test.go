@@ -0,0 +1,201 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakeAMQPBroker stands in for the channels of a broker. confirm tells how
+// to answer the nth message published: "ack", "nack", or "close" to close
+// the channel without confirming it.
+type fakeAMQPBroker struct {
+	dials   int
+	keys    []string
+	msgs    []amqp.Publishing
+	confirm func(n int) string
+}
+
+// fakeAMQPChannel is a channel in confirm mode of fakeAMQPBroker
+type fakeAMQPChannel struct {
+	broker  *fakeAMQPBroker
+	session *amqpSession
+	tag     uint64
+	closed  bool
+}
+
+func (c *fakeAMQPChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b := c.broker
+	b.keys = append(b.keys, exchange+"/"+key)
+	b.msgs = append(b.msgs, msg)
+	c.tag++
+	if c.closed {
+		// The broker never sees it
+		return nil
+	}
+	switch b.confirm(len(b.msgs)) {
+	case "ack":
+		c.session.confirms <- amqp.Confirmation{DeliveryTag: c.tag, Ack: true}
+	case "nack":
+		c.session.confirms <- amqp.Confirmation{DeliveryTag: c.tag, Ack: false}
+	case "close":
+		c.closed = true
+		c.session.closed <- &amqp.Error{Code: amqp.ChannelError, Reason: "channel closed"}
+	}
+	return nil
+}
+
+func (b *fakeAMQPBroker) dial() (*amqpSession, error) {
+	b.dials++
+	s := &amqpSession{
+		confirms: make(chan amqp.Confirmation, amqpMaxUnconfirmed),
+		closed:   make(chan *amqp.Error, 1),
+	}
+	s.channel = &fakeAMQPChannel{broker: b, session: s}
+	return s, nil
+}
+
+func newTestAMQPSink(t *testing.T, b *fakeAMQPBroker) *AMQPSink {
+	a, err := NewAMQPSink("amqp://localhost", "events", nil, false, 10, mustGetFormatter("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.dial = b.dial
+	a.retryBackoff = 0
+	return a
+}
+
+func amqpTestEvents(n int) []EventData {
+	var events []EventData
+	for i := 0; i < n; i++ {
+		e := formatTestEvent()
+		e.Event.UID = types.UID([]string{"a", "b", "c"}[i])
+		e.Event.ResourceVersion = "1"
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestAMQPSink(t *testing.T) {
+	b := &fakeAMQPBroker{confirm: func(n int) string { return "ack" }}
+	a := newTestAMQPSink(t, b)
+
+	if err := a.HealthCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SendEvents(amqpTestEvents(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.dials != 1 || len(b.msgs) != 2 {
+		t.Fatalf("Expected 2 messages on one channel, got %d on %d", len(b.msgs), b.dials)
+	}
+	if b.keys[0] != "events/prod.Warning.BackOff" {
+		t.Errorf("Expected routing key prod.Warning.BackOff on exchange events, got %s", b.keys[0])
+	}
+	msg := b.msgs[0]
+	if msg.DeliveryMode != amqp.Persistent || msg.MessageId != "a.1" {
+		t.Errorf("Expected a persistent message with ID a.1, got %+v", msg)
+	}
+	want := map[string]string{"namespace": "prod", "kind": "Pod", "name": "web-1", "reason": "BackOff", "type": "Warning", "verb": "ADDED"}
+	for k, v := range want {
+		if msg.Headers[k] != v {
+			t.Errorf("Expected header %s=%s, got %v", k, v, msg.Headers[k])
+		}
+	}
+}
+
+func TestAMQPSinkTimestamp(t *testing.T) {
+	a := newTestAMQPSink(t, &fakeAMQPBroker{})
+	eventTime := time.Date(2019, 9, 2, 8, 0, 0, 0, time.UTC)
+	created := time.Date(2019, 9, 3, 8, 0, 0, 0, time.UTC)
+
+	e := amqpTestEvents(1)[0]
+	e.Event.LastTimestamp = metav1.Time{}
+	e.Event.EventTime = metav1.NewMicroTime(eventTime)
+	e.Event.CreationTimestamp = metav1.NewTime(created)
+	out, err := a.newMessage(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.msg.Timestamp.Equal(eventTime) {
+		t.Errorf("Expected the event time %v, got %v", eventTime, out.msg.Timestamp)
+	}
+
+	e.Event.EventTime = metav1.MicroTime{}
+	if out, _ = a.newMessage(e); !out.msg.Timestamp.Equal(created) {
+		t.Errorf("Expected the creation time %v, got %v", created, out.msg.Timestamp)
+	}
+}
+
+func TestAMQPSinkRetriesNacks(t *testing.T) {
+	b := &fakeAMQPBroker{confirm: func(n int) string {
+		if n == 2 {
+			return "nack"
+		}
+		return "ack"
+	}}
+	a := newTestAMQPSink(t, b)
+
+	if err := a.SendEvents(amqpTestEvents(3)); err != nil {
+		t.Fatal(err)
+	}
+	// Only the rejected message is retried, on the same channel
+	if b.dials != 1 || len(b.msgs) != 4 || b.msgs[3].MessageId != "b.1" {
+		t.Errorf("Expected b.1 to be retried on the same channel, got %d messages on %d channels", len(b.msgs), b.dials)
+	}
+}
+
+func TestAMQPSinkReconnects(t *testing.T) {
+	b := &fakeAMQPBroker{confirm: func(n int) string {
+		if n == 1 {
+			return "close"
+		}
+		return "ack"
+	}}
+	a := newTestAMQPSink(t, b)
+
+	if err := a.SendEvents(amqpTestEvents(2)); err != nil {
+		t.Fatal(err)
+	}
+	// The unconfirmed messages are retried on a new channel
+	if b.dials != 2 {
+		t.Errorf("Expected a new channel, got %d", b.dials)
+	}
+	var ids []string
+	for _, m := range b.msgs[2:] {
+		ids = append(ids, m.MessageId)
+	}
+	if len(ids) != 2 || ids[0] != "a.1" || ids[1] != "b.1" {
+		t.Errorf("Expected a.1 and b.1 to be retried, got %v", ids)
+	}
+
+	// The error is reported once the retries are exhausted
+	b.confirm = func(n int) string { return "close" }
+	a.MaxRetries = 1
+	if err := a.SendEvents(amqpTestEvents(1)); err == nil {
+		t.Fatal("Expected an error once the retries are exhausted")
+	}
+	if a.Status().LastError == "" {
+		t.Errorf("Expected the error in the sink status")
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// SchemaFormatter is implemented by binary formats with a schema that can be
+// registered with a schema registry
+type SchemaFormatter interface {
+	Formatter
+	Schema() string
+}
+
+// EventDataAvroSchema is the Avro schema of the avro format. It is also
+// published as schema/eventdata.avsc.
+const EventDataAvroSchema = `{
+  "type": "record",
+  "name": "EventData",
+  "namespace": "com.heptio.eventrouter",
+  "fields": [
+    {"name": "verb", "type": "string"},
+    {"name": "event", "type": {
+      "type": "record",
+      "name": "Event",
+      "fields": [
+        {"name": "uid", "type": "string"},
+        {"name": "name", "type": "string"},
+        {"name": "namespace", "type": "string"},
+        {"name": "resource_version", "type": "string"},
+        {"name": "type", "type": "string"},
+        {"name": "reason", "type": "string"},
+        {"name": "message", "type": "string"},
+        {"name": "count", "type": "int"},
+        {"name": "first_timestamp", "type": ["null", {"type": "long", "logicalType": "timestamp-millis"}], "default": null},
+        {"name": "last_timestamp", "type": ["null", {"type": "long", "logicalType": "timestamp-millis"}], "default": null},
+        {"name": "event_time", "type": ["null", {"type": "long", "logicalType": "timestamp-millis"}], "default": null},
+        {"name": "involved_object", "type": {
+          "type": "record",
+          "name": "ObjectReference",
+          "fields": [
+            {"name": "kind", "type": "string"},
+            {"name": "namespace", "type": "string"},
+            {"name": "name", "type": "string"},
+            {"name": "uid", "type": "string"},
+            {"name": "api_version", "type": "string"},
+            {"name": "resource_version", "type": "string"},
+            {"name": "field_path", "type": "string"}
+          ]
+        }},
+        {"name": "source", "type": {
+          "type": "record",
+          "name": "EventSource",
+          "fields": [
+            {"name": "component", "type": "string"},
+            {"name": "host", "type": "string"}
+          ]
+        }},
+        {"name": "reporting_component", "type": "string"},
+        {"name": "reporting_instance", "type": "string"},
+        {"name": "labels", "type": {"type": "map", "values": "string"}},
+        {"name": "annotations", "type": {"type": "map", "values": "string"}}
+      ]
+    }},
+    {"name": "old_event", "type": ["null", "Event"], "default": null}
+  ]
+}
+`
+
+// avroFormatter writes the event data in the Avro binary encoding of
+// EventDataAvroSchema, without any container or registry framing
+type avroFormatter struct{}
+
+// Format implements the Formatter interface
+func (avroFormatter) Format(e EventData) ([]byte, error) {
+	var b bytes.Buffer
+	avroString(&b, e.Verb)
+	avroEvent(&b, e.Event)
+	if e.OldEvent == nil {
+		avroLong(&b, 0)
+	} else {
+		avroLong(&b, 1)
+		avroEvent(&b, e.OldEvent)
+	}
+	return b.Bytes(), nil
+}
+
+// Schema implements the SchemaFormatter interface
+func (avroFormatter) Schema() string {
+	return EventDataAvroSchema
+}
+
+// avroEvent writes an Event record. The fields must stay in schema order.
+func avroEvent(b *bytes.Buffer, e *v1.Event) {
+	if e == nil {
+		e = &v1.Event{}
+	}
+	avroString(b, string(e.UID))
+	avroString(b, e.Name)
+	avroString(b, e.Namespace)
+	avroString(b, e.ResourceVersion)
+	avroString(b, e.Type)
+	avroString(b, e.Reason)
+	avroString(b, e.Message)
+	avroLong(b, int64(e.Count))
+	avroTimestamp(b, unixMillis(e.FirstTimestamp.Time))
+	avroTimestamp(b, unixMillis(e.LastTimestamp.Time))
+	avroTimestamp(b, unixMillis(e.EventTime.Time))
+
+	avroString(b, e.InvolvedObject.Kind)
+	avroString(b, e.InvolvedObject.Namespace)
+	avroString(b, e.InvolvedObject.Name)
+	avroString(b, string(e.InvolvedObject.UID))
+	avroString(b, e.InvolvedObject.APIVersion)
+	avroString(b, e.InvolvedObject.ResourceVersion)
+	avroString(b, e.InvolvedObject.FieldPath)
+
+	avroString(b, e.Source.Component)
+	avroString(b, e.Source.Host)
+
+	avroString(b, e.ReportingController)
+	avroString(b, e.ReportingInstance)
+	avroMap(b, e.Labels)
+	avroMap(b, e.Annotations)
+}
+
+// avroLong writes an int or long as a zig-zag varint
+func avroLong(b *bytes.Buffer, v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	b.Write(buf[:n])
+}
+
+func avroString(b *bytes.Buffer, s string) {
+	avroLong(b, int64(len(s)))
+	b.WriteString(s)
+}
+
+// avroTimestamp writes a nullable timestamp, where 0 is null
+func avroTimestamp(b *bytes.Buffer, ms int64) {
+	if ms == 0 {
+		avroLong(b, 0)
+		return
+	}
+	avroLong(b, 1)
+	avroLong(b, ms)
+}
+
+// avroMap writes a map of strings as a single block of sorted entries
+func avroMap(b *bytes.Buffer, m map[string]string) {
+	if len(m) > 0 {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		avroLong(b, int64(len(keys)))
+		for _, k := range keys {
+			avroString(b, k)
+			avroString(b, m[k])
+		}
+	}
+	avroLong(b, 0)
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// avroReader decodes the primitive types of the Avro binary encoding
+type avroReader struct {
+	t *testing.T
+	r *bytes.Reader
+}
+
+func (a avroReader) long() int64 {
+	v, err := binary.ReadVarint(a.r)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return v
+}
+
+func (a avroReader) str() string {
+	b := make([]byte, a.long())
+	if _, err := a.r.Read(b); err != nil && len(b) > 0 {
+		a.t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestAvroSchemaFile(t *testing.T) {
+	file, err := ioutil.ReadFile("schema/eventdata.avsc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var published, schema interface{}
+	if err := json.Unmarshal(file, &published); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(EventDataAvroSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(published, schema) {
+		t.Errorf("schema/eventdata.avsc is out of date with EventDataAvroSchema")
+	}
+}
+
+func TestAvroFormat(t *testing.T) {
+	e := formatTestEvent()
+	e.Event.Labels = map[string]string{"team": "web"}
+	msg, err := mustGetFormatter("avro").Format(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := avroReader{t, bytes.NewReader(msg)}
+	if v := a.str(); v != "ADDED" {
+		t.Errorf("Expected verb ADDED, got %s", v)
+	}
+	got := []string{a.str(), a.str(), a.str(), a.str(), a.str(), a.str(), a.str()}
+	want := []string{"", "web-1.15c", "prod", "", "Warning", "BackOff", `Back-off restarting failed container "app"`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if c := a.long(); c != 3 {
+		t.Errorf("Expected count 3, got %d", c)
+	}
+	if u := a.long(); u != 0 {
+		t.Errorf("Expected a null first timestamp, got union branch %d", u)
+	}
+	if u, ts := a.long(), a.long(); u != 1 || ts != 1567339200000 {
+		t.Errorf("Expected last timestamp 1567339200000, got %d (branch %d)", ts, u)
+	}
+	a.long() // event_time
+	got = []string{a.str(), a.str(), a.str(), a.str(), a.str(), a.str(), a.str(), a.str(), a.str(), a.str(), a.str()}
+	want = []string{"Pod", "prod", "web-1", "", "", "", "", "kubelet", "node-1", "", ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if n, k, v, end := a.long(), a.str(), a.str(), a.long(); n != 1 || k != "team" || v != "web" || end != 0 {
+		t.Errorf("Unexpected labels block %d %s=%s %d", n, k, v, end)
+	}
+	if n := a.long(); n != 0 {
+		t.Errorf("Expected no annotations, got %d", n)
+	}
+	if u := a.long(); u != 0 {
+		t.Errorf("Expected a null old event, got union branch %d", u)
+	}
+	if a.r.Len() != 0 {
+		t.Errorf("Expected the whole message to be read, %d bytes left", a.r.Len())
+	}
+}
+
+func TestSchemaRegistryFormatter(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path != "/subjects/eventrouter-value/versions" || r.Method != "POST" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if user, pwd, _ := r.BasicAuth(); user != "alice" || pwd != "secret" {
+			t.Errorf("Expected basic auth, got %s:%s", user, pwd)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != schemaRegistryContentType {
+			t.Errorf("Unexpected content type %s", ct)
+		}
+		var req struct {
+			Schema string `json:"schema"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Schema != EventDataAvroSchema {
+			t.Errorf("Expected the EventData schema to be registered")
+		}
+		w.Write([]byte(`{"id":258}`))
+	}))
+	defer srv.Close()
+
+	u := strings.Replace(srv.URL, "http://", "http://alice:secret@", 1)
+	f, err := NewSchemaRegistryFormatter(avroFormatter{}, u, "eventrouter-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := avroFormatter{}.Format(formatTestEvent())
+	for i := 0; i < 2; i++ {
+		msg, err := f.Format(formatTestEvent())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append([]byte{0, 0, 0, 1, 2}, plain...)
+		if !bytes.Equal(msg, want) {
+			t.Errorf("Expected a framed message with schema id 258, got % x", msg[:5])
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the schema to be registered once, got %d calls", calls)
+	}
+}
+
+func TestSchemaRegistryFormatterError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error_code":409,"message":"incompatible schema"}`, http.StatusConflict)
+	}))
+	defer srv.Close()
+
+	if _, err := NewSchemaRegistryFormatter(avroFormatter{}, srv.URL+"/", "events"); err == nil || !strings.Contains(err.Error(), "incompatible schema") {
+		t.Errorf("Expected an error when the registry rejects the schema, got %v", err)
+	}
+
+	srv.Close()
+	if _, err := NewSchemaRegistryFormatter(avroFormatter{}, srv.URL, "events"); err == nil {
+		t.Errorf("Expected an error when the registry is unreachable")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/golang/glog"
+)
+
+// newAWSSession creates the session of the AWS sinks. Static credentials are
+// used when given, and otherwise the default credential chain (environment,
+// shared config, then the instance or pod role). A non-empty endpoint
+// overrides that of the service, to use a local stand-in such as LocalStack.
+func newAWSSession(accessKeyID, secretAccessKey, region, endpoint string) (*session.Session, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(region),
+	}
+	if accessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(accessKeyID, secretAccessKey, "")
+	}
+	if endpoint != "" {
+		// Stand-ins don't serve virtual hosted buckets
+		awsConfig = awsConfig.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+
+	awsConfig = awsConfig.WithCredentialsChainVerboseErrors(true)
+	return session.NewSession(awsConfig)
+}
+
+// awsRecord is a record of a Kinesis or Firehose stream. Firehose records
+// have no partition key.
+type awsRecord struct {
+	data []byte
+	key  string
+}
+
+// size is what the record counts for in the request limits
+func (r awsRecord) size() int {
+	return len(r.data) + len(r.key)
+}
+
+// awsPutFunc puts records in a single request. It returns the records that
+// failed, along with the error code of the first of them.
+type awsPutFunc func(records []awsRecord) (failed []awsRecord, code string, err error)
+
+// awsBatches splits records into requests of at most maxCount records and
+// maxBytes bytes. Records over maxRecordBytes are logged and dropped, as no
+// request would take them.
+func awsBatches(records []awsRecord, maxCount, maxBytes, maxRecordBytes int) [][]awsRecord {
+	var batches [][]awsRecord
+	var batch []awsRecord
+	var size int
+	for _, r := range records {
+		if r.size() > maxRecordBytes {
+			glog.Warningf("Dropping a record of %d bytes, over the maximum of %d", r.size(), maxRecordBytes)
+			continue
+		}
+		if len(batch) > 0 && (len(batch) >= maxCount || size+r.size() > maxBytes) {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, r)
+		size += r.size()
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// putAWSRecords puts a batch of records. Failed requests are already retried
+// by the SDK, so only the records that failed in a partial failure are
+// retried here, with exponential backoff.
+func putAWSRecords(records []awsRecord, put awsPutFunc, maxRetries int, backoff time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		failed, code, err := put(records)
+		if err != nil {
+			return err
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		if attempt >= maxRetries {
+			return fmt.Errorf("%d of %d records failed: %s", len(failed), len(records), code)
+		}
+		glog.Warningf("Retrying %d of %d records in %v: %s", len(failed), len(records), backoff, code)
+		time.Sleep(backoff)
+		backoff *= 2
+		records = failed
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAWSRecord is a record put in a fake stream
+type fakeAWSRecord struct {
+	Data         []byte
+	PartitionKey string
+}
+
+// fakeAWSStreams is a stand-in for the Kinesis and Firehose JSON APIs, like
+// LocalStack. fail tells whether the nth record put should fail.
+type fakeAWSStreams struct {
+	mu       sync.Mutex
+	requests [][]fakeAWSRecord
+	puts     int
+	fail     func(n int) bool
+}
+
+func (f *fakeAWSStreams) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	target := r.Header.Get("X-Amz-Target")
+	switch target {
+	case "Kinesis_20131202.DescribeStreamSummary", "Firehose_20150804.DescribeDeliveryStream":
+		w.Write([]byte(`{}`))
+		return
+	case "Kinesis_20131202.PutRecords", "Firehose_20150804.PutRecordBatch":
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"UnknownOperationException","message":"` + target + `"}`))
+		return
+	}
+
+	var req struct {
+		Records []fakeAWSRecord
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	f.requests = append(f.requests, req.Records)
+
+	var results []map[string]string
+	var failed int
+	for range req.Records {
+		f.puts++
+		if f.fail != nil && f.fail(f.puts) {
+			failed++
+			results = append(results, map[string]string{"ErrorCode": "ProvisionedThroughputExceededException", "ErrorMessage": "slow down"})
+		} else {
+			results = append(results, map[string]string{"SequenceNumber": "1", "ShardId": "shardId-000000000000", "RecordId": "1"})
+		}
+	}
+
+	if target == "Kinesis_20131202.PutRecords" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"FailedRecordCount": failed, "Records": results})
+	} else {
+		json.NewEncoder(w).Encode(map[string]interface{}{"FailedPutCount": failed, "RequestResponses": results})
+	}
+}
+
+func TestAWSBatches(t *testing.T) {
+	record := func(size int) awsRecord {
+		return awsRecord{data: []byte(strings.Repeat("x", size-1)), key: "k"}
+	}
+	records := []awsRecord{record(400), record(400), record(5000), record(400), record(400), record(400)}
+
+	// The 5000 byte record is dropped, and the count limit splits the rest
+	batches := awsBatches(records, 3, 1000, 1000)
+	if len(batches) != 3 {
+		t.Fatalf("Expected 3 batches, got %d", len(batches))
+	}
+	for i, want := range []int{2, 2, 1} {
+		if len(batches[i]) != want {
+			t.Errorf("Expected %d records in batch %d, got %d", want, i, len(batches[i]))
+		}
+	}
+
+	batches = awsBatches(records, 3, 10000, 10000)
+	if len(batches) != 2 || len(batches[0]) != 3 || len(batches[1]) != 3 {
+		t.Errorf("Expected 2 batches of 3 records, got %v", batches)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+/*
+CircuitBreaker wraps a sink that implements HealthChecker. The sink is probed
+every probeInterval. After failureThreshold consecutive failed probes the
+circuit opens: events are no longer handed to the sink but held in a bounded
+buffer, dropping the oldest ones when it is full. The sink keeps being probed,
+and as soon as a probe succeeds the buffered events are replayed in order and
+the circuit closes again.
+*/
+type CircuitBreaker struct {
+	sink    EventSinkInterface
+	checker HealthChecker
+
+	probeInterval    time.Duration
+	failureThreshold int
+	bufferSize       int
+
+	// mu guards everything below
+	mu       sync.Mutex
+	open     bool
+	failures int
+	lastErr  error
+	buffer   []EventData
+	dropped  int
+}
+
+// NewCircuitBreaker wraps the given sink, which must implement HealthChecker,
+// in a CircuitBreaker.
+func NewCircuitBreaker(sink EventSinkInterface, probeInterval time.Duration, failureThreshold int, bufferSize int) *CircuitBreaker {
+	return &CircuitBreaker{
+		sink:             sink,
+		checker:          sink.(HealthChecker),
+		probeInterval:    probeInterval,
+		failureThreshold: failureThreshold,
+		bufferSize:       bufferSize,
+	}
+}
+
+// UpdateEvents implements the EventSinkInterface. Events are passed straight
+// through while the circuit is closed and buffered while it is open.
+func (cb *CircuitBreaker) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	cb.mu.Lock()
+	if !cb.open {
+		cb.mu.Unlock()
+		cb.sink.UpdateEvents(eNew, eOld)
+		return
+	}
+	defer cb.mu.Unlock()
+
+	if len(cb.buffer) >= cb.bufferSize {
+		cb.buffer = cb.buffer[1:]
+		cb.dropped++
+	}
+	cb.buffer = append(cb.buffer, NewEventData(eNew, eOld))
+}
+
+// SendEvents implements the BatchSender interface, so that a disk queue in
+// front of the circuit breaker keeps events spooled while the circuit is open.
+func (cb *CircuitBreaker) SendEvents(events []EventData) error {
+	cb.mu.Lock()
+	open, lastErr := cb.open, cb.lastErr
+	cb.mu.Unlock()
+	if open {
+		return fmt.Errorf("circuit is open: %v", lastErr)
+	}
+
+	if bs, ok := cb.sink.(BatchSender); ok {
+		return bs.SendEvents(events)
+	}
+	for _, evt := range events {
+		resend(cb.sink, evt)
+	}
+	return nil
+}
+
+// Status implements the StatusReporter interface. The wrapped sink is reported
+// as unhealthy while the circuit is open.
+func (cb *CircuitBreaker) Status() SinkStatus {
+	st := SinkStatus{Healthy: true}
+	if r, ok := cb.sink.(StatusReporter); ok {
+		st = r.Status()
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	st.CircuitOpen = cb.open
+	st.BufferDepth += len(cb.buffer)
+	if cb.open {
+		st.Healthy = false
+		if cb.lastErr != nil {
+			st.LastError = cb.lastErr.Error()
+		}
+	}
+	return st
+}
+
+// Run probes the wrapped sink every probeInterval until stopCh is closed or
+// written to.
+func (cb *CircuitBreaker) Run(stopCh <-chan bool) {
+	ticker := time.NewTicker(cb.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cb.probe()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// probe runs a single health check and opens or closes the circuit
+// accordingly.
+func (cb *CircuitBreaker) probe() {
+	err := cb.checker.HealthCheck()
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if err != nil {
+		cb.failures++
+		cb.lastErr = err
+		if !cb.open && cb.failures >= cb.failureThreshold {
+			glog.Warningf("Sink failed %d health checks, opening circuit: %v", cb.failures, err)
+			cb.open = true
+		}
+		return
+	}
+
+	cb.failures = 0
+	cb.lastErr = nil
+	if !cb.open {
+		return
+	}
+
+	glog.Infof("Sink recovered, replaying %d buffered events (%d dropped)", len(cb.buffer), cb.dropped)
+	cb.dropped = 0
+
+	// The circuit stays open during the replay, so that new events are
+	// buffered behind the replayed ones instead of overtaking them, but the
+	// lock is released so that UpdateEvents doesn't wait for the replay.
+	for len(cb.buffer) > 0 {
+		buffer := cb.buffer
+		cb.buffer = nil
+		cb.mu.Unlock()
+		for _, evt := range buffer {
+			resend(cb.sink, evt)
+		}
+		cb.mu.Lock()
+	}
+	cb.open = false
+}
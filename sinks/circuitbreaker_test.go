@@ -0,0 +1,140 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+// fakeSink records the events it receives and fails its health check on
+// demand.
+type fakeSink struct {
+	events  []*v1.Event
+	healthy bool
+}
+
+func (f *fakeSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	f.events = append(f.events, eNew)
+}
+
+func (f *fakeSink) HealthCheck() error {
+	if !f.healthy {
+		return errors.New("backend down")
+	}
+	return nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	sink := &fakeSink{healthy: true}
+	cb := NewCircuitBreaker(sink, time.Second, 2, 2)
+
+	cb.UpdateEvents(&v1.Event{Message: "1"}, nil)
+	if len(sink.events) != 1 {
+		t.Fatalf("Event should pass through a closed circuit")
+	}
+
+	// One failure is below the threshold, the second one opens the circuit.
+	sink.healthy = false
+	cb.probe()
+	cb.UpdateEvents(&v1.Event{Message: "2"}, nil)
+	if len(sink.events) != 2 {
+		t.Fatalf("Event should pass through until the failure threshold is reached")
+	}
+	cb.probe()
+
+	for _, msg := range []string{"3", "4", "5"} {
+		cb.UpdateEvents(&v1.Event{Message: msg}, nil)
+	}
+	if len(sink.events) != 2 {
+		t.Errorf("Events should be buffered while the circuit is open")
+	}
+	st := cb.Status()
+	if st.Healthy || !st.CircuitOpen || st.BufferDepth != 2 {
+		t.Errorf("Unexpected status while open: %+v", st)
+	}
+
+	// Recovery replays the buffer, which only kept the two newest events.
+	sink.healthy = true
+	cb.probe()
+	if len(sink.events) != 4 || sink.events[2].Message != "4" || sink.events[3].Message != "5" {
+		t.Errorf("Buffered events were not replayed in order: %v", sink.events)
+	}
+	if st := cb.Status(); !st.Healthy || st.CircuitOpen {
+		t.Errorf("Unexpected status after recovery: %+v", st)
+	}
+}
+
+// blockingSink holds up the event with the message "block" until release is
+// closed
+type blockingSink struct {
+	fakeSink
+	mu      sync.Mutex
+	started chan bool
+	release chan bool
+}
+
+func (b *blockingSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	if eNew.Message == "block" {
+		b.started <- true
+		<-b.release
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fakeSink.UpdateEvents(eNew, eOld)
+}
+
+func TestCircuitBreakerReplayDoesNotBlock(t *testing.T) {
+	sink := &blockingSink{started: make(chan bool), release: make(chan bool)}
+	cb := NewCircuitBreaker(sink, time.Second, 1, 10)
+	cb.probe()
+	cb.UpdateEvents(&v1.Event{Message: "block"}, nil)
+
+	sink.healthy = true
+	done := make(chan bool)
+	go func() {
+		cb.probe()
+		close(done)
+	}()
+	<-sink.started
+
+	// Events sent during the replay are buffered without waiting for it,
+	// and replayed after the ones before them
+	updated := make(chan bool)
+	go func() {
+		cb.UpdateEvents(&v1.Event{Message: "late"}, nil)
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("UpdateEvents blocked during the replay")
+	}
+	close(sink.release)
+	<-done
+
+	if len(sink.events) != 2 || sink.events[0].Message != "block" || sink.events[1].Message != "late" {
+		t.Errorf("Expected the events in order, got %v", sink.events)
+	}
+	if cb.Status().CircuitOpen {
+		t.Errorf("Expected the circuit to close after the replay")
+	}
+}
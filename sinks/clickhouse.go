@@ -0,0 +1,358 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// clickhouseColumns are the columns of the table. They are named like the
+// keys of WriteFlattenedJSON, so that queries work on both.
+var clickhouseColumns = []struct {
+	name, typ string
+	value     func(e EventData) interface{}
+}{
+	{"verb", "LowCardinality(String)", func(e EventData) interface{} { return e.Verb }},
+	{"event_metadata_uid", "String", func(e EventData) interface{} { return string(e.Event.UID) }},
+	{"event_metadata_name", "String", func(e EventData) interface{} { return e.Event.Name }},
+	{"event_metadata_namespace", "LowCardinality(String)", func(e EventData) interface{} { return e.Event.Namespace }},
+	{"event_metadata_resourceVersion", "String", func(e EventData) interface{} { return e.Event.ResourceVersion }},
+	{"event_metadata_creationTimestamp", "DateTime('UTC')", func(e EventData) interface{} { return clickhouseTime(e.Event.CreationTimestamp) }},
+	{"event_involvedObject_kind", "LowCardinality(String)", func(e EventData) interface{} { return e.Event.InvolvedObject.Kind }},
+	{"event_involvedObject_namespace", "LowCardinality(String)", func(e EventData) interface{} { return e.Event.InvolvedObject.Namespace }},
+	{"event_involvedObject_name", "String", func(e EventData) interface{} { return e.Event.InvolvedObject.Name }},
+	{"event_involvedObject_uid", "String", func(e EventData) interface{} { return string(e.Event.InvolvedObject.UID) }},
+	{"event_involvedObject_apiVersion", "LowCardinality(String)", func(e EventData) interface{} { return e.Event.InvolvedObject.APIVersion }},
+	{"event_involvedObject_resourceVersion", "String", func(e EventData) interface{} { return e.Event.InvolvedObject.ResourceVersion }},
+	{"event_involvedObject_fieldPath", "String", func(e EventData) interface{} { return e.Event.InvolvedObject.FieldPath }},
+	{"event_reason", "LowCardinality(String)", func(e EventData) interface{} { return e.Event.Reason }},
+	{"event_message", "String", func(e EventData) interface{} { return e.Event.Message }},
+	{"event_source_component", "LowCardinality(String)", func(e EventData) interface{} { return e.Event.Source.Component }},
+	{"event_source_host", "LowCardinality(String)", func(e EventData) interface{} { return e.Event.Source.Host }},
+	{"event_firstTimestamp", "DateTime('UTC')", func(e EventData) interface{} { return clickhouseTime(e.Event.FirstTimestamp) }},
+	{"event_lastTimestamp", "DateTime('UTC')", func(e EventData) interface{} { return clickhouseTime(e.Event.LastTimestamp) }},
+	{"event_count", "UInt32", func(e EventData) interface{} { return e.Event.Count }},
+	{"event_type", "LowCardinality(String)", func(e EventData) interface{} { return e.Event.Type }},
+	{"event_action", "LowCardinality(String)", func(e EventData) interface{} { return e.Event.Action }},
+	{"event_reportingComponent", "LowCardinality(String)", func(e EventData) interface{} { return e.Event.ReportingController }},
+	{"event_reportingInstance", "String", func(e EventData) interface{} { return e.Event.ReportingInstance }},
+}
+
+// clickhouseTime formats a timestamp for a DateTime column. ClickHouse
+// DateTimes start at the epoch, which stands for missing timestamps.
+func clickhouseTime(t metav1.Time) string {
+	if t.IsZero() {
+		return "1970-01-01 00:00:00"
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// ClickHouseSink inserts events into a ClickHouse table over the HTTP
+// interface. The table can be created as a ReplacingMergeTree keyed by the
+// event UID, so that the updates of an event replace its row once parts are
+// merged.
+type ClickHouseSink struct {
+	// CreateTable creates the table if it doesn't exist
+	CreateTable bool
+
+	// AsyncInsert lets the server buffer inserts, and WaitForAsyncInsert
+	// waits for them to be written before acknowledging them
+	AsyncInsert        bool
+	WaitForAsyncInsert bool
+
+	// BatchSize bounds how many rows are inserted at once, and
+	// FlushInterval how long Run waits for a batch to fill up
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// MaxRetries bounds how many times a batch is retried
+	MaxRetries int
+
+	url          string
+	database     string
+	table        string
+	username     string
+	password     string
+	httpClient   *http.Client
+	retryBackoff time.Duration
+	eventCh      channels.Channel
+	stats        sinkStats
+
+	// tableReady is set once the table is created. It is only used by
+	// SendEvents.
+	tableReady bool
+}
+
+// NewClickHouseSink constructs a new ClickHouseSink inserting into
+// database.table of the server at rawurl, such as http://localhost:8123.
+// tlsConfig may be nil.
+func NewClickHouseSink(rawurl, database, table, username, password string, tlsConfig *tls.Config, overflow bool, bufferSize int) (*ClickHouseSink, error) {
+	if _, err := url.Parse(rawurl); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{database, table} {
+		if !sqlIdentifier.MatchString(name) {
+			return nil, fmt.Errorf("invalid name %q, must be letters, digits and underscores", name)
+		}
+	}
+
+	httpClient := &http.Client{Timeout: 60 * time.Second}
+	if tlsConfig != nil {
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}
+	}
+
+	c := &ClickHouseSink{
+		WaitForAsyncInsert: true,
+		BatchSize:          1000,
+		FlushInterval:      time.Second,
+		MaxRetries:         3,
+		url:                strings.TrimSuffix(rawurl, "/"),
+		database:           database,
+		table:              table,
+		username:           username,
+		password:           password,
+		httpClient:         httpClient,
+		retryBackoff:       time.Second,
+	}
+	if overflow {
+		c.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		c.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+	return c, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event OverflowingChannel, which should never block.
+// Messages that are buffered beyond the bufferSize specified for this
+// ClickHouseSink are discarded.
+func (c *ClickHouseSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	c.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Status implements the StatusReporter interface
+func (c *ClickHouseSink) Status() SinkStatus {
+	return c.stats.status(c.eventCh.Len())
+}
+
+// HealthCheck implements the HealthChecker interface by running a query,
+// which checks both the connection and the credentials
+func (c *ClickHouseSink) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	_, err := c.query(ctx, "SELECT 1", nil, nil)
+	return err
+}
+
+// Run sits in a loop, waiting for data to come in through c.eventCh, and
+// inserting it. Once an event comes in, it waits up to FlushInterval for
+// more, so that they are inserted together.
+func (c *ClickHouseSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-c.eventCh.Out():
+			var evt EventData
+			var ok bool
+			evt, ok = e.(EventData)
+			if !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// ...and wait for more until the batch is full
+			timer := time.NewTimer(c.FlushInterval)
+		wait:
+			for len(arr) < c.BatchSize {
+				select {
+				case e := <-c.eventCh.Out():
+					if evt, ok = e.(EventData); ok {
+						arr = append(arr, evt)
+					} else {
+						glog.Warningf("Invalid type sent through event channel: %T", e)
+					}
+				case <-timer.C:
+					break wait
+				}
+			}
+			timer.Stop()
+
+			c.SendEvents(arr)
+		case <-stopCh:
+			break loop
+		}
+	}
+}
+
+// SendEvents implements the BatchSender interface. It inserts the events in
+// batches of up to BatchSize rows, retrying network errors and server errors
+// with exponential backoff. A batch that still fails doesn't stop the others
+// from being inserted, and the errors are returned together.
+func (c *ClickHouseSink) SendEvents(events []EventData) error {
+	if !c.tableReady && c.CreateTable {
+		if err := c.createTable(); err != nil {
+			glog.Errorf("Failed to create ClickHouse table %s.%s: %v", c.database, c.table, err)
+			c.stats.sendFailed(err)
+			return err
+		}
+	}
+	c.tableReady = true
+
+	// A batch that fails doesn't keep the next batches from being inserted
+	var errs []error
+	for len(events) > 0 {
+		n := len(events)
+		if c.BatchSize > 0 && n > c.BatchSize {
+			n = c.BatchSize
+		}
+		if err := c.insert(events[:n]); err != nil {
+			errs = append(errs, err)
+		}
+		events = events[n:]
+	}
+	if err := combineErrors(errs); err != nil {
+		c.stats.sendFailed(err)
+		return err
+	}
+	c.stats.sendSucceeded()
+	return nil
+}
+
+// insert inserts a batch of events as JSONEachRow
+func (c *ClickHouseSink) insert(events []EventData) error {
+	var body bytes.Buffer
+	for _, evt := range events {
+		row := make(map[string]interface{}, len(clickhouseColumns))
+		for _, col := range clickhouseColumns {
+			row[col.name] = col.value(evt)
+		}
+		b, err := json.Marshal(row)
+		if err != nil {
+			glog.Warningf("Failed to serialize event: %v", err)
+			continue
+		}
+		body.Write(b)
+		body.WriteByte('\n')
+	}
+
+	names := make([]string, len(clickhouseColumns))
+	for i, col := range clickhouseColumns {
+		names[i] = col.name
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) FORMAT JSONEachRow", c.tableName(), strings.Join(names, ", "))
+	settings := url.Values{}
+	if c.AsyncInsert {
+		settings.Set("async_insert", "1")
+		if c.WaitForAsyncInsert {
+			settings.Set("wait_for_async_insert", "1")
+		} else {
+			settings.Set("wait_for_async_insert", "0")
+		}
+	}
+
+	backoff := c.retryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := c.query(context.Background(), query, settings, body.Bytes())
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= c.MaxRetries {
+			glog.Errorf("Failed to insert %d events into ClickHouse: %v", len(events), err)
+			return err
+		}
+		glog.Warningf("Retrying %d events in %v: %v", len(events), backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// createTable creates the table as a ReplacingMergeTree keyed by the event
+// UID, keeping the row with the highest count. Unlike lastTimestamp, which
+// has a resolution of seconds, the count increases with every update of the
+// event, so that two updates within a second are told apart. Rows are only
+// replaced within a partition, so it is partitioned by the creation of the
+// event, which its updates don't change.
+func (c *ClickHouseSink) createTable() error {
+	var cols []string
+	for _, col := range clickhouseColumns {
+		cols = append(cols, col.name+" "+col.typ)
+	}
+	stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s) ENGINE = ReplacingMergeTree(event_count) "+
+		"PARTITION BY toYYYYMM(event_metadata_creationTimestamp) ORDER BY event_metadata_uid", c.tableName(), strings.Join(cols, ", "))
+	_, err := c.query(context.Background(), stmt, nil, nil)
+	return err
+}
+
+// tableName returns the quoted name of the table
+func (c *ClickHouseSink) tableName() string {
+	return "`" + c.database + "`.`" + c.table + "`"
+}
+
+// query runs a query with the given settings, with data as the input of
+// INSERT queries, and returns whether a failure is transient
+func (c *ClickHouseSink) query(ctx context.Context, query string, settings url.Values, data []byte) (bool, error) {
+	params := url.Values{}
+	for k, v := range settings {
+		params[k] = v
+	}
+	params.Set("database", c.database)
+
+	var body []byte
+	if data == nil {
+		body = []byte(query)
+	} else {
+		params.Set("query", query)
+		body = data
+	}
+	req, err := http.NewRequest("POST", c.url+"/?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if c.username != "" {
+		req.Header.Set("X-ClickHouse-User", c.username)
+		req.Header.Set("X-ClickHouse-Key", c.password)
+	}
+
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, bytes.TrimSpace(msg))
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClickHouseRequest is a query received by the fake server
+type fakeClickHouseRequest struct {
+	params url.Values
+	header http.Header
+	body   string
+}
+
+// fakeClickHouse is a stand-in ClickHouse HTTP interface. status gives the
+// HTTP code of the nth request.
+type fakeClickHouse struct {
+	*httptest.Server
+	mu     sync.Mutex
+	reqs   []fakeClickHouseRequest
+	status func(n int) int
+}
+
+func newFakeClickHouse() *fakeClickHouse {
+	f := &fakeClickHouse{status: func(n int) int { return http.StatusOK }}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		f.mu.Lock()
+		f.reqs = append(f.reqs, fakeClickHouseRequest{r.URL.Query(), r.Header, string(body)})
+		status := f.status(len(f.reqs))
+		f.mu.Unlock()
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			w.Write([]byte("Code: 999. DB::Exception: failed\n"))
+		}
+	}))
+	return f
+}
+
+// requests returns the requests received so far
+func (f *fakeClickHouse) requests() []fakeClickHouseRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeClickHouseRequest(nil), f.reqs...)
+}
+
+func newTestClickHouseSink(t *testing.T, f *fakeClickHouse) *ClickHouseSink {
+	c, err := NewClickHouseSink(f.URL+"/", "k8s", "events", "eventrouter", "pwd", nil, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.retryBackoff = 0
+	return c
+}
+
+func TestClickHouseSink(t *testing.T) {
+	f := newFakeClickHouse()
+	defer f.Close()
+
+	c := newTestClickHouseSink(t, f)
+	c.CreateTable = true
+	c.AsyncInsert = true
+	if err := c.HealthCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendEvents(natsTestEvents()); err != nil {
+		t.Fatal(err)
+	}
+	// The table is only created once
+	if err := c.SendEvents(natsTestEvents()); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := f.requests()
+	if len(reqs) != 4 {
+		t.Fatalf("Expected a health check, a CREATE TABLE and 2 INSERTs, got %d requests", len(reqs))
+	}
+	for _, r := range reqs {
+		if r.params.Get("database") != "k8s" || r.header.Get("X-ClickHouse-User") != "eventrouter" || r.header.Get("X-ClickHouse-Key") != "pwd" {
+			t.Errorf("Expected the database and credentials, got %v %v", r.params, r.header)
+		}
+	}
+	if reqs[0].body != "SELECT 1" {
+		t.Errorf("Unexpected health check %s", reqs[0].body)
+	}
+	create := reqs[1].body
+	if !strings.HasPrefix(create, "CREATE TABLE IF NOT EXISTS `k8s`.`events` (verb LowCardinality(String), event_metadata_uid String,") ||
+		!strings.HasSuffix(create, "ENGINE = ReplacingMergeTree(event_count) PARTITION BY toYYYYMM(event_metadata_creationTimestamp) ORDER BY event_metadata_uid") {
+		t.Errorf("Unexpected CREATE TABLE statement %s", create)
+	}
+
+	insert := reqs[2]
+	if !strings.HasPrefix(insert.params.Get("query"), "INSERT INTO `k8s`.`events` (verb, event_metadata_uid, ") ||
+		!strings.HasSuffix(insert.params.Get("query"), ") FORMAT JSONEachRow") {
+		t.Errorf("Unexpected INSERT query %s", insert.params.Get("query"))
+	}
+	if insert.params.Get("async_insert") != "1" || insert.params.Get("wait_for_async_insert") != "1" {
+		t.Errorf("Expected async insert settings, got %v", insert.params)
+	}
+	lines := strings.Split(strings.TrimSpace(insert.body), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 rows, got %q", insert.body)
+	}
+	var row map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &row); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"verb":                             "ADDED",
+		"event_metadata_uid":               "uid-1",
+		"event_involvedObject_kind":        "Pod",
+		"event_involvedObject_name":        "web-1",
+		"event_reason":                     "BackOff",
+		"event_count":                      float64(3),
+		"event_lastTimestamp":              "2019-09-01 12:00:00",
+		"event_firstTimestamp":             "1970-01-01 00:00:00",
+		"event_metadata_creationTimestamp": "1970-01-01 00:00:00",
+	}
+	for k, v := range want {
+		if row[k] != v {
+			t.Errorf("Expected %s=%v, got %v", k, v, row[k])
+		}
+	}
+	if len(row) != len(clickhouseColumns) {
+		t.Errorf("Expected %d columns, got %d", len(clickhouseColumns), len(row))
+	}
+}
+
+func TestClickHouseSinkRetries(t *testing.T) {
+	f := newFakeClickHouse()
+	defer f.Close()
+	f.status = func(n int) int {
+		if n == 1 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}
+
+	c := newTestClickHouseSink(t, f)
+	if err := c.SendEvents(natsTestEvents()); err != nil {
+		t.Fatal(err)
+	}
+	if reqs := f.requests(); len(reqs) != 2 || reqs[0].body != reqs[1].body {
+		t.Errorf("Expected the batch to be retried, got %d requests", len(reqs))
+	}
+
+	// Client errors aren't retried
+	f.mu.Lock()
+	f.status = func(n int) int { return http.StatusBadRequest }
+	f.mu.Unlock()
+	if err := c.SendEvents(natsTestEvents()); err == nil || !strings.Contains(err.Error(), "DB::Exception") {
+		t.Errorf("Expected the server error, got %v", err)
+	}
+	if reqs := f.requests(); len(reqs) != 3 {
+		t.Errorf("Expected a single attempt, got %d", len(reqs)-2)
+	}
+	if c.Status().LastError == "" {
+		t.Errorf("Expected the error in the sink status")
+	}
+}
+
+func TestClickHouseSinkKeepsInsertingAfterFailedBatch(t *testing.T) {
+	f := newFakeClickHouse()
+	defer f.Close()
+	f.status = func(n int) int {
+		if n == 1 {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	}
+
+	c := newTestClickHouseSink(t, f)
+	c.BatchSize = 1
+	if err := c.SendEvents(natsTestEvents()); err == nil {
+		t.Fatal("Expected an error for the failed batch")
+	}
+	if reqs := f.requests(); len(reqs) != 2 {
+		t.Errorf("Expected the second batch to be inserted, got %d requests", len(reqs))
+	}
+}
+
+func TestClickHouseSinkBatches(t *testing.T) {
+	f := newFakeClickHouse()
+	defer f.Close()
+
+	c := newTestClickHouseSink(t, f)
+	c.BatchSize = 2
+	c.FlushInterval = time.Minute
+	stopCh := make(chan bool)
+	defer close(stopCh)
+	go c.Run(stopCh)
+
+	// A full batch is inserted without waiting for the flush interval
+	for _, evt := range natsTestEvents() {
+		c.UpdateEvents(evt.Event, nil)
+	}
+	waitFor(t, "the batch", func() bool { return len(f.requests()) == 1 })
+	if rows := strings.Count(f.requests()[0].body, "\n"); rows != 2 {
+		t.Errorf("Expected 2 rows, got %d", rows)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// AttributeFormatter is implemented by formats that carry part of an event out
+// of band, such as CloudEvents in binary mode. Sinks that support it map the
+// attributes to transport headers and send the formatted bytes as the body.
+// The content type of the body is the "datacontenttype" attribute.
+type AttributeFormatter interface {
+	Formatter
+	Attributes(e EventData) map[string]string
+}
+
+// cloudEventsSpecVersion is the version of the CloudEvents spec implemented
+const cloudEventsSpecVersion = "1.0"
+
+// cloudEvent is the structured mode envelope of an event
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Time            string    `json:"time,omitempty"`
+	Subject         string    `json:"subject,omitempty"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            EventData `json:"data"`
+}
+
+/*
+cloudEventsFormatter maps events to CloudEvents 1.0:
+
+	type    io.k8s.event.<type>.<reason>, such as io.k8s.event.warning.BackOff
+	source  /<cluster>/<namespace>/<kind>/<name> of the involved object
+	id      <event uid>.<resource version>
+	time    the last timestamp of the event
+	subject the name of the event
+	data    the EventData as JSON
+
+In structured mode the whole envelope is the JSON body. In binary mode the body
+is the data alone, and the other attributes are returned by Attributes.
+*/
+type cloudEventsFormatter struct {
+	cluster string
+	binary  bool
+}
+
+// NewCloudEventsFormatter builds a CloudEvents formatter. The cluster name is
+// the first segment of the source attribute, and is left out when empty.
+func NewCloudEventsFormatter(cluster string, binary bool) Formatter {
+	return &cloudEventsFormatter{cluster: cluster, binary: binary}
+}
+
+func (f *cloudEventsFormatter) envelope(e EventData) cloudEvent {
+	evt := e.Event
+
+	eventType := strings.ToLower(evt.Type)
+	if eventType == "" {
+		eventType = "unknown"
+	}
+
+	source := []string{""}
+	if f.cluster != "" {
+		source = append(source, f.cluster)
+	}
+	// Empty segments, such as the namespace of cluster scoped objects, would
+	// turn the source into a network-path reference
+	for _, segment := range []string{evt.InvolvedObject.Namespace, evt.InvolvedObject.Kind, evt.InvolvedObject.Name} {
+		if segment == "" {
+			segment = "_"
+		}
+		source = append(source, segment)
+	}
+
+	ts := evt.LastTimestamp.Time
+	if ts.IsZero() {
+		ts = evt.EventTime.Time
+	}
+	var t string
+	if !ts.IsZero() {
+		t = ts.UTC().Format(time.RFC3339Nano)
+	}
+
+	return cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              eventVersionID(evt),
+		Source:          strings.Join(source, "/"),
+		Type:            "io.k8s.event." + eventType + "." + evt.Reason,
+		Time:            t,
+		Subject:         evt.Name,
+		DataContentType: "application/json",
+		Data:            e,
+	}
+}
+
+// Format implements the Formatter interface
+func (f *cloudEventsFormatter) Format(e EventData) ([]byte, error) {
+	if f.binary {
+		return json.Marshal(e)
+	}
+	return json.Marshal(f.envelope(e))
+}
+
+// Attributes implements the AttributeFormatter interface. Structured mode has
+// no attributes, only its content type.
+func (f *cloudEventsFormatter) Attributes(e EventData) map[string]string {
+	if !f.binary {
+		return map[string]string{"datacontenttype": "application/cloudevents+json"}
+	}
+	ce := f.envelope(e)
+	attrs := map[string]string{
+		"specversion":     ce.SpecVersion,
+		"id":              ce.ID,
+		"source":          ce.Source,
+		"type":            ce.Type,
+		"datacontenttype": ce.DataContentType,
+	}
+	if ce.Time != "" {
+		attrs["time"] = ce.Time
+	}
+	if ce.Subject != "" {
+		attrs["subject"] = ce.Subject
+	}
+	return attrs
+}
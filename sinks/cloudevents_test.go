@@ -0,0 +1,119 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func cloudEventsTestData() EventData {
+	e := formatTestEvent()
+	e.Event.UID = "uid-1"
+	e.Event.ResourceVersion = "42"
+	return e
+}
+
+func TestCloudEventsStructured(t *testing.T) {
+	f := NewCloudEventsFormatter("prod-cluster", false)
+	b, err := f.Format(cloudEventsTestData())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ce map[string]interface{}
+	if err := json.Unmarshal(b, &ce); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"specversion": "1.0",
+		"id":          "uid-1.42",
+		"source":      "/prod-cluster/prod/Pod/web-1",
+		"type":        "io.k8s.event.warning.BackOff",
+		"time":        "2019-09-01T12:00:00Z",
+		"subject":     "web-1.15c",
+	}
+	for k, v := range want {
+		if ce[k] != v {
+			t.Errorf("Expected %s=%q, got %v", k, v, ce[k])
+		}
+	}
+	if data, ok := ce["data"].(map[string]interface{}); !ok || data["verb"] != "ADDED" {
+		t.Errorf("Expected the event data in data, got %v", ce["data"])
+	}
+}
+
+func TestCloudEventsClusterScoped(t *testing.T) {
+	e := cloudEventsTestData()
+	e.Event.Namespace = "default"
+	e.Event.InvolvedObject = v1.ObjectReference{Kind: "Node", Name: "node-1"}
+	b, err := NewCloudEventsFormatter("", false).Format(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ce map[string]interface{}
+	if err := json.Unmarshal(b, &ce); err != nil {
+		t.Fatal(err)
+	}
+	source, _ := ce["source"].(string)
+	if source != "/_/Node/node-1" {
+		t.Errorf("Expected source /_/Node/node-1, got %q", source)
+	}
+	if u, err := url.Parse(source); err != nil || u.Host != "" || u.Path != source {
+		t.Errorf("Expected the source to be a path, got %#v", u)
+	}
+}
+
+func TestCloudEventsBinaryHTTP(t *testing.T) {
+	var headers []http.Header
+	var bodies []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header)
+		b, _ := ioutil.ReadAll(r.Body)
+		var body map[string]interface{}
+		if err := json.Unmarshal(b, &body); err != nil {
+			t.Errorf("Invalid body %q: %v", b, err)
+		}
+		bodies = append(bodies, body)
+	}))
+	defer srv.Close()
+
+	sink := NewHTTPSink(srv.URL, false, 0)
+	sink.Formatter = NewCloudEventsFormatter("", true)
+	if err := sink.SendEvents([]EventData{cloudEventsTestData(), cloudEventsTestData()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(headers) != 2 {
+		t.Fatalf("Expected one request per event, got %d", len(headers))
+	}
+	h := headers[0]
+	if h.Get("ce-specversion") != "1.0" || h.Get("ce-type") != "io.k8s.event.warning.BackOff" ||
+		h.Get("ce-source") != "/prod/Pod/web-1" || h.Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected headers %v", h)
+	}
+	if bodies[0]["verb"] != "ADDED" {
+		t.Errorf("Expected the event data as body, got %v", bodies[0])
+	}
+}
@@ -0,0 +1,552 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// diskQueueSegmentExt is the extension of the segment files
+	diskQueueSegmentExt = ".seg"
+
+	// diskQueueAckFile holds the position of the last acknowledged record
+	diskQueueAckFile = "ack"
+
+	// diskQueueMaxBackoff caps the delay between delivery retries
+	diskQueueMaxBackoff = time.Minute
+)
+
+/*
+DiskQueue is a write-ahead queue kept on disk in front of a sink. Every event
+is appended to the current segment file as a length-prefixed JSON EventData
+record and synced to disk, and a separate goroutine delivers the records to
+the sink in batches.
+
+The position of the last delivered record is written to an ack file, so that
+events which were queued but not yet delivered are replayed after a restart.
+Sinks that implement BatchSender are retried with backoff until they accept a
+batch; for other sinks, records are acknowledged as soon as they are handed
+over.
+
+Once the segments take more than maxBytes on disk, the oldest segment is
+deleted, even if it has not been delivered yet.
+*/
+type DiskQueue struct {
+	sink         EventSinkInterface
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	batchSize    int
+
+	// mu guards everything below
+	mu sync.Mutex
+
+	// segments lists the segments on disk, oldest first. The first one is
+	// being read and the last one is being written.
+	segments []*diskSegment
+	writer   *os.File
+
+	// readOff is the offset of the next unacknowledged record in the first
+	// segment, and readRecords the number of records before it.
+	readOff     int64
+	readRecords int
+
+	pending int
+	dropped int
+	lastErr error
+
+	// notify is signalled whenever a record is appended
+	notify chan struct{}
+}
+
+// diskSegment describes a single segment file
+type diskSegment struct {
+	id      int64
+	size    int64
+	records int
+}
+
+// diskQueueAck is the content of the ack file
+type diskQueueAck struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// NewDiskQueue opens the queue in dir, creating it if needed, and replays
+// whatever was left unacknowledged by a previous run.
+func NewDiskQueue(sink EventSinkInterface, dir string, maxBytes int64, segmentBytes int64, batchSize int) (*DiskQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &DiskQueue{
+		sink:         sink,
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		batchSize:    batchSize,
+		notify:       make(chan struct{}, 1),
+	}
+	if err := q.open(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// open loads the segments and the ack file left in the queue directory
+func (q *DiskQueue) open() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), diskQueueSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), diskQueueSegmentExt), 10, 64)
+		if err != nil {
+			glog.Warningf("Ignoring unexpected file %s in disk queue", f.Name())
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var ack diskQueueAck
+	if b, err := ioutil.ReadFile(filepath.Join(q.dir, diskQueueAckFile)); err == nil {
+		if err := json.Unmarshal(b, &ack); err != nil {
+			glog.Warningf("Ignoring corrupt disk queue ack file: %v", err)
+			ack = diskQueueAck{}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, id := range ids {
+		// Segments before the acknowledged one were fully delivered
+		if id < ack.Segment {
+			os.Remove(q.segmentPath(id))
+			continue
+		}
+		seg, recordsBefore, err := q.scanSegment(id, ack)
+		if err != nil {
+			return err
+		}
+		if id == ack.Segment {
+			q.readOff = ack.Offset
+			q.readRecords = recordsBefore
+		}
+		q.segments = append(q.segments, seg)
+		q.pending += seg.records
+	}
+	if len(q.segments) > 0 && q.segments[0].id != ack.Segment {
+		// The acknowledged segment was evicted, start over with the oldest one
+		q.readOff = 0
+		q.readRecords = 0
+	}
+	q.pending -= q.readRecords
+
+	var last *diskSegment
+	if len(q.segments) == 0 {
+		last = &diskSegment{id: ack.Segment + 1}
+		q.segments = append(q.segments, last)
+	} else {
+		last = q.segments[len(q.segments)-1]
+	}
+	q.writer, err = os.OpenFile(q.segmentPath(last.id), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(q.dir); err != nil {
+		return err
+	}
+	// Cut off a record that was only partially written before a crash
+	if err := q.writer.Truncate(last.size); err != nil {
+		return err
+	}
+	if _, err := q.writer.Seek(last.size, io.SeekStart); err != nil {
+		return err
+	}
+
+	if q.pending > 0 {
+		glog.Infof("Replaying %d events from disk queue at %s", q.pending, q.dir)
+		q.notify <- struct{}{}
+	}
+	return nil
+}
+
+// scanSegment counts the complete records of a segment. It also returns how
+// many of them come before the acknowledged offset.
+func (q *DiskQueue) scanSegment(id int64, ack diskQueueAck) (*diskSegment, int, error) {
+	f, err := os.Open(q.segmentPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	seg := &diskSegment{id: id}
+	recordsBefore := 0
+	r := bufio.NewReader(f)
+	for {
+		n, err := readRecordLength(r)
+		if err != nil {
+			break
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, int64(n)); err != nil {
+			break
+		}
+		if id == ack.Segment && seg.size < ack.Offset {
+			recordsBefore++
+		}
+		seg.size += 4 + int64(n)
+		seg.records++
+	}
+	return seg, recordsBefore, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It appends the event to the
+// current segment, it does not wait for the event to be delivered.
+func (q *DiskQueue) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	eJSONBytes, err := json.Marshal(NewEventData(eNew, eOld))
+	if err != nil {
+		glog.Warningf("Failed to json serialize event: %v", err)
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.append(eJSONBytes); err != nil {
+		glog.Errorf("Failed to write event to disk queue: %v", err)
+		q.lastErr = err
+		return
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// append writes a record to the current segment, rolling over to a new segment
+// and evicting old ones as needed. It must be called with q.mu held.
+func (q *DiskQueue) append(data []byte) error {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	if _, err := q.writer.Write(append(header[:], data...)); err != nil {
+		return err
+	}
+	// The event is only queued once it survives a crash of the node
+	if err := q.writer.Sync(); err != nil {
+		return err
+	}
+
+	seg := q.segments[len(q.segments)-1]
+	seg.size += int64(len(header) + len(data))
+	seg.records++
+	q.pending++
+
+	if seg.size >= q.segmentBytes {
+		if err := q.roll(); err != nil {
+			return err
+		}
+	}
+	q.evict()
+	return nil
+}
+
+// roll closes the current segment and starts a new one. It must be called with
+// q.mu held.
+func (q *DiskQueue) roll() error {
+	if err := q.writer.Close(); err != nil {
+		return err
+	}
+	seg := &diskSegment{id: q.segments[len(q.segments)-1].id + 1}
+	writer, err := os.OpenFile(q.segmentPath(seg.id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(q.dir); err != nil {
+		writer.Close()
+		return err
+	}
+	q.writer = writer
+	q.segments = append(q.segments, seg)
+	return nil
+}
+
+// evict deletes the oldest segments while the queue takes more than maxBytes.
+// The segment being written is never evicted. It must be called with q.mu
+// held.
+func (q *DiskQueue) evict() {
+	for len(q.segments) > 1 && q.size() > q.maxBytes {
+		seg := q.segments[0]
+		lost := seg.records - q.readRecords
+		glog.Warningf("Disk queue is over %d bytes, dropping %d undelivered events", q.maxBytes, lost)
+
+		os.Remove(q.segmentPath(seg.id))
+		q.segments = q.segments[1:]
+		q.pending -= lost
+		q.dropped += lost
+		q.readOff = 0
+		q.readRecords = 0
+		q.writeAck()
+	}
+}
+
+// size returns the number of bytes taken by the segments. It must be called
+// with q.mu held.
+func (q *DiskQueue) size() int64 {
+	var size int64
+	for _, seg := range q.segments {
+		size += seg.size
+	}
+	return size
+}
+
+// Status implements the StatusReporter interface. Queued events are included
+// in the buffer depth of the wrapped sink.
+func (q *DiskQueue) Status() SinkStatus {
+	st := SinkStatus{Healthy: true}
+	if r, ok := q.sink.(StatusReporter); ok {
+		st = r.Status()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st.BufferDepth += q.pending
+	if q.lastErr != nil {
+		st.Healthy = false
+		st.LastError = q.lastErr.Error()
+	}
+	return st
+}
+
+// Run sits in a loop, delivering queued events to the sink until stopCh is
+// closed or written to. A batch that fails to be delivered is retried with
+// exponential backoff.
+func (q *DiskQueue) Run(stopCh <-chan bool) {
+	backoff := time.Second
+	for {
+		segID, events, next, records, err := q.readBatch()
+		if err != nil {
+			glog.Errorf("Failed to read from disk queue: %v", err)
+		}
+		if records == 0 {
+			select {
+			case <-q.notify:
+			case <-time.After(backoff):
+			case <-stopCh:
+				return
+			}
+			continue
+		}
+
+		if len(events) == 0 {
+			// Only undecodable records were read, there is nothing to send
+			q.ack(segID, next, records)
+			continue
+		}
+		if err := q.deliver(events); err != nil {
+			glog.Warningf("Failed to deliver %d events from disk queue, retrying in %v: %v", len(events), backoff, err)
+			q.mu.Lock()
+			q.lastErr = err
+			q.mu.Unlock()
+
+			select {
+			case <-time.After(backoff):
+			case <-stopCh:
+				return
+			}
+			if backoff *= 2; backoff > diskQueueMaxBackoff {
+				backoff = diskQueueMaxBackoff
+			}
+			continue
+		}
+
+		backoff = time.Second
+		q.ack(segID, next, records)
+	}
+}
+
+// deliver hands a batch of events to the sink
+func (q *DiskQueue) deliver(events []EventData) error {
+	if bs, ok := q.sink.(BatchSender); ok {
+		return bs.SendEvents(events)
+	}
+	for _, evt := range events {
+		resend(q.sink, evt)
+	}
+	return nil
+}
+
+// readBatch reads up to batchSize records from the first segment, starting at
+// the last acknowledged record. It returns the segment read, the events, the
+// offset following the last record read and the number of records read,
+// which includes records that could not be decoded.
+func (q *DiskQueue) readBatch() (int64, []EventData, int64, int, error) {
+	q.mu.Lock()
+	seg := q.segments[0]
+	segID, off, limit := seg.id, q.readOff, seg.size
+	if off >= limit && len(q.segments) > 1 {
+		// The first segment was fully delivered, move on to the next one
+		os.Remove(q.segmentPath(seg.id))
+		q.segments = q.segments[1:]
+		q.readOff = 0
+		q.readRecords = 0
+		q.writeAck()
+		segID, off, limit = q.segments[0].id, 0, q.segments[0].size
+	}
+	q.mu.Unlock()
+
+	if off >= limit {
+		return segID, nil, off, 0, nil
+	}
+
+	f, err := os.Open(q.segmentPath(segID))
+	if err != nil {
+		return segID, nil, off, 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return segID, nil, off, 0, err
+	}
+
+	// Only read up to the size known under the lock, the writer may be in
+	// the middle of appending the next record.
+	r := bufio.NewReader(io.LimitReader(f, limit-off))
+	var events []EventData
+	records := 0
+	for records < q.batchSize {
+		n, err := readRecordLength(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return segID, events, off, records, err
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return segID, events, off, records, err
+		}
+		off += 4 + int64(n)
+		records++
+
+		var evt EventData
+		if err := json.Unmarshal(data, &evt); err != nil {
+			glog.Warningf("Skipping undecodable record in disk queue segment %d: %v", segID, err)
+			continue
+		}
+		events = append(events, evt)
+	}
+	return segID, events, off, records, nil
+}
+
+// ack marks the records read from segID up to off as delivered
+func (q *DiskQueue) ack(segID int64, off int64, records int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.lastErr = nil
+	if q.segments[0].id != segID {
+		// The segment was evicted while its events were being delivered
+		return
+	}
+	q.readOff = off
+	q.readRecords += records
+	q.pending -= records
+	q.writeAck()
+}
+
+// writeAck persists the read position. It must be called with q.mu held.
+func (q *DiskQueue) writeAck() {
+	b, err := json.Marshal(diskQueueAck{Segment: q.segments[0].id, Offset: q.readOff})
+	if err != nil {
+		glog.Errorf("Failed to serialize disk queue ack: %v", err)
+		return
+	}
+	if err := writeFileSync(filepath.Join(q.dir, diskQueueAckFile), b); err != nil {
+		glog.Errorf("Failed to write disk queue ack: %v", err)
+	}
+}
+
+// writeFileSync atomically replaces the file at path with data, and syncs it
+// and its directory to disk
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs a directory to disk, so that the files created, renamed or
+// deleted in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// segmentPath returns the path of the segment file with the given id
+func (q *DiskQueue) segmentPath(id int64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%016d%s", id, diskQueueSegmentExt))
+}
+
+// readRecordLength reads the length prefix of the next record
+func readRecordLength(r io.Reader) (uint32, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(header[:]), nil
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+// fakeBatchSink accepts batches only while up is true, and counts them
+type fakeBatchSink struct {
+	sync.Mutex
+	up       bool
+	batches  int
+	messages []string
+}
+
+func (f *fakeBatchSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {}
+
+func (f *fakeBatchSink) SendEvents(events []EventData) error {
+	f.Lock()
+	defer f.Unlock()
+	if !f.up {
+		return errors.New("backend down")
+	}
+	f.batches++
+	for _, evt := range events {
+		f.messages = append(f.messages, evt.Event.Message)
+	}
+	return nil
+}
+
+func (f *fakeBatchSink) received() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.messages...)
+}
+
+func TestDiskQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// 1. Events written while the backend is down are kept on disk and
+	// replayed by a new queue over the same directory.
+	sink := &fakeBatchSink{}
+	q, err := NewDiskQueue(sink, dir, 1<<20, 256, 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < 20; i++ {
+		q.UpdateEvents(&v1.Event{Message: strconv.Itoa(i)}, nil)
+	}
+	if _, events, _, _, _ := q.readBatch(); len(events) == 0 {
+		t.Fatalf("Expected queued events to be readable")
+	}
+	if err := q.deliver(nil); err == nil {
+		t.Errorf("Expected delivery to fail while the backend is down")
+	}
+	q.writer.Close()
+
+	sink = &fakeBatchSink{up: true}
+	q, err = NewDiskQueue(sink, dir, 1<<20, 256, 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if st := q.Status(); st.BufferDepth != 20 {
+		t.Errorf("Got %v pending events after reopening, expected 20", st.BufferDepth)
+	}
+
+	stopCh := make(chan bool)
+	go q.Run(stopCh)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.received()) < 20 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stopCh)
+
+	got := sink.received()
+	if len(got) != 20 {
+		t.Fatalf("Got %v replayed events, expected 20", len(got))
+	}
+	for i, msg := range got {
+		if msg != strconv.Itoa(i) {
+			t.Errorf("Got event %q at position %v, events should be replayed in order", msg, i)
+		}
+	}
+	if st := q.Status(); st.BufferDepth != 0 {
+		t.Errorf("Got %v pending events after delivery, expected 0", st.BufferDepth)
+	}
+	q.writer.Close()
+
+	// 2. Once over the size limit, the oldest segments are evicted.
+	q, err = NewDiskQueue(&fakeBatchSink{}, dir, 1024, 256, 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < 100; i++ {
+		q.UpdateEvents(&v1.Event{Message: strconv.Itoa(i)}, nil)
+	}
+	q.mu.Lock()
+	size, dropped := q.size(), q.dropped
+	q.mu.Unlock()
+	if size > 1024+256 || dropped == 0 {
+		t.Errorf("Expected old segments to be evicted, got %v bytes on disk and %v dropped events", size, dropped)
+	}
+	q.writer.Close()
+}
+
+func TestDiskQueueSkipsUndecodableRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	sink := &fakeBatchSink{up: true}
+	q, err := NewDiskQueue(sink, dir, 1<<20, 256, 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer q.writer.Close()
+	q.mu.Lock()
+	err = q.append([]byte("not json"))
+	q.mu.Unlock()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	stopCh := make(chan bool)
+	go q.Run(stopCh)
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Status().BufferDepth != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stopCh)
+
+	if st := q.Status(); st.BufferDepth != 0 {
+		t.Errorf("Expected the record to be acknowledged, got %v pending", st.BufferDepth)
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	if sink.batches != 0 {
+		t.Errorf("Expected no empty batch to be sent, got %d", sink.batches)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, diskQueueAckFile)); err != nil || len(b) == 0 {
+		t.Errorf("Expected the ack file to be written, got %q %v", b, err)
+	}
+}
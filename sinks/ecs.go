@@ -0,0 +1,130 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	// ecsVersion is the version of the Elastic Common Schema produced
+	ecsVersion = "1.7.0"
+
+	// DefaultECSRawField is where the ecs format keeps the event data
+	DefaultECSRawField = "kubernetes.event"
+)
+
+// ecsLogLevels maps event types to log levels
+var ecsLogLevels = map[string]string{
+	"Normal":  "info",
+	"Warning": "warning",
+}
+
+/*
+ecsFormatter maps events to the Elastic Common Schema:
+
+	@timestamp                  the last timestamp of the event
+	event.kind, event.dataset   "event" and "kubernetes.event"
+	event.action                the verb, added or updated
+	event.reason                the reason of the event
+	message                     the message of the event
+	log.level                   info for Normal events, warning for Warning ones
+	orchestrator.namespace      the namespace of the involved object
+	orchestrator.resource.type  the kind of the involved object
+	orchestrator.resource.name  the name of the involved object
+	host.name                   the source host
+	labels                      the labels of the event and the source component
+
+The event data is kept as is under rawField, a dotted path. It is left out
+when rawField is empty.
+*/
+type ecsFormatter struct {
+	rawField string
+}
+
+// NewECSFormatter builds an Elastic Common Schema formatter keeping the event
+// data under rawField
+func NewECSFormatter(rawField string) Formatter {
+	return &ecsFormatter{rawField: rawField}
+}
+
+// Format implements the Formatter interface
+func (f *ecsFormatter) Format(e EventData) ([]byte, error) {
+	evt := e.Event
+	doc := map[string]interface{}{}
+
+	ts := evt.LastTimestamp.Time
+	if ts.IsZero() {
+		ts = evt.EventTime.Time
+	}
+	if !ts.IsZero() {
+		doc["@timestamp"] = ts.UTC().Format(time.RFC3339Nano)
+	}
+
+	level, ok := ecsLogLevels[evt.Type]
+	if !ok {
+		level = strings.ToLower(evt.Type)
+	}
+
+	labels := map[string]string{}
+	for k, v := range evt.Labels {
+		labels[k] = v
+	}
+	if evt.Source.Component != "" {
+		labels["source_component"] = evt.Source.Component
+	}
+
+	setECSField(doc, "ecs.version", ecsVersion)
+	setECSField(doc, "event.kind", "event")
+	setECSField(doc, "event.dataset", "kubernetes.event")
+	setECSField(doc, "event.action", strings.ToLower(e.Verb))
+	setECSField(doc, "event.reason", evt.Reason)
+	setECSField(doc, "message", evt.Message)
+	setECSField(doc, "log.level", level)
+	setECSField(doc, "orchestrator.type", "kubernetes")
+	setECSField(doc, "orchestrator.namespace", evt.InvolvedObject.Namespace)
+	setECSField(doc, "orchestrator.resource.type", evt.InvolvedObject.Kind)
+	setECSField(doc, "orchestrator.resource.name", evt.InvolvedObject.Name)
+	setECSField(doc, "host.name", evt.Source.Host)
+	if len(labels) > 0 {
+		doc["labels"] = labels
+	}
+	if f.rawField != "" {
+		setECSField(doc, f.rawField, e)
+	}
+	return json.Marshal(doc)
+}
+
+// setECSField sets a dotted path in a nested document. Empty strings are left
+// out.
+func setECSField(doc map[string]interface{}, path string, value interface{}) {
+	if s, ok := value.(string); ok && s == "" {
+		return
+	}
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := doc[p].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			doc[p] = next
+		}
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = value
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestECSFormatter(t *testing.T) {
+	b, err := NewECSFormatter("raw.k8s").Format(formatTestEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"@timestamp": "2019-09-01T12:00:00Z",
+		"message":    `Back-off restarting failed container "app"`,
+		"event": map[string]interface{}{
+			"kind":    "event",
+			"dataset": "kubernetes.event",
+			"action":  "added",
+			"reason":  "BackOff",
+		},
+		"log": map[string]interface{}{"level": "warning"},
+		"orchestrator": map[string]interface{}{
+			"type":      "kubernetes",
+			"namespace": "prod",
+			"resource":  map[string]interface{}{"type": "Pod", "name": "web-1"},
+		},
+		"host":   map[string]interface{}{"name": "node-1"},
+		"labels": map[string]interface{}{"source_component": "kubelet"},
+	}
+	for k, v := range want {
+		if !reflect.DeepEqual(doc[k], v) {
+			t.Errorf("Expected %s=%v, got %v", k, v, doc[k])
+		}
+	}
+
+	raw, ok := doc["raw"].(map[string]interface{})["k8s"].(map[string]interface{})
+	if !ok || raw["verb"] != "ADDED" {
+		t.Errorf("Expected the event data under raw.k8s, got %v", doc["raw"])
+	}
+
+	b, _ = NewECSFormatter("").Format(formatTestEvent())
+	doc = nil
+	json.Unmarshal(b, &doc)
+	if _, ok := doc["kubernetes"]; ok {
+		t.Errorf("Expected no raw event with an empty raw field")
+	}
+}
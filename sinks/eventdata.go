@@ -37,8 +37,13 @@ type EventData struct {
 	OldEvent *v1.Event `json:"old_event,omitempty"`
 }
 
+// OmittedEvent stands in for an old event that was left out. It is recognized
+// by identity and must not be modified.
+var OmittedEvent = &v1.Event{}
+
 // NewEventData constructs an EventData struct from an old and new event,
-// setting the verb accordingly
+// setting the verb accordingly. For OmittedEvent as the old event, the verb is
+// UPDATED, but OldEvent stays nil.
 func NewEventData(eNew *v1.Event, eOld *v1.Event) EventData {
 	var eData EventData
 	if eOld == nil {
@@ -52,11 +57,30 @@ func NewEventData(eNew *v1.Event, eOld *v1.Event) EventData {
 			Event:    eNew,
 			OldEvent: eOld,
 		}
+		if eOld == OmittedEvent {
+			eData.OldEvent = nil
+		}
 	}
 
 	return eData
 }
 
+// resend passes event data back through the UpdateEvents method of a sink.
+// OmittedEvent stands in for an omitted old event, so the verb is preserved.
+func resend(sink EventSinkInterface, e EventData) {
+	eOld := e.OldEvent
+	if eOld == nil && e.Verb == "UPDATED" {
+		eOld = OmittedEvent
+	}
+	sink.UpdateEvents(e.Event, eOld)
+}
+
+// eventVersionID identifies an event version, so that every update of the
+// event gets a new id while a redelivered update keeps its id
+func eventVersionID(e *v1.Event) string {
+	return string(e.UID) + "." + e.ResourceVersion
+}
+
 // WriteRFC5424 writes the current event data to the given io.Writer using
 // RFC5424 (syslog over TCP) syntax.
 func (e *EventData) WriteRFC5424(w io.Writer) (int64, error) {
@@ -0,0 +1,55 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+// verbSink records the event data built from the events it receives
+type verbSink struct {
+	data []EventData
+}
+
+func (s *verbSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	s.data = append(s.data, NewEventData(eNew, eOld))
+}
+
+func TestOmitOldEvents(t *testing.T) {
+	if d := NewEventData(&v1.Event{Message: "new"}, &v1.Event{Message: "old"}); d.OldEvent == nil {
+		t.Fatalf("Expected the old event to be kept, got %+v", d)
+	}
+
+	// An empty old event is kept, only OmittedEvent stands for one that was
+	// left out.
+	if d := NewEventData(&v1.Event{Message: "new"}, &v1.Event{}); d.OldEvent == nil {
+		t.Fatalf("Expected the empty old event to be kept, got %+v", d)
+	}
+	d := NewEventData(&v1.Event{Message: "new"}, OmittedEvent)
+	if d.Verb != "UPDATED" || d.OldEvent != nil {
+		t.Fatalf("Expected an UPDATED event without old event, got %+v", d)
+	}
+
+	// Resending through a wrapper keeps the verb.
+	sink := &verbSink{}
+	resend(sink, d)
+	if got := sink.data[0]; got.Verb != "UPDATED" || got.OldEvent != nil {
+		t.Errorf("Expected the resent event to stay UPDATED without old event, got %+v", got)
+	}
+}
@@ -2,9 +2,12 @@ package sinks
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
+	"time"
 
+	"github.com/Azure/azure-amqp-common-go/v2/aad"
 	eventhub "github.com/Azure/azure-event-hubs-go/v2"
+	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/eapache/channels"
 	"github.com/golang/glog"
 	v1 "k8s.io/api/core/v1"
@@ -12,10 +15,29 @@ import (
 
 const maxMessageSize = 1046528
 
+// eventHubResourceURI is the resource AAD tokens are requested for
+const eventHubResourceURI = "https://eventhubs.azure.net/"
+
 // EventHubSink sends events to an Azure Event Hub.
 type EventHubSink struct {
-	hub     *eventhub.Hub
-	eventCh channels.Channel
+	// PartitionKey renders the partition key of an event, so that the events
+	// of an object stay in order on one partition. Without it, events are
+	// spread over the partitions.
+	PartitionKey Formatter
+
+	// ClusterName is added to the application properties of each event when
+	// it is set
+	ClusterName string
+
+	// MaxRetries bounds how many times a batch that failed to send is retried
+	MaxRetries int
+
+	hub          *eventhub.Hub
+	sendBatch    func(ctx context.Context, it eventhub.BatchIterator) error
+	retryBackoff time.Duration
+	eventCh      channels.Channel
+	formatter    Formatter
+	stats        sinkStats
 }
 
 // NewEventHubSink constructs a new EventHubSink given a event hub connection string
@@ -39,11 +61,47 @@ type EventHubSink struct {
 //
 // connString expects the Azure Event Hub connection string format:
 //		`Endpoint=sb://YOUR_ENDPOINT.servicebus.windows.net/;SharedAccessKeyName=YOUR_ACCESS_KEY_NAME;SharedAccessKey=YOUR_ACCESS_KEY;EntityPath=YOUR_EVENT_HUB_NAME`
-func NewEventHubSink(connString string, overflow bool, bufferSize int) (*EventHubSink, error) {
+func NewEventHubSink(connString string, overflow bool, bufferSize int, formatter Formatter) (*EventHubSink, error) {
 	hub, err := eventhub.NewHubFromConnectionString(connString)
 	if err != nil {
 		return nil, err
 	}
+	return newEventHubSink(hub, overflow, bufferSize, formatter), nil
+}
+
+// NewEventHubSinkWithAAD constructs a new EventHubSink authenticating with Azure
+// Active Directory instead of a shared access key. A service principal is used
+// when AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET (or
+// AZURE_CERTIFICATE_PATH) are set, otherwise the managed identity of the node.
+// managedIdentityClientID selects a user-assigned managed identity.
+func NewEventHubSinkWithAAD(namespace string, hubName string, managedIdentityClientID string, overflow bool, bufferSize int, formatter Formatter) (*EventHubSink, error) {
+	var opt aad.JWTProviderOption
+	if managedIdentityClientID != "" {
+		msiEndpoint, err := adal.GetMSIVMEndpoint()
+		if err != nil {
+			return nil, err
+		}
+		token, err := adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, eventHubResourceURI, managedIdentityClientID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get oauth token from MSI: %v", err)
+		}
+		opt = aad.JWTProviderWithAADToken(token)
+	} else {
+		opt = aad.JWTProviderWithEnvironmentVars()
+	}
+
+	provider, err := aad.NewJWTProvider(opt)
+	if err != nil {
+		return nil, err
+	}
+	hub, err := eventhub.NewHub(namespace, hubName, provider)
+	if err != nil {
+		return nil, err
+	}
+	return newEventHubSink(hub, overflow, bufferSize, formatter), nil
+}
+
+func newEventHubSink(hub *eventhub.Hub, overflow bool, bufferSize int, formatter Formatter) *EventHubSink {
 	var eventCh channels.Channel
 	if overflow {
 		eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
@@ -51,7 +109,19 @@ func NewEventHubSink(connString string, overflow bool, bufferSize int) (*EventHu
 		eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
 	}
 
-	return &EventHubSink{hub: hub, eventCh: eventCh}, nil
+	h := &EventHubSink{
+		MaxRetries:   5,
+		hub:          hub,
+		retryBackoff: time.Second,
+		eventCh:      eventCh,
+		formatter:    formatter,
+	}
+	if hub != nil {
+		h.sendBatch = func(ctx context.Context, it eventhub.BatchIterator) error {
+			return hub.SendBatch(ctx, it)
+		}
+	}
+	return h
 }
 
 // UpdateEvents implements the EventSinkInterface. It really just writes the
@@ -62,6 +132,11 @@ func (h *EventHubSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 	h.eventCh.In() <- NewEventData(eNew, eOld)
 }
 
+// Status implements the StatusReporter interface
+func (h *EventHubSink) Status() SinkStatus {
+	return h.stats.status(h.eventCh.Len())
+}
+
 // Run sits in a loop, waiting for data to come in through h.eventCh,
 // and forwarding them to the event hub sink. If multiple events have happened
 // between loop iterations, it puts all of them in one request instead of
@@ -94,37 +169,171 @@ loop:
 				}
 			}
 
-			h.drainEvents(arr)
+			h.SendEvents(arr)
 		case <-stopCh:
 			break loop
 		}
 	}
 }
 
-// drainEvents takes an array of event data and sends it to the receiving event hub.
-func (h *EventHubSink) drainEvents(events []EventData) {
-	var messageSize int
+// SendEvents implements the BatchSender interface. It takes an array of event
+// data and sends it to the receiving event hub, in as many batches as the
+// partition keys and the maximum batch size require. Each batch is retried
+// with backoff up to MaxRetries times. Events that can't be serialized or are
+// too large on their own are logged and dropped.
+func (h *EventHubSink) SendEvents(events []EventData) error {
 	var evts []*eventhub.Event
 	for _, evt := range events {
-		eJSONBytes, err := json.Marshal(evt)
+		e, err := h.newEvent(evt)
 		if err != nil {
-			glog.Warningf("Failed to flatten json: %v", err)
-			return
+			glog.Warningf("Failed to serialize event: %v", err)
+			continue
 		}
-		glog.V(4).Infof("%s", string(eJSONBytes))
-		messageSize += len(eJSONBytes)
-		if messageSize > maxMessageSize {
-			h.sendBatch(evts)
-			evts = nil
-			messageSize = 0
+		evts = append(evts, e)
+	}
+
+	// A batch that fails doesn't keep the batches of other partition keys
+	// from being sent
+	var errs []error
+	for _, batch := range eventHubBatches(evts, maxMessageSize) {
+		if err := h.sendWithRetries(batch); err != nil {
+			errs = append(errs, err)
 		}
-		evts = append(evts, eventhub.NewEvent(eJSONBytes))
 	}
-	h.sendBatch(evts)
+	if err := combineErrors(errs); err != nil {
+		h.stats.sendFailed(err)
+		return err
+	}
+	h.stats.sendSucceeded()
+	return nil
+}
+
+// newEvent formats event data as an Event Hub event, with its partition key
+// and application properties
+func (h *EventHubSink) newEvent(evt EventData) (*eventhub.Event, error) {
+	b, err := h.formatter.Format(evt)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(4).Infof("%s", string(b))
+
+	e := eventhub.NewEvent(b)
+	if h.PartitionKey != nil {
+		key, err := h.PartitionKey.Format(evt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render partition key: %v", err)
+		}
+		if len(key) > 0 {
+			k := string(key)
+			e.PartitionKey = &k
+		}
+	}
+
+	props := map[string]string{
+		"namespace": evt.Event.InvolvedObject.Namespace,
+		"kind":      evt.Event.InvolvedObject.Kind,
+		"reason":    evt.Event.Reason,
+		"type":      evt.Event.Type,
+		"cluster":   h.ClusterName,
+	}
+	for k, v := range props {
+		if v != "" {
+			e.Set(k, v)
+		}
+	}
+	return e, nil
+}
+
+// eventHubBatches splits events into batches of at most maxSize bytes once
+// AMQP encoded, with one partition key per batch. Events keep their order
+// within a partition key.
+func eventHubBatches(evts []*eventhub.Event, maxSize int) []*eventhub.EventBatch {
+	opts := &eventhub.BatchOptions{MaxSize: eventhub.MaxMessageSizeInBytes(maxSize)}
+
+	var keys []string
+	byKey := map[string][]*eventhub.Event{}
+	for _, e := range evts {
+		var key string
+		if e.PartitionKey != nil {
+			key = *e.PartitionKey
+		}
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], e)
+	}
+
+	var batches []*eventhub.EventBatch
+	for _, key := range keys {
+		var batch *eventhub.EventBatch
+		var n int
+		for _, e := range byKey[key] {
+			if batch == nil {
+				batch = eventhub.NewEventBatch("", opts)
+				batch.PartitionKey = e.PartitionKey
+				n = 0
+			}
+			ok, err := batch.Add(e)
+			if err == nil && !ok && n > 0 {
+				// Full, start the next batch with this event
+				batches = append(batches, batch)
+				batch = eventhub.NewEventBatch("", opts)
+				batch.PartitionKey = e.PartitionKey
+				n = 0
+				ok, err = batch.Add(e)
+			}
+			switch {
+			case err != nil:
+				glog.Warningf("Failed to encode event: %v", err)
+			case !ok:
+				glog.Warningf("Dropping event of %d bytes, larger than the maximum batch size", len(e.Data))
+			default:
+				n++
+			}
+		}
+		if n > 0 {
+			batches = append(batches, batch)
+		}
+	}
+	return batches
+}
+
+// sendWithRetries sends one batch, retrying with exponential backoff
+func (h *EventHubSink) sendWithRetries(batch *eventhub.EventBatch) error {
+	backoff := h.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := h.sendBatch(context.Background(), &singleBatchIterator{batch: batch})
+		if err == nil {
+			return nil
+		}
+		if attempt >= h.MaxRetries {
+			glog.Errorf("Failed to send batch of %d bytes: %v", batch.Size(), err)
+			return err
+		}
+		glog.Warningf("Retrying batch of %d bytes in %v: %v", batch.Size(), backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// singleBatchIterator hands a batch that was already built to SendBatch, so
+// that each batch can be retried on its own
+type singleBatchIterator struct {
+	batch *eventhub.EventBatch
+	done  bool
+}
+
+// Done implements the eventhub.BatchIterator interface
+func (it *singleBatchIterator) Done() bool {
+	return it.done
 }
 
-func (h *EventHubSink) sendBatch(evts []*eventhub.Event) {
-	if err := h.hub.SendBatch(context.Background(), eventhub.NewEventBatchIterator(evts...)); err != nil {
-		glog.Errorf("Failed to send batch of %d: %v", len(evts), err)
+// Next implements the eventhub.BatchIterator interface
+func (it *singleBatchIterator) Next(messageID string, opts *eventhub.BatchOptions) (*eventhub.EventBatch, error) {
+	it.done = true
+	if it.batch.ID == "" {
+		// Keep the message ID across retries
+		it.batch.ID = messageID
 	}
+	return it.batch, nil
 }
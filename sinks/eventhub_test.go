@@ -0,0 +1,170 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	eventhub "github.com/Azure/azure-event-hubs-go/v2"
+)
+
+func newTestEventHubSink(t *testing.T) *EventHubSink {
+	h := newEventHubSink(nil, false, 10, mustGetFormatter("json"))
+	key, err := newTemplateFormatter("key", "{{.Event.InvolvedObject.Namespace}}/{{.Event.InvolvedObject.Name}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.PartitionKey = key
+	h.ClusterName = "prod-eu"
+	h.retryBackoff = 0
+	return h
+}
+
+func TestEventHubEvent(t *testing.T) {
+	h := newTestEventHubSink(t)
+	e, err := h.newEvent(formatTestEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.PartitionKey == nil || *e.PartitionKey != "prod/web-1" {
+		t.Errorf("Expected partition key prod/web-1, got %v", e.PartitionKey)
+	}
+	want := map[string]interface{}{
+		"namespace": "prod",
+		"kind":      "Pod",
+		"reason":    "BackOff",
+		"type":      "Warning",
+		"cluster":   "prod-eu",
+	}
+	for k, v := range want {
+		if e.Properties[k] != v {
+			t.Errorf("Expected property %s=%v, got %v", k, v, e.Properties[k])
+		}
+	}
+}
+
+func TestEventHubBatches(t *testing.T) {
+	newEvent := func(key string, size int) *eventhub.Event {
+		e := eventhub.NewEvent([]byte(strings.Repeat("x", size)))
+		e.PartitionKey = &key
+		return e
+	}
+	evts := []*eventhub.Event{
+		newEvent("a", 400),
+		newEvent("b", 400),
+		newEvent("a", 400),
+		newEvent("a", 5000),
+		newEvent("a", 400),
+	}
+
+	// Each event takes a little more than its data once encoded, so only two
+	// of them fit in a batch, and the 5000 byte one fits nowhere
+	batches := eventHubBatches(evts, 1200)
+	if len(batches) != 3 {
+		t.Fatalf("Expected 3 batches, got %d", len(batches))
+	}
+	for i, key := range []string{"a", "a", "b"} {
+		if *batches[i].PartitionKey != key {
+			t.Errorf("Expected batch %d to be for key %s, got %s", i, key, *batches[i].PartitionKey)
+		}
+		if batches[i].Size() > 1200 {
+			t.Errorf("Batch %d is %d bytes, over the maximum size", i, batches[i].Size())
+		}
+	}
+}
+
+func TestEventHubSendEventsRetries(t *testing.T) {
+	h := newTestEventHubSink(t)
+	var calls int
+	var ids []string
+	h.sendBatch = func(ctx context.Context, it eventhub.BatchIterator) error {
+		calls++
+		batch, _ := it.Next(fmt.Sprintf("id-%d", calls), nil)
+		ids = append(ids, batch.ID)
+		if calls < 3 {
+			return errors.New("link detached")
+		}
+		return nil
+	}
+
+	events := []EventData{formatTestEvent(), formatTestEvent()}
+	if err := h.SendEvents(events); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 2 retries, got %d calls", calls)
+	}
+	for _, id := range ids {
+		if id != "id-1" {
+			t.Errorf("Expected the batch to keep its message ID across retries, got %s", id)
+		}
+	}
+
+	h.MaxRetries = 1
+	calls = 0
+	h.sendBatch = func(ctx context.Context, it eventhub.BatchIterator) error {
+		calls++
+		return errors.New("link detached")
+	}
+	if err := h.SendEvents(events); err == nil {
+		t.Errorf("Expected an error once the retries are exhausted")
+	}
+	if calls != 2 {
+		t.Errorf("Expected 1 retry, got %d calls", calls)
+	}
+}
+
+func TestEventHubSendEventsKeepsSendingAfterFailures(t *testing.T) {
+	h := newTestEventHubSink(t)
+	h.MaxRetries = 0
+	var keys []string
+	h.sendBatch = func(ctx context.Context, it eventhub.BatchIterator) error {
+		batch, _ := it.Next("id", nil)
+		keys = append(keys, *batch.PartitionKey)
+		if len(keys) == 1 {
+			return errors.New("link detached")
+		}
+		return nil
+	}
+
+	other := formatTestEvent()
+	other.Event = other.Event.DeepCopy()
+	other.Event.InvolvedObject.Name = "web-2"
+	err := h.SendEvents([]EventData{formatTestEvent(), other})
+	if err == nil || !strings.Contains(err.Error(), "link detached") {
+		t.Errorf("Expected the error of the failed batch, got %v", err)
+	}
+	if len(keys) != 2 || keys[1] != "prod/web-2" {
+		t.Errorf("Expected the batch of the other partition key to be sent, got %v", keys)
+	}
+	if h.Status().Healthy {
+		t.Errorf("Expected the sink to be unhealthy after a failed batch")
+	}
+}
+
+func TestEventHubSendEventsSkipsBadEvents(t *testing.T) {
+	h := newTestEventHubSink(t)
+	h.formatter = FormatterFunc(func(e EventData) ([]byte, error) {
+		if e.Event.Reason == "Bad" {
+			return nil, errors.New("cannot format")
+		}
+		return formatJSON(e)
+	})
+	var sent int
+	h.sendBatch = func(ctx context.Context, it eventhub.BatchIterator) error {
+		sent++
+		return nil
+	}
+
+	bad := formatTestEvent()
+	bad.Event = bad.Event.DeepCopy()
+	bad.Event.Reason = "Bad"
+	if err := h.SendEvents([]EventData{bad, formatTestEvent()}); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 {
+		t.Errorf("Expected the remaining event to be sent, got %d batches", sent)
+	}
+}
@@ -0,0 +1,378 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+Expression is a boolean expression over the fields of an EventData, used to
+select events in alert rules and routes. For example:
+
+	Type == Warning && Reason in (OOMKilling, FailedScheduling)
+	InvolvedObject.Namespace matches "prod-*" || Count >= 10
+	!(Source.Component == kubelet) && Message =~ "^Liveness probe failed"
+
+Comparisons always have a field on the left and a literal on the right.
+Literals are bare words, numbers or double quoted strings. The operators are
+==, !=, <, <=, >, >= (numeric when both sides are numbers), in (a list of
+literals), matches (a glob pattern) and =~ (a regular expression). They can be
+combined with &&, || and !, and grouped with parentheses.
+*/
+type Expression struct {
+	source string
+	root   exprNode
+}
+
+// exprFields maps the field names usable in expressions to their value
+var exprFields = map[string]func(EventData) string{
+	"Verb":                     func(d EventData) string { return d.Verb },
+	"Type":                     func(d EventData) string { return d.Event.Type },
+	"Reason":                   func(d EventData) string { return d.Event.Reason },
+	"Message":                  func(d EventData) string { return d.Event.Message },
+	"Name":                     func(d EventData) string { return d.Event.Name },
+	"Namespace":                func(d EventData) string { return d.Event.Namespace },
+	"Count":                    func(d EventData) string { return strconv.Itoa(int(d.Event.Count)) },
+	"InvolvedObject.Kind":      func(d EventData) string { return d.Event.InvolvedObject.Kind },
+	"InvolvedObject.Name":      func(d EventData) string { return d.Event.InvolvedObject.Name },
+	"InvolvedObject.Namespace": func(d EventData) string { return d.Event.InvolvedObject.Namespace },
+	"InvolvedObject.FieldPath": func(d EventData) string { return d.Event.InvolvedObject.FieldPath },
+	"Source.Component":         func(d EventData) string { return d.Event.Source.Component },
+	"Source.Host":              func(d EventData) string { return d.Event.Source.Host },
+}
+
+// ParseExpression parses an expression. An empty expression matches every
+// event.
+func ParseExpression(s string) (*Expression, error) {
+	if strings.TrimSpace(s) == "" {
+		return &Expression{source: s, root: trueNode{}}, nil
+	}
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", s, err)
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", s, err)
+	}
+	return &Expression{source: s, root: root}, nil
+}
+
+// Match returns true if the event data satisfies the expression
+func (e *Expression) Match(d EventData) bool {
+	return e.root.eval(d)
+}
+
+// String returns the source of the expression
+func (e *Expression) String() string {
+	return e.source
+}
+
+type exprNode interface {
+	eval(d EventData) bool
+}
+
+type trueNode struct{}
+
+func (trueNode) eval(d EventData) bool { return true }
+
+type andNode struct{ left, right exprNode }
+
+func (n andNode) eval(d EventData) bool { return n.left.eval(d) && n.right.eval(d) }
+
+type orNode struct{ left, right exprNode }
+
+func (n orNode) eval(d EventData) bool { return n.left.eval(d) || n.right.eval(d) }
+
+type notNode struct{ expr exprNode }
+
+func (n notNode) eval(d EventData) bool { return !n.expr.eval(d) }
+
+// cmpNode compares a field with one or more literals
+type cmpNode struct {
+	field  func(EventData) string
+	op     string
+	values []string
+	re     *regexp.Regexp
+}
+
+func (n cmpNode) eval(d EventData) bool {
+	v := n.field(d)
+	switch n.op {
+	case "==":
+		return v == n.values[0]
+	case "!=":
+		return v != n.values[0]
+	case "in":
+		for _, val := range n.values {
+			if v == val {
+				return true
+			}
+		}
+		return false
+	case "matches":
+		ok, _ := path.Match(n.values[0], v)
+		return ok
+	case "=~":
+		return n.re.MatchString(v)
+	}
+
+	// Ordering operators compare numbers numerically and anything else
+	// lexically.
+	cmp := strings.Compare(v, n.values[0])
+	if a, err := strconv.ParseFloat(v, 64); err == nil {
+		if b, err := strconv.ParseFloat(n.values[0], 64); err == nil {
+			switch {
+			case a < b:
+				cmp = -1
+			case a > b:
+				cmp = 1
+			default:
+				cmp = 0
+			}
+		}
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// exprOperators are the comparison operators taking a single literal
+var exprOperators = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "=~": true,
+}
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// tokenize splits an expression into words, quoted strings and operators
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			text, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokString, text})
+			i = j + 1
+		case strings.ContainsRune("()!=<>&|,~", c):
+			op := string(c)
+			for _, two := range []string{"&&", "||", "==", "!=", "<=", ">=", "=~"} {
+				if strings.HasPrefix(s[i:], two) {
+					op = two
+					break
+				}
+			}
+			if op == "&" || op == "|" || op == "=" || op == "~" {
+				return nil, fmt.Errorf("unexpected %q", op)
+			}
+			tokens = append(tokens, token{tokOp, op})
+			i += len(op)
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune("()!=<>&|,~\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, token{tokWord, s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// exprParser is a recursive descent parser over the tokens of an expression
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) peek() *token {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *exprParser) acceptOp(op string) bool {
+	if t := p.peek(); t != nil && t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.acceptOp("!") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{expr}, nil
+	}
+	if p.acceptOp("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.acceptOp(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	t := p.peek()
+	if t == nil || t.kind != tokWord {
+		return nil, fmt.Errorf("expected a field name")
+	}
+	field, ok := exprFields[t.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", t.text)
+	}
+	p.pos++
+
+	t = p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("expected an operator")
+	}
+	p.pos++
+	n := cmpNode{field: field, op: t.text}
+	switch {
+	case t.kind == tokWord && t.text == "in":
+		if !p.acceptOp("(") {
+			return nil, fmt.Errorf("expected ( after in")
+		}
+		for {
+			v, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			n.values = append(n.values, v)
+			if p.acceptOp(")") {
+				break
+			}
+			if !p.acceptOp(",") {
+				return nil, fmt.Errorf("expected , or ) in list")
+			}
+		}
+		return n, nil
+	case t.kind == tokWord && t.text == "matches":
+	case t.kind == tokOp && exprOperators[t.text]:
+	default:
+		return nil, fmt.Errorf("unknown operator %q", t.text)
+	}
+
+	v, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	n.values = []string{v}
+	switch n.op {
+	case "matches":
+		if _, err := path.Match(v, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", v, err)
+		}
+	case "=~":
+		if n.re, err = regexp.Compile(v); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (p *exprParser) parseLiteral() (string, error) {
+	t := p.peek()
+	if t == nil || t.kind == tokOp {
+		return "", fmt.Errorf("expected a value")
+	}
+	p.pos++
+	return t.text, nil
+}
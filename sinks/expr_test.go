@@ -0,0 +1,78 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestExpression(t *testing.T) {
+	evt := &v1.Event{
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "web-1", Namespace: "prod-eu"},
+		Reason:         "OOMKilling",
+		Message:        "Memory cgroup out of memory",
+		Type:           "Warning",
+		Count:          12,
+		Source:         v1.EventSource{Component: "kubelet"},
+	}
+	data := NewEventData(evt, nil)
+
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{"", true},
+		{"Type == Warning && Reason in (OOMKilling, FailedScheduling)", true},
+		{"Type == Warning && Reason in (FailedScheduling)", false},
+		{`InvolvedObject.Namespace matches "prod-*"`, true},
+		{`InvolvedObject.Namespace matches "dev-*" || Count >= 10`, true},
+		{"Count > 12", false},
+		{"Count < 9", false},
+		{`!(Source.Component == kubelet) && Message =~ "^Memory"`, false},
+		{`Message =~ "out of (memory|disk)"`, true},
+		{"Verb != UPDATED", true},
+		{`Reason == "OOMKilling"`, true},
+	}
+	for _, test := range tests {
+		e, err := ParseExpression(test.expr)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", test.expr, err)
+			continue
+		}
+		if got := e.Match(data); got != test.match {
+			t.Errorf("%q: got %v, expected %v", test.expr, got, test.match)
+		}
+	}
+
+	for _, bad := range []string{
+		"Type",
+		"Type = Warning",
+		"Bogus == 1",
+		"Type == Warning &&",
+		"Reason in (A, B",
+		"(Type == Warning",
+		`Message =~ "("`,
+		"Type ! Warning",
+		`Message == "unterminated`,
+	} {
+		if _, err := ParseExpression(bad); err == nil {
+			t.Errorf("Expected %q to fail to parse", bad)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// Limits of a PutRecordBatch request
+	firehoseMaxRecords     = 500
+	firehoseMaxBytes       = 4 * 1024 * 1024
+	firehoseMaxRecordBytes = 1000 * 1024
+)
+
+// FirehoseSink puts events in a Kinesis Data Firehose delivery stream
+type FirehoseSink struct {
+	// AppendNewline ends each record with a newline. Firehose concatenates
+	// records as they are, so this keeps events apart in the delivered files.
+	AppendNewline bool
+
+	// MaxRetries bounds how many times the records that failed in a batch are
+	// retried
+	MaxRetries int
+
+	client       *firehose.Firehose
+	stream       string
+	formatter    Formatter
+	retryBackoff time.Duration
+	eventCh      channels.Channel
+	stats        sinkStats
+}
+
+// NewFirehoseSink constructs a new FirehoseSink putting events in the given
+// delivery stream. A non-empty endpoint overrides that of Firehose, to use a
+// local stand-in such as LocalStack.
+func NewFirehoseSink(accessKeyID, secretAccessKey, region, endpoint, stream string, overflow bool, bufferSize int, formatter Formatter) (*FirehoseSink, error) {
+	sess, err := newAWSSession(accessKeyID, secretAccessKey, region, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FirehoseSink{
+		client:       firehose.New(sess),
+		stream:       stream,
+		formatter:    formatter,
+		retryBackoff: 100 * time.Millisecond,
+	}
+	if overflow {
+		f.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		f.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+	return f, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event OverflowingChannel, which should never block.
+// Messages that are buffered beyond the bufferSize specified for this
+// FirehoseSink are discarded.
+func (f *FirehoseSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	f.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Status implements the StatusReporter interface
+func (f *FirehoseSink) Status() SinkStatus {
+	return f.stats.status(f.eventCh.Len())
+}
+
+// HealthCheck implements the HealthChecker interface by checking that the
+// delivery stream exists and is accessible with the configured credentials.
+func (f *FirehoseSink) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	_, err := f.client.DescribeDeliveryStreamWithContext(ctx, &firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: aws.String(f.stream),
+	})
+	return err
+}
+
+// Run sits in a loop, waiting for data to come in through f.eventCh, and
+// forwarding them to Firehose. If multiple events have happened between loop
+// iterations, it puts all of them in as few requests as possible.
+func (f *FirehoseSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-f.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := f.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-f.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			f.SendEvents(arr)
+		case <-stopCh:
+			break loop
+		}
+	}
+}
+
+// SendEvents implements the BatchSender interface. It puts the events in
+// PutRecordBatch requests within the limits of Firehose, and retries the
+// records that failed. A batch that still fails doesn't stop the others from
+// being put, and the errors are returned together. Events that can't be
+// serialized are logged and dropped.
+func (f *FirehoseSink) SendEvents(events []EventData) error {
+	var records []awsRecord
+	for _, evt := range events {
+		data, err := f.formatter.Format(evt)
+		if err != nil {
+			glog.Warningf("Failed to serialize event: %v", err)
+			continue
+		}
+		if f.AppendNewline {
+			data = append(data, '\n')
+		}
+		records = append(records, awsRecord{data: data})
+	}
+
+	// A batch that fails doesn't keep the next batches from being put
+	var errs []error
+	for _, batch := range awsBatches(records, firehoseMaxRecords, firehoseMaxBytes, firehoseMaxRecordBytes) {
+		if err := putAWSRecords(batch, f.putRecordBatch, f.MaxRetries, f.retryBackoff); err != nil {
+			glog.Errorf("Failed to put %d records in Firehose delivery stream %s: %v", len(batch), f.stream, err)
+			errs = append(errs, err)
+		}
+	}
+	if err := combineErrors(errs); err != nil {
+		f.stats.sendFailed(err)
+		return err
+	}
+	f.stats.sendSucceeded()
+	return nil
+}
+
+// putRecordBatch makes a PutRecordBatch request, and returns the records that
+// failed
+func (f *FirehoseSink) putRecordBatch(records []awsRecord) ([]awsRecord, string, error) {
+	input := &firehose.PutRecordBatchInput{DeliveryStreamName: aws.String(f.stream)}
+	for _, r := range records {
+		input.Records = append(input.Records, &firehose.Record{Data: r.data})
+	}
+
+	out, err := f.client.PutRecordBatch(input)
+	if err != nil {
+		return nil, "", err
+	}
+	if aws.Int64Value(out.FailedPutCount) == 0 {
+		return nil, "", nil
+	}
+
+	// Responses are in the order of the records
+	var failed []awsRecord
+	var code string
+	for i, res := range out.RequestResponses {
+		if res.ErrorCode == nil || i >= len(records) {
+			continue
+		}
+		if code == "" {
+			code = aws.StringValue(res.ErrorCode) + ": " + aws.StringValue(res.ErrorMessage)
+		}
+		failed = append(failed, records[i])
+	}
+	return failed, code, nil
+}
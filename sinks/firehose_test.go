@@ -0,0 +1,82 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFirehoseSink(t *testing.T) {
+	f := &fakeAWSStreams{fail: func(n int) bool { return n == 1 }}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	fh, err := NewFirehoseSink("key", "secret", "us-east-1", srv.URL, "events", false, 10, mustGetFormatter("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.retryBackoff = 0
+	fh.MaxRetries = 2
+	fh.AppendNewline = true
+
+	if err := fh.HealthCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fh.SendEvents([]EventData{formatTestEvent(), formatTestEvent()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first record failed, and is retried on its own
+	if len(f.requests) != 2 || len(f.requests[0]) != 2 || len(f.requests[1]) != 1 {
+		t.Fatalf("Expected requests of 2 and 1 records, got %v", f.requests)
+	}
+	for _, r := range f.requests[0] {
+		if r.PartitionKey != "" {
+			t.Errorf("Expected no partition key, got %q", r.PartitionKey)
+		}
+		if !bytes.HasSuffix(r.Data, []byte("}\n")) {
+			t.Errorf("Expected a newline delimited record, got %q", r.Data)
+		}
+	}
+}
+
+func TestFirehoseSinkKeepsPuttingAfterFailedBatch(t *testing.T) {
+	// Every record of the first batch fails
+	f := &fakeAWSStreams{fail: func(n int) bool { return n <= firehoseMaxRecords }}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	fh, err := NewFirehoseSink("key", "secret", "us-east-1", srv.URL, "events", false, 10, mustGetFormatter("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.retryBackoff = 0
+	fh.MaxRetries = 0
+
+	events := make([]EventData, firehoseMaxRecords+1)
+	for i := range events {
+		events[i] = formatTestEvent()
+	}
+	if err := fh.SendEvents(events); err == nil {
+		t.Fatal("Expected an error for the failed batch")
+	}
+	if len(f.requests) != 2 || len(f.requests[1]) != 1 {
+		t.Errorf("Expected the second batch to be put, got %d requests", len(f.requests))
+	}
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/spf13/viper"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// Formatter serializes event data into the bytes a sink writes out. Sinks
+// reference formatters by name, so the same schema can be shared by every
+// sink.
+type Formatter interface {
+	Format(e EventData) ([]byte, error)
+}
+
+// FormatterFunc adapts a function to the Formatter interface
+type FormatterFunc func(e EventData) ([]byte, error)
+
+// Format implements the Formatter interface
+func (f FormatterFunc) Format(e EventData) ([]byte, error) {
+	return f(e)
+}
+
+var (
+	formattersMu sync.RWMutex
+
+	// formatters holds the built-in and user-defined formats by name
+	formatters = map[string]Formatter{
+		"json":     FormatterFunc(formatJSON),
+		"flatjson": FormatterFunc(formatFlatJSON),
+		"rfc5424":  FormatterFunc(formatRFC5424),
+		"logfmt":   FormatterFunc(formatLogfmt),
+
+		"cloudevents":        NewCloudEventsFormatter("", false),
+		"cloudevents-binary": NewCloudEventsFormatter("", true),
+		"ecs":                NewECSFormatter(DefaultECSRawField),
+
+		"protobuf": FormatterFunc(formatProtobuf),
+		"avro":     avroFormatter{},
+	}
+)
+
+// RegisterFormatter makes a formatter available under the given name,
+// replacing any previous formatter with that name.
+func RegisterFormatter(name string, f Formatter) {
+	formattersMu.Lock()
+	defer formattersMu.Unlock()
+	formatters[name] = f
+}
+
+// GetFormatter returns the formatter registered under the given name
+func GetFormatter(name string) (Formatter, error) {
+	formattersMu.RLock()
+	defer formattersMu.RUnlock()
+	f, ok := formatters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q", name)
+	}
+	return f, nil
+}
+
+// mustGetFormatter is used by ManufactureSink, where config errors panic
+func mustGetFormatter(name string) Formatter {
+	f, err := GetFormatter(name)
+	if err != nil {
+		panic(err.Error())
+	}
+	return f
+}
+
+// FormatConfig describes a user-defined format. Template formats render a
+// text/template over the EventData; jsonpath formats build a JSON object with
+// one key per field, projected from the JSON form of the EventData.
+type FormatConfig struct {
+	Name     string              `mapstructure:"name"`
+	Type     string              `mapstructure:"type"`
+	Template string              `mapstructure:"template"`
+	Fields   []FormatFieldConfig `mapstructure:"fields"`
+}
+
+// FormatFieldConfig is one key of a jsonpath format. Path is a kubectl style
+// JSONPath expression such as {.event.involvedObject.name}.
+type FormatFieldConfig struct {
+	Name string `mapstructure:"name"`
+	Path string `mapstructure:"path"`
+}
+
+// LoadFormats registers the user-defined formats listed under "formats" in
+// the config, sets the cluster name of the CloudEvents formats from
+// "cloudEventsCluster" and the raw field of the ecs format from "ecsRawField".
+// It must be called before the sinks are manufactured.
+func LoadFormats() error {
+	if cluster := viper.GetString("cloudEventsCluster"); cluster != "" {
+		RegisterFormatter("cloudevents", NewCloudEventsFormatter(cluster, false))
+		RegisterFormatter("cloudevents-binary", NewCloudEventsFormatter(cluster, true))
+	}
+
+	if viper.IsSet("ecsRawField") {
+		RegisterFormatter("ecs", NewECSFormatter(viper.GetString("ecsRawField")))
+	}
+
+	var configs []FormatConfig
+	if err := viper.UnmarshalKey("formats", &configs); err != nil {
+		return err
+	}
+	for _, c := range configs {
+		f, err := NewFormatter(c)
+		if err != nil {
+			return err
+		}
+		RegisterFormatter(c.Name, f)
+	}
+	return nil
+}
+
+// NewFormatter builds a user-defined formatter
+func NewFormatter(c FormatConfig) (Formatter, error) {
+	if c.Name == "" {
+		return nil, fmt.Errorf("format has no name")
+	}
+	switch c.Type {
+	case "template":
+		return newTemplateFormatter(c.Name, c.Template)
+	case "jsonpath":
+		return newJSONPathFormatter(c.Name, c.Fields)
+	default:
+		return nil, fmt.Errorf("invalid type %q for format %q, must be template or jsonpath", c.Type, c.Name)
+	}
+}
+
+// formatJSON serializes the EventData as is
+func formatJSON(e EventData) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// formatFlatJSON flattens the EventData into snake_case keys, see
+// WriteFlattenedJSON
+func formatFlatJSON(e EventData) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := e.WriteFlattenedJSON(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// formatRFC5424 writes the EventData as an RFC5424 syslog message, see
+// WriteRFC5424
+func formatRFC5424(e EventData) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := e.WriteRFC5424(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// eventField is a main field of an event, as a string
+type eventField struct{ key, value string }
+
+// eventFields returns the main fields of the new event, as used by logfmt
+func eventFields(e EventData) []eventField {
+	evt := e.Event
+	return []eventField{
+		{"time", evt.LastTimestamp.UTC().Format("2006-01-02T15:04:05Z07:00")},
+		{"verb", e.Verb},
+		{"type", evt.Type},
+		{"reason", evt.Reason},
+		{"kind", evt.InvolvedObject.Kind},
+		{"namespace", evt.InvolvedObject.Namespace},
+		{"name", evt.InvolvedObject.Name},
+		{"component", evt.Source.Component},
+		{"host", evt.Source.Host},
+		{"count", strconv.Itoa(int(evt.Count))},
+		{"message", evt.Message},
+	}
+}
+
+// formatLogfmt writes the main fields of the new event as logfmt key=value
+// pairs
+func formatLogfmt(e EventData) ([]byte, error) {
+	var buf bytes.Buffer
+	for i, p := range eventFields(e) {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(p.key)
+		buf.WriteByte('=')
+		if p.value == "" || strings.ContainsAny(p.value, " =\"\t\r\n") {
+			buf.WriteString(strconv.Quote(p.value))
+		} else {
+			buf.WriteString(p.value)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// templateFuncs are available in template formats
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func newTemplateFormatter(name, text string) (Formatter, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template for format %q: %v", name, err)
+	}
+	return FormatterFunc(func(e EventData) ([]byte, error) {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, e); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}), nil
+}
+
+// jsonPathField is a parsed field of a jsonpath format
+type jsonPathField struct {
+	name string
+	path *jsonpath.JSONPath
+}
+
+func newJSONPathFormatter(name string, fields []FormatFieldConfig) (Formatter, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("jsonpath format %q has no fields", name)
+	}
+	parsed := make([]jsonPathField, len(fields))
+	for i, f := range fields {
+		p := jsonpath.New(f.Name).AllowMissingKeys(true)
+		if err := p.Parse(f.Path); err != nil {
+			return nil, fmt.Errorf("invalid path %q for field %q of format %q: %v", f.Path, f.Name, name, err)
+		}
+		parsed[i] = jsonPathField{f.Name, p}
+	}
+
+	// A JSONPath keeps state while it is evaluated, so it can't be used
+	// concurrently
+	var mu sync.Mutex
+	return FormatterFunc(func(e EventData) ([]byte, error) {
+		// JSONPath works on the generic JSON form, so the paths use the JSON
+		// field names
+		raw, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		var data interface{}
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return nil, err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Build the object by hand to keep the configured key order
+		var buf bytes.Buffer
+		buf.WriteByte('{')
+		for i, f := range parsed {
+			results, err := f.path.FindResults(data)
+			if err != nil {
+				return nil, err
+			}
+			var values []interface{}
+			for _, r := range results {
+				for _, v := range r {
+					values = append(values, v.Interface())
+				}
+			}
+			var value interface{}
+			switch len(values) {
+			case 0:
+			case 1:
+				value = values[0]
+			default:
+				value = values
+			}
+
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(f.name)
+			val, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(val)
+		}
+		buf.WriteByte('}')
+		return buf.Bytes(), nil
+	}), nil
+}
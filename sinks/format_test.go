@@ -0,0 +1,90 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func formatTestEvent() EventData {
+	return NewEventData(&v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "web-1.15c", Namespace: "prod"},
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "web-1", Namespace: "prod"},
+		Reason:         "BackOff",
+		Message:        `Back-off restarting failed container "app"`,
+		Source:         v1.EventSource{Component: "kubelet", Host: "node-1"},
+		Type:           v1.EventTypeWarning,
+		Count:          3,
+		LastTimestamp:  metav1.NewTime(time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)),
+	}, nil)
+}
+
+func TestFormatters(t *testing.T) {
+	tests := []struct {
+		format FormatConfig
+		want   string
+	}{
+		{
+			FormatConfig{Name: "tmpl", Type: "template", Template: `{{.Verb}} {{.Event.Reason}} {{json .Event.InvolvedObject.Name}}`},
+			`ADDED BackOff "web-1"`,
+		},
+		{
+			FormatConfig{Name: "projection", Type: "jsonpath", Fields: []FormatFieldConfig{
+				{Name: "reason", Path: "{.event.reason}"},
+				{Name: "object", Path: "{.event.involvedObject.name}"},
+				{Name: "count", Path: "{.event.count}"},
+				{Name: "missing", Path: "{.old_event.reason}"},
+			}},
+			`{"reason":"BackOff","object":"web-1","count":3,"missing":null}`,
+		},
+	}
+	for _, test := range tests {
+		f, err := NewFormatter(test.format)
+		if err != nil {
+			t.Fatalf("%s: %v", test.format.Name, err)
+		}
+		got, err := f.Format(formatTestEvent())
+		if err != nil {
+			t.Fatalf("%s: %v", test.format.Name, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: expected %s, got %s", test.format.Name, test.want, got)
+		}
+	}
+
+	logfmt, err := GetFormatter("logfmt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := logfmt.Format(formatTestEvent())
+	want := `time=2019-09-01T12:00:00Z verb=ADDED type=Warning reason=BackOff kind=Pod namespace=prod name=web-1 ` +
+		`component=kubelet host=node-1 count=3 message="Back-off restarting failed container \"app\""`
+	if string(got) != want {
+		t.Errorf("Expected logfmt %s, got %s", want, got)
+	}
+
+	if _, err := GetFormatter("nope"); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+	if _, err := NewFormatter(FormatConfig{Name: "bad", Type: "jsonpath", Fields: []FormatFieldConfig{{Name: "x", Path: "{.event["}}}); err == nil {
+		t.Errorf("Expected an error for an invalid path")
+	}
+}
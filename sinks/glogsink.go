@@ -17,8 +17,6 @@ limitations under the License.
 package sinks
 
 import (
-	"encoding/json"
-
 	"github.com/golang/glog"
 	"k8s.io/api/core/v1"
 )
@@ -27,19 +25,21 @@ import (
 // Useful when you already have ELK/EFK Stack
 type GlogSink struct {
 	// TODO: create a channel and buffer for scaling
+	formatter Formatter
 }
 
-// NewGlogSink will create a new
-func NewGlogSink() EventSinkInterface {
-	return &GlogSink{}
+// NewGlogSink will create a new GlogSink logging events with the given
+// formatter
+func NewGlogSink(formatter Formatter) EventSinkInterface {
+	return &GlogSink{formatter: formatter}
 }
 
 // UpdateEvents implements the EventSinkInterface
 func (gs *GlogSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 	eData := NewEventData(eNew, eOld)
 
-	if eJSONBytes, err := json.Marshal(eData); err == nil {
-		glog.Info(string(eJSONBytes))
+	if b, err := gs.formatter.Format(eData); err == nil {
+		glog.Info(string(b))
 	} else {
 		glog.Warningf("Failed to json serialize event: %v", err)
 	}
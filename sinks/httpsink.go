@@ -18,6 +18,8 @@ package sinks
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/eapache/channels"
@@ -50,15 +52,21 @@ containing the kubernetes v1.Event.
 type HTTPSink struct {
 	SinkURL string
 
+	// Formatter serializes each event of a request body, one per line. It
+	// defaults to the rfc5424 format.
+	Formatter Formatter
+
 	eventCh    channels.Channel
 	httpClient *pester.Client
 	bodyBuf    *bytes.Buffer
+	stats      sinkStats
 }
 
 // NewHTTPSink constructs a new HTTPSink given a sink URL and buffer size
 func NewHTTPSink(sinkURL string, overflow bool, bufferSize int) *HTTPSink {
 	h := &HTTPSink{
-		SinkURL: sinkURL,
+		SinkURL:   sinkURL,
+		Formatter: FormatterFunc(formatRFC5424),
 	}
 
 	if overflow {
@@ -85,6 +93,33 @@ func (h *HTTPSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 	h.eventCh.In() <- NewEventData(eNew, eOld)
 }
 
+// Status implements the StatusReporter interface
+func (h *HTTPSink) Status() SinkStatus {
+	return h.stats.status(h.eventCh.Len())
+}
+
+// HealthCheck implements the HealthChecker interface. It sends a HEAD request
+// to the sink URL; any response other than a server error means the endpoint
+// is reachable.
+func (h *HTTPSink) HealthCheck() error {
+	req, err := http.NewRequest("HEAD", h.SinkURL, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: healthCheckTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("got HTTP code %v from %v", resp.StatusCode, h.SinkURL)
+	}
+	return nil
+}
+
 // Run sits in a loop, waiting for data to come in through h.eventCh,
 // and forwarding them to the HTTP sink. If multiple events have happened
 // between loop iterations, it puts all of them in one request instead of
@@ -116,46 +151,90 @@ loop:
 				}
 			}
 
-			h.drainEvents(arr)
+			h.SendEvents(arr)
 		case <-stopCh:
 			break loop
 		}
 	}
 }
 
-// drainEvents takes an array of event data and sends it to the receiving HTTP
-// server. This function is *NOT* re-entrant: it re-uses the same body buffer
-// for each call, truncating it each time to avoid extra memory allocations.
-func (h *HTTPSink) drainEvents(events []EventData) {
+// SendEvents implements the BatchSender interface. It takes an array of event
+// data and sends it to the receiving HTTP server, one event per line. Formats
+// with attributes, such as CloudEvents, are sent one event per request with
+// the attributes as headers. This function is *NOT* re-entrant: it re-uses the
+// same body buffer for each call, truncating it each time to avoid extra
+// memory allocations.
+func (h *HTTPSink) SendEvents(events []EventData) error {
+	if af, ok := h.Formatter.(AttributeFormatter); ok {
+		for _, evt := range events {
+			body, err := af.Format(evt)
+			if err != nil {
+				glog.Warningf("Could not serialize event: %v", err)
+				h.stats.sendFailed(err)
+				return err
+			}
+			if err := h.post(bytes.NewReader(body), af.Attributes(evt)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	// Reuse the body buffer for each request
 	h.bodyBuf.Truncate(0)
 
 	var written int64
 	for _, evt := range events {
-		w, err := evt.WriteRFC5424(h.bodyBuf)
-		written += w
+		b, err := h.Formatter.Format(evt)
+		if err == nil {
+			var w int
+			w, err = h.bodyBuf.Write(b)
+			written += int64(w)
+		}
 		if err != nil {
 			glog.Warningf("Could not write to event request body (wrote %v) bytes: %v", written, err)
-			return
+			h.stats.sendFailed(err)
+			return err
 		}
 
 		h.bodyBuf.Write([]byte{'\n'})
 		written++
 	}
 
-	req, err := http.NewRequest("POST", h.SinkURL, h.bodyBuf)
+	return h.post(h.bodyBuf, nil)
+}
+
+// post sends a request body to the receiving HTTP server. The datacontenttype
+// attribute sets the Content-Type header, the others are sent as ce- headers.
+func (h *HTTPSink) post(body io.Reader, attrs map[string]string) error {
+	req, err := http.NewRequest("POST", h.SinkURL, body)
 	if err != nil {
 		glog.Warningf(err.Error())
-		return
+		h.stats.sendFailed(err)
+		return err
+	}
+	for k, v := range attrs {
+		if k == "datacontenttype" {
+			req.Header.Set("Content-Type", v)
+		} else {
+			req.Header.Set("ce-"+k, v)
+		}
 	}
 
 	resp, err := h.httpClient.Do(req)
 	if err != nil {
 		glog.Warningf(err.Error())
-		return
+		h.stats.sendFailed(err)
+		return err
 	}
+	resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		glog.Warningf("Got HTTP code %v from %v", resp.StatusCode, h.SinkURL)
+		err := fmt.Errorf("got HTTP code %v from %v", resp.StatusCode, h.SinkURL)
+		h.stats.sendFailed(err)
+		return err
 	}
+	h.stats.sendSucceeded()
+	return nil
 }
@@ -0,0 +1,413 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultPagerDutyURL is the PagerDuty Events API v2 endpoint
+	DefaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+	// DefaultOpsgenieURL is the Opsgenie Alert API endpoint
+	DefaultOpsgenieURL = "https://api.opsgenie.com/v2/alerts"
+
+	// incidentMaxBackoff caps the delay between two delivery attempts
+	incidentMaxBackoff = 5 * time.Minute
+)
+
+// IncidentRule opens an incident for the events matching Expression, and
+// resolves it when an event matching Resolve is seen for the same object.
+type IncidentRule struct {
+	Name string `mapstructure:"name"`
+
+	// Expression selects the events that trigger an incident, see Expression
+	// for the syntax
+	Expression string `mapstructure:"expression"`
+
+	// Resolve selects the recovery events, for example "Reason == NodeReady".
+	// Incidents are never resolved automatically when it is empty.
+	Resolve string `mapstructure:"resolve"`
+
+	// Namespace is a glob pattern the namespace of the involved object must
+	// match. An empty pattern matches every namespace.
+	Namespace string `mapstructure:"namespace"`
+
+	// Severity is one of critical, error, warning or info
+	Severity string `mapstructure:"severity"`
+
+	expr    *Expression
+	resolve *Expression
+}
+
+// incidentAction is a trigger or a resolve waiting to be delivered
+type incidentAction struct {
+	resolve  bool
+	key      string
+	rule     *IncidentRule
+	event    EventData
+	attempts int
+	next     time.Time
+}
+
+// incidentProvider builds the API requests of an incident management service
+type incidentProvider interface {
+	request(a *incidentAction) (*http.Request, error)
+}
+
+/*
+IncidentSink opens and resolves incidents in PagerDuty or Opsgenie. The
+dedup key of an incident is derived from the involved object and the reason of
+the triggering event, so repeated events update the same incident.
+
+Actions are delivered in order from an in-memory retry queue. A failed delivery
+is retried with exponential backoff and holds back the actions behind it, so a
+resolve never overtakes its trigger. Requests rejected with a 4xx status other
+than 429 are dropped.
+*/
+type IncidentSink struct {
+	provider   incidentProvider
+	rules      []*IncidentRule
+	eventCh    channels.Channel
+	httpClient *http.Client
+	maxQueue   int
+	stats      sinkStats
+
+	mu    sync.Mutex
+	queue []*incidentAction
+
+	// open is the set of dedup keys with an open incident per rule and
+	// object, only used from the Run goroutine
+	open map[string]map[string]bool
+}
+
+// NewPagerDutySink constructs an IncidentSink sending to the PagerDuty Events
+// API v2 with the given integration routing key.
+func NewPagerDutySink(apiURL, routingKey string, rules []*IncidentRule, overflow bool, bufferSize, maxQueue int) (*IncidentSink, error) {
+	return newIncidentSink(&pagerDuty{url: apiURL, routingKey: routingKey}, rules, overflow, bufferSize, maxQueue)
+}
+
+// NewOpsgenieSink constructs an IncidentSink sending to the Opsgenie Alert API
+// with the given API integration key.
+func NewOpsgenieSink(apiURL, apiKey string, rules []*IncidentRule, overflow bool, bufferSize, maxQueue int) (*IncidentSink, error) {
+	return newIncidentSink(&opsgenie{url: apiURL, apiKey: apiKey}, rules, overflow, bufferSize, maxQueue)
+}
+
+func newIncidentSink(provider incidentProvider, rules []*IncidentRule, overflow bool, bufferSize, maxQueue int) (*IncidentSink, error) {
+	for _, r := range rules {
+		if r.Expression == "" {
+			return nil, fmt.Errorf("incident rule %q has no expression", r.Name)
+		}
+		var err error
+		if r.expr, err = ParseExpression(r.Expression); err != nil {
+			return nil, fmt.Errorf("incident rule %q: %v", r.Name, err)
+		}
+		if r.Resolve != "" {
+			if r.resolve, err = ParseExpression(r.Resolve); err != nil {
+				return nil, fmt.Errorf("incident rule %q: %v", r.Name, err)
+			}
+		}
+		if _, err := path.Match(r.Namespace, ""); err != nil {
+			return nil, fmt.Errorf("incident rule %q: invalid namespace pattern: %v", r.Name, err)
+		}
+		switch r.Severity {
+		case "":
+			r.Severity = "critical"
+		case "critical", "error", "warning", "info":
+		default:
+			return nil, fmt.Errorf("incident rule %q: invalid severity %q", r.Name, r.Severity)
+		}
+	}
+
+	s := &IncidentSink{
+		provider:   provider,
+		rules:      rules,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		maxQueue:   maxQueue,
+		open:       map[string]map[string]bool{},
+	}
+	if overflow {
+		s.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		s.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+	return s, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, rules are evaluated in Run.
+func (s *IncidentSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	s.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Status implements the StatusReporter interface. Queued actions count towards
+// the buffer depth.
+func (s *IncidentSink) Status() SinkStatus {
+	s.mu.Lock()
+	depth := len(s.queue)
+	s.mu.Unlock()
+	return s.stats.status(s.eventCh.Len() + depth)
+}
+
+// Run sits in a loop, evaluating the rules against the events coming in
+// through s.eventCh and delivering the resulting actions.
+func (s *IncidentSink) Run(stopCh <-chan bool) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case e := <-s.eventCh.Out():
+			evt, ok := e.(EventData)
+			if !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+			s.evaluate(evt)
+			s.flush(time.Now())
+		case <-ticker.C:
+			s.flush(time.Now())
+		case <-stopCh:
+			break loop
+		}
+	}
+}
+
+// evaluate queues the triggers and resolves caused by an event
+func (s *IncidentSink) evaluate(evt EventData) {
+	obj := evt.Event.InvolvedObject
+	objKey := obj.Kind + "/" + obj.Namespace + "/" + obj.Name
+	for _, r := range s.rules {
+		if ok, _ := path.Match(r.Namespace, obj.Namespace); r.Namespace != "" && !ok {
+			continue
+		}
+		openKey := r.Name + "\xff" + objKey
+
+		if r.resolve != nil && r.resolve.Match(evt) {
+			for key := range s.open[openKey] {
+				s.enqueue(&incidentAction{resolve: true, key: key, rule: r, event: evt})
+			}
+			delete(s.open, openKey)
+			continue
+		}
+		if !r.expr.Match(evt) {
+			continue
+		}
+
+		// The rule is part of the key, so that rules matching the same event
+		// open and resolve their own incidents
+		key := r.Name + "/" + objKey + "/" + evt.Event.Reason
+		if s.open[openKey][key] {
+			continue
+		}
+		s.enqueue(&incidentAction{key: key, rule: r, event: evt})
+		// Only incidents that can be resolved need to be remembered
+		if r.resolve != nil {
+			if s.open[openKey] == nil {
+				s.open[openKey] = map[string]bool{}
+			}
+			s.open[openKey][key] = true
+		}
+	}
+}
+
+// enqueue adds an action to the retry queue, dropping the oldest one when the
+// queue is full
+func (s *IncidentSink) enqueue(a *incidentAction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxQueue > 0 && len(s.queue) >= s.maxQueue {
+		glog.Warningf("Incident queue is full, dropping action for %s", s.queue[0].key)
+		s.queue = s.queue[1:]
+	}
+	s.queue = append(s.queue, a)
+}
+
+// flush delivers the queued actions in order, stopping at the first one that
+// has to be retried later
+func (s *IncidentSink) flush(now time.Time) {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 || s.queue[0].next.After(now) {
+			s.mu.Unlock()
+			return
+		}
+		a := s.queue[0]
+		s.mu.Unlock()
+
+		retry, err := s.send(a)
+		if err != nil {
+			s.stats.sendFailed(err)
+		} else {
+			s.stats.sendSucceeded()
+		}
+		if retry {
+			a.attempts++
+			backoff := time.Second << uint(a.attempts)
+			if backoff > incidentMaxBackoff || backoff <= 0 {
+				backoff = incidentMaxBackoff
+			}
+			a.next = now.Add(backoff)
+			glog.Warningf("Failed to deliver incident action for %s, retrying in %v: %v", a.key, backoff, err)
+			return
+		}
+		if err != nil {
+			glog.Errorf("Dropping incident action for %s: %v", a.key, err)
+		}
+
+		s.mu.Lock()
+		if len(s.queue) > 0 && s.queue[0] == a {
+			s.queue = s.queue[1:]
+		}
+		s.mu.Unlock()
+	}
+}
+
+// send delivers an action and says whether it should be retried
+func (s *IncidentSink) send(a *incidentAction) (bool, error) {
+	req, err := s.provider.request(a)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, body)
+	default:
+		return false, fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, body)
+	}
+}
+
+// incidentSummary is the one line description of an incident
+func incidentSummary(a *incidentAction) string {
+	e := a.event.Event
+	return fmt.Sprintf("%s %s/%s: %s - %s", e.InvolvedObject.Kind, e.InvolvedObject.Namespace,
+		e.InvolvedObject.Name, e.Reason, e.Message)
+}
+
+// pagerDuty sends actions to the PagerDuty Events API v2
+type pagerDuty struct {
+	url        string
+	routingKey string
+}
+
+func (p *pagerDuty) request(a *incidentAction) (*http.Request, error) {
+	msg := map[string]interface{}{
+		"routing_key":  p.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    a.key,
+	}
+	if a.resolve {
+		msg["event_action"] = "resolve"
+	} else {
+		e := a.event.Event
+		msg["payload"] = map[string]interface{}{
+			"summary":        incidentSummary(a),
+			"source":         e.InvolvedObject.Namespace + "/" + e.InvolvedObject.Name,
+			"severity":       a.rule.Severity,
+			"component":      e.Source.Component,
+			"group":          e.InvolvedObject.Kind,
+			"class":          e.Reason,
+			"custom_details": a.event,
+		}
+	}
+	return newJSONRequest(p.url, msg)
+}
+
+// opsgenie sends actions to the Opsgenie Alert API, using the dedup key as
+// the alert alias
+type opsgenie struct {
+	url    string
+	apiKey string
+}
+
+// opsgeniePriorities maps severities to Opsgenie priorities
+var opsgeniePriorities = map[string]string{
+	"critical": "P1",
+	"error":    "P2",
+	"warning":  "P3",
+	"info":     "P5",
+}
+
+func (o *opsgenie) request(a *incidentAction) (*http.Request, error) {
+	var req *http.Request
+	var err error
+	if a.resolve {
+		u := fmt.Sprintf("%s/%s/close?identifierType=alias", o.url, url.PathEscape(a.key))
+		req, err = newJSONRequest(u, map[string]interface{}{
+			"source": "eventrouter",
+			"note":   incidentSummary(a),
+		})
+	} else {
+		message := incidentSummary(a)
+		// Opsgenie truncates messages longer than 130 characters
+		if utf8.RuneCountInString(message) > 130 {
+			message = string([]rune(message)[:130])
+		}
+		details, _ := json.Marshal(a.event)
+		req, err = newJSONRequest(o.url, map[string]interface{}{
+			"message":     message,
+			"alias":       a.key,
+			"description": string(details),
+			"priority":    opsgeniePriorities[a.rule.Severity],
+			"source":      "eventrouter",
+			"tags":        []string{a.rule.Name, a.event.Event.Reason},
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "GenieKey "+o.apiKey)
+	return req, nil
+}
+
+// newJSONRequest builds a POST request with msg serialized as the JSON body
+func newJSONRequest(u string, msg interface{}) (*http.Request, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
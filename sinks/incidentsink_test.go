@@ -0,0 +1,212 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"k8s.io/api/core/v1"
+)
+
+// incidentRequest is a request received by the incident API stand-in
+type incidentRequest struct {
+	path string
+	auth string
+	body map[string]interface{}
+}
+
+// newIncidentServer starts a stand-in for an incident API answering with the
+// given status codes in turn, and 202 once they run out.
+func newIncidentServer(t *testing.T, codes ...int) (*httptest.Server, *[]incidentRequest) {
+	var requests []incidentRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Invalid JSON body: %v", err)
+		}
+		requests = append(requests, incidentRequest{r.URL.RequestURI(), r.Header.Get("Authorization"), body})
+		code := http.StatusAccepted
+		if len(codes) > 0 {
+			code, codes = codes[0], codes[1:]
+		}
+		w.WriteHeader(code)
+	}))
+	return srv, &requests
+}
+
+func nodeEvent(reason string) EventData {
+	return NewEventData(&v1.Event{
+		Type:           v1.EventTypeWarning,
+		Reason:         reason,
+		Message:        "Node node-1 status is now: " + reason,
+		InvolvedObject: v1.ObjectReference{Kind: "Node", Name: "node-1"},
+	}, nil)
+}
+
+func nodeRules() []*IncidentRule {
+	return []*IncidentRule{{
+		Name:       "node",
+		Expression: "Reason == NodeNotReady",
+		Resolve:    "Reason == NodeReady",
+	}}
+}
+
+func TestPagerDutySink(t *testing.T) {
+	// The first trigger fails with a server error and has to be retried.
+	srv, requests := newIncidentServer(t, http.StatusInternalServerError)
+	defer srv.Close()
+
+	s, err := NewPagerDutySink(srv.URL, "routing", nodeRules(), false, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	s.evaluate(nodeEvent("NodeNotReady"))
+	s.evaluate(nodeEvent("NodeNotReady"))
+	s.flush(now)
+	if len(*requests) != 1 || len(s.queue) != 1 {
+		t.Fatalf("Expected one failed trigger still queued, got %d requests and %d queued", len(*requests), len(s.queue))
+	}
+
+	// The resolve waits behind the trigger until the backoff expires.
+	s.evaluate(nodeEvent("NodeReady"))
+	s.flush(now)
+	if len(*requests) != 1 {
+		t.Fatalf("Expected no request before the backoff expires")
+	}
+	s.flush(now.Add(time.Minute))
+	if len(*requests) != 3 || len(s.queue) != 0 {
+		t.Fatalf("Expected the trigger and resolve to be delivered, got %d requests and %d queued", len(*requests), len(s.queue))
+	}
+
+	trigger, resolve := (*requests)[1].body, (*requests)[2].body
+	if trigger["event_action"] != "trigger" || trigger["routing_key"] != "routing" || trigger["dedup_key"] != "node/Node//node-1/NodeNotReady" {
+		t.Errorf("Unexpected trigger %v", trigger)
+	}
+	if payload := trigger["payload"].(map[string]interface{}); payload["severity"] != "critical" {
+		t.Errorf("Expected a critical severity, got %v", payload["severity"])
+	}
+	if resolve["event_action"] != "resolve" || resolve["dedup_key"] != trigger["dedup_key"] {
+		t.Errorf("Unexpected resolve %v", resolve)
+	}
+
+	// A recovery event without an open incident sends nothing.
+	s.evaluate(nodeEvent("NodeReady"))
+	s.flush(now)
+	if len(*requests) != 3 {
+		t.Errorf("Expected no resolve without an open incident")
+	}
+}
+
+func TestOpsgenieSink(t *testing.T) {
+	// A client error is not retried.
+	srv, requests := newIncidentServer(t, http.StatusBadRequest)
+	defer srv.Close()
+
+	s, err := NewOpsgenieSink(srv.URL, "key", nodeRules(), false, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.evaluate(nodeEvent("NodeNotReady"))
+	s.flush(time.Now())
+	if len(*requests) != 1 || len(s.queue) != 0 {
+		t.Fatalf("Expected the rejected trigger to be dropped")
+	}
+	if s.Status().LastError == "" {
+		t.Errorf("Expected the failure in the sink status")
+	}
+
+	s.evaluate(nodeEvent("NodeReady"))
+	s.evaluate(nodeEvent("NodeNotReady"))
+	s.evaluate(nodeEvent("NodeReady"))
+	s.flush(time.Now())
+	if len(*requests) != 4 {
+		t.Fatalf("Expected 4 requests, got %d", len(*requests))
+	}
+	create, closeReq := (*requests)[2], (*requests)[3]
+	if create.path != "/" || create.auth != "GenieKey key" || create.body["alias"] != "node/Node//node-1/NodeNotReady" || create.body["priority"] != "P1" {
+		t.Errorf("Unexpected create request %+v", create)
+	}
+	if closeReq.path != "/node%2FNode%2F%2Fnode-1%2FNodeNotReady/close?identifierType=alias" {
+		t.Errorf("Unexpected close path %q", closeReq.path)
+	}
+}
+
+func TestIncidentSinkRulesKeepOwnIncidents(t *testing.T) {
+	srv, requests := newIncidentServer(t)
+	defer srv.Close()
+
+	rules := append(nodeRules(), &IncidentRule{
+		Name:       "reboot",
+		Expression: "Reason == NodeNotReady",
+		Resolve:    "Reason == Rebooted",
+	})
+	s, err := NewPagerDutySink(srv.URL, "routing", rules, false, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.evaluate(nodeEvent("NodeNotReady"))
+	s.evaluate(nodeEvent("NodeReady"))
+	s.flush(time.Now())
+	if len(*requests) != 3 {
+		t.Fatalf("Expected 2 triggers and 1 resolve, got %d requests", len(*requests))
+	}
+	var keys []interface{}
+	for _, r := range *requests {
+		keys = append(keys, r.body["event_action"], r.body["dedup_key"])
+	}
+	want := []interface{}{
+		"trigger", "node/Node//node-1/NodeNotReady",
+		"trigger", "reboot/Node//node-1/NodeNotReady",
+		"resolve", "node/Node//node-1/NodeNotReady",
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Expected actions %v, got %v", want, keys)
+	}
+}
+
+func TestOpsgenieMessageTruncation(t *testing.T) {
+	srv, requests := newIncidentServer(t)
+	defer srv.Close()
+
+	s, err := NewOpsgenieSink(srv.URL, "key", nodeRules(), false, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := nodeEvent("NodeNotReady")
+	e.Event.Message = strings.Repeat("é", 200)
+	s.evaluate(e)
+	s.flush(time.Now())
+	if len(*requests) != 1 {
+		t.Fatalf("Expected one request, got %d", len(*requests))
+	}
+	message := (*requests)[0].body["message"].(string)
+	if !utf8.ValidString(message) || utf8.RuneCountInString(message) != 130 {
+		t.Errorf("Expected a valid message of 130 characters, got %q", message)
+	}
+}
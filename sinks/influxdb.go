@@ -17,13 +17,18 @@ limitations under the License.
 package sinks
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/eapache/channels"
 	"github.com/golang/glog"
 	influxdb "github.com/influxdata/influxdb/client"
 
@@ -54,6 +59,8 @@ var (
 
 const (
 	eventMeasurementName = "k8s_events"
+	// Measurement of the counter points
+	eventCountMeasurementName = "k8s_event_count"
 	// Event special tags
 	eventUID = "uid"
 	// Value Field name
@@ -70,11 +77,25 @@ type LabelDescriptor struct {
 	Description string `json:"description,omitempty"`
 }
 
+// retentionDurationRE matches InfluxQL durations, such as 0, 30d, 1d12h or INF
+var retentionDurationRE = regexp.MustCompile(`^(?i:inf|0|([0-9]+(ns|u|µ|ms|s|m|h|d|w))+)$`)
+
+// InfluxDBSink writes events to InfluxDB in batches. Events are buffered and
+// written once BatchSize of them are pending or FlushInterval has passed, by
+// up to Concurrency writers at once.
 type InfluxDBSink struct {
 	config InfluxdbConfig
-	client *influxdb.Client
+
+	// client is the InfluxDB 1.x client, and httpClient the client of the
+	// 2.x write API
+	client     *influxdb.Client
+	httpClient *http.Client
+
+	// The lock protects client and dbExists
 	sync.RWMutex
 	dbExists bool
+	eventCh  channels.Channel
+	stats    sinkStats
 }
 
 type InfluxdbConfig struct {
@@ -85,24 +106,65 @@ type InfluxdbConfig struct {
 	DbName                string
 	WithFields            bool
 	InsecureSsl           bool
-	RetentionPolicy       string
 	ClusterName           string
 	DisableCounterMetrics bool
 	Concurrency           int
+
+	// RetentionPolicy is the policy written to, "default" when empty. The
+	// sink creates the "default" policy with the database, keeping data for
+	// RetentionDuration, an InfluxQL duration such as 30d, or forever when it
+	// is empty or 0. Other policies must already exist.
+	RetentionPolicy   string
+	RetentionDuration string
+
+	// BatchSize and FlushInterval bound how long events wait before being
+	// written. BufferSize events are buffered, and when Overflow is set the
+	// newest are dropped once the buffer is full.
+	BatchSize     int
+	FlushInterval time.Duration
+	BufferSize    int
+	Overflow      bool
+
+	// Version selects the write API, 1 for InfluxDB 1.x or 2 for the
+	// /api/v2/write endpoint of InfluxDB 2.x, which uses Org, Bucket and Token
+	// instead of the database, retention policy and credentials.
+	Version int
+	Org     string
+	Bucket  string
+	Token   string
 }
 
 // Returns a thread-safe implementation of EventSinkInterface for InfluxDB.
-func NewInfuxdbSink(cfg InfluxdbConfig) (EventSinkInterface, error) {
-	client, err := newClient(cfg)
-	if err != nil {
-		return nil, err
+// Events are only written once Run has been started. It connects lazily, so
+// it doesn't fail when the server is down.
+func NewInfuxdbSink(cfg InfluxdbConfig) (*InfluxDBSink, error) {
+	if cfg.RetentionDuration != "" && !retentionDurationRE.MatchString(cfg.RetentionDuration) {
+		return nil, fmt.Errorf("invalid retention duration %q", cfg.RetentionDuration)
+	}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
 	}
 
-	return &InfluxDBSink{
+	sink := &InfluxDBSink{
 		config:   cfg,
-		client:   client,
 		dbExists: false,
-	}, nil
+	}
+	if cfg.Overflow {
+		sink.eventCh = channels.NewOverflowingChannel(channels.BufferCap(cfg.BufferSize))
+	} else {
+		sink.eventCh = channels.NewNativeChannel(channels.BufferCap(cfg.BufferSize))
+	}
+
+	if cfg.Version == 2 {
+		sink.httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return sink, nil
 }
 
 func newClient(c InfluxdbConfig) (*influxdb.Client, error) {
@@ -134,26 +196,109 @@ func newClient(c InfluxdbConfig) (*influxdb.Client, error) {
 	return client, nil
 }
 
+// UpdateEvents implements the EventSinkInterface. It only buffers the event,
+// which is written by Run.
 func (sink *InfluxDBSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
-	sink.Lock()
-	defer sink.Unlock()
+	sink.eventCh.In() <- NewEventData(eNew, eOld)
+}
 
-	var point *influxdb.Point
-	var err error
-	if sink.config.WithFields {
-		point, err = eventToPointWithFields(eNew)
-	} else {
-		point, err = eventToPoint(eNew)
+// Run collects the buffered events into batches and hands them to
+// Concurrency writers, until stopCh is closed. Buffered events are written
+// before it returns.
+func (sink *InfluxDBSink) Run(stopCh <-chan bool) {
+	batches := make(chan []EventData)
+	var wg sync.WaitGroup
+	for i := 0; i < sink.config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				sink.SendEvents(batch)
+			}
+		}()
 	}
-	if err != nil {
-		glog.Warningf("Failed to convert event to point: %v", err)
+
+	ticker := time.NewTicker(sink.config.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []EventData
+	flush := func() {
+		if len(batch) > 0 {
+			batches <- batch
+			batch = nil
+		}
 	}
 
-	point.Tags["cluster_name"] = sink.config.ClusterName
+loop:
+	for {
+		select {
+		case e := <-sink.eventCh.Out():
+			evt, ok := e.(EventData)
+			if !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+			batch = append(batch, evt)
+			if len(batch) >= sink.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-stopCh:
+			break loop
+		}
+	}
 
-	dataPoints := make([]influxdb.Point, 0, 10)
-	dataPoints = append(dataPoints, *point)
-	sink.sendData(dataPoints)
+	// Write what is still buffered
+	numEvents := sink.eventCh.Len()
+	for i := 0; i < numEvents; i++ {
+		if evt, ok := (<-sink.eventCh.Out()).(EventData); ok {
+			batch = append(batch, evt)
+		}
+		if len(batch) >= sink.config.BatchSize {
+			flush()
+		}
+	}
+	flush()
+	close(batches)
+	wg.Wait()
+}
+
+// SendEvents implements the BatchSender interface by writing the events, and
+// their counter points unless DisableCounterMetrics is set, in one request.
+// Events that cannot be converted are skipped.
+func (sink *InfluxDBSink) SendEvents(events []EventData) error {
+	dataPoints := make([]influxdb.Point, 0, 2*len(events))
+	for _, e := range events {
+		var point *influxdb.Point
+		var err error
+		if sink.config.WithFields {
+			point, err = eventToPointWithFields(e.Event)
+		} else {
+			point, err = eventToPoint(e.Event)
+		}
+		if err != nil {
+			glog.Warningf("Failed to convert event to point: %v", err)
+			continue
+		}
+		point.Tags["cluster_name"] = sink.config.ClusterName
+		dataPoints = append(dataPoints, *point)
+
+		if !sink.config.DisableCounterMetrics {
+			counter := eventToCounterPoint(e.Event)
+			counter.Tags["cluster_name"] = sink.config.ClusterName
+			dataPoints = append(dataPoints, *counter)
+		}
+	}
+	if len(dataPoints) == 0 {
+		return nil
+	}
+	return sink.sendData(dataPoints)
+}
+
+// Status implements the StatusReporter interface
+func (sink *InfluxDBSink) Status() SinkStatus {
+	return sink.stats.status(sink.eventCh.Len())
 }
 
 // Generate point value for event
@@ -189,6 +334,26 @@ func eventToPointWithFields(event *v1.Event) (*influxdb.Point, error) {
 	return &point, nil
 }
 
+// eventToCounterPoint generates a point with the count of the event, which
+// lets dashboards sum up events without parsing them
+func eventToCounterPoint(event *v1.Event) *influxdb.Point {
+	return &influxdb.Point{
+		Measurement: eventCountMeasurementName,
+		Time:        event.LastTimestamp.Time.UTC(),
+		Fields: map[string]interface{}{
+			valueField: int64(event.Count),
+		},
+		Tags: map[string]string{
+			eventUID:               string(event.UID),
+			"type":                 event.Type,
+			"kind":                 event.InvolvedObject.Kind,
+			"reason":               event.Reason,
+			"object_name":          event.InvolvedObject.Name,
+			LabelNamespaceName.Key: event.InvolvedObject.Namespace,
+		},
+	}
+}
+
 func eventToPoint(event *v1.Event) (*influxdb.Point, error) {
 	value, err := getEventValue(event)
 	if err != nil {
@@ -213,38 +378,173 @@ func eventToPoint(event *v1.Event) (*influxdb.Point, error) {
 	return &point, nil
 }
 
-func (sink *InfluxDBSink) sendData(dataPoints []influxdb.Point) {
-	if err := sink.createDatabase(); err != nil {
+// retentionPolicy returns the retention policy written to
+func (sink *InfluxDBSink) retentionPolicy() string {
+	if rp := sink.config.RetentionPolicy; rp != "" {
+		return rp
+	}
+	return "default"
+}
+
+func (sink *InfluxDBSink) sendData(dataPoints []influxdb.Point) error {
+	start := time.Now()
+	var err error
+	if sink.config.Version == 2 {
+		err = sink.writeV2(dataPoints)
+	} else {
+		err = sink.writeV1(dataPoints)
+	}
+	if err != nil {
+		sink.stats.sendFailed(err)
+		return err
+	}
+	sink.stats.sendSucceeded()
+	end := time.Now()
+	glog.V(4).Infof("Exported %d data to influxDB in %s", len(dataPoints), end.Sub(start))
+	return nil
+}
+
+func (sink *InfluxDBSink) writeV1(dataPoints []influxdb.Point) error {
+	sink.Lock()
+	err := sink.createDatabase()
+	client := sink.client
+	sink.Unlock()
+	if err != nil {
 		glog.Errorf("Failed to create influxdb: %v", err)
-		return
+		return err
 	}
+
 	bp := influxdb.BatchPoints{
 		Points:          dataPoints,
 		Database:        sink.config.DbName,
-		RetentionPolicy: "default",
+		RetentionPolicy: sink.retentionPolicy(),
 	}
 
-	start := time.Now()
-	if _, err := sink.client.Write(bp); err != nil {
+	if _, err := client.Write(bp); err != nil {
 		glog.Errorf("InfluxDB write failed: %v", err)
+		sink.Lock()
+		defer sink.Unlock()
+		if sink.client != client {
+			// Another writer already reset the connection
+			return err
+		}
 		if strings.Contains(err.Error(), dbNotFoundError) {
 			sink.resetConnection()
-		} else if _, _, err := sink.client.Ping(); err != nil {
+		} else if _, _, err := client.Ping(); err != nil {
 			glog.Errorf("InfluxDB ping failed: %v", err)
 			sink.resetConnection()
 		}
+		return err
 	}
-	end := time.Now()
-	glog.V(4).Infof("Exported %d data to influxDB in %s", len(dataPoints), end.Sub(start))
+	return nil
 }
 
+// v2URL returns the URL of an InfluxDB 2.x endpoint
+func (sink *InfluxDBSink) v2URL(path string) *url.URL {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   sink.config.Host,
+		Path:   path,
+	}
+	if sink.config.Secure {
+		u.Scheme = "https"
+	}
+	return u
+}
+
+// writeV2 writes the points in line protocol to the /api/v2/write endpoint
+func (sink *InfluxDBSink) writeV2(dataPoints []influxdb.Point) error {
+	var body bytes.Buffer
+	for _, p := range dataPoints {
+		body.WriteString(p.MarshalString())
+		body.WriteByte('\n')
+	}
+
+	u := sink.v2URL("/api/v2/write")
+	params := url.Values{}
+	params.Set("org", sink.config.Org)
+	params.Set("bucket", sink.config.Bucket)
+	params.Set("precision", "ns")
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Authorization", "Token "+sink.config.Token)
+
+	resp, err := sink.httpClient.Do(req)
+	if err != nil {
+		glog.Errorf("InfluxDB write failed: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		err := fmt.Errorf("InfluxDB write returned %s: %s", resp.Status, msg)
+		glog.Error(err)
+		return err
+	}
+	return nil
+}
+
+// resetConnection drops the client so that it is recreated from the config on
+// the next write.
 func (sink *InfluxDBSink) resetConnection() {
 	glog.Infof("Influxdb connection reset")
 	sink.dbExists = false
 	sink.client = nil
-	sink.config = InfluxdbConfig{}
 }
 
+// HealthCheck implements the HealthChecker interface by pinging the InfluxDB
+// server, reconnecting first if the connection was reset. InfluxDB 2.x is
+// checked through its /health endpoint.
+func (sink *InfluxDBSink) HealthCheck() error {
+	if sink.config.Version == 2 {
+		client := &http.Client{Timeout: healthCheckTimeout}
+		resp, err := client.Get(sink.v2URL("/health").String())
+		if err != nil {
+			return fmt.Errorf("failed to reach influxDB server at %q - %v", sink.config.Host, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("influxDB server at %q is unhealthy: %s", sink.config.Host, resp.Status)
+		}
+		return nil
+	}
+
+	sink.Lock()
+	defer sink.Unlock()
+
+	if sink.client == nil {
+		client, err := newClient(sink.config)
+		if err != nil {
+			return err
+		}
+		sink.client = client
+		return nil
+	}
+
+	if _, _, err := sink.client.Ping(); err != nil {
+		return fmt.Errorf("failed to ping influxDB server at %q - %v", sink.config.Host, err)
+	}
+	return nil
+}
+
+// query runs an InfluxQL statement, returning errors reported by the server
+// as well as transport errors
+func (sink *InfluxDBSink) query(command string) error {
+	resp, err := sink.client.Query(influxdb.Query{Command: command})
+	if err == nil && resp != nil {
+		err = resp.Error()
+	}
+	return err
+}
+
+// createDatabase creates the database, with a "default" retention policy of
+// the configured duration unless another policy is written to. It is called
+// with the lock held.
 func (sink *InfluxDBSink) createDatabase() error {
 	if sink.client == nil {
 		client, err := newClient(sink.config)
@@ -258,17 +558,17 @@ func (sink *InfluxDBSink) createDatabase() error {
 		return nil
 	}
 
-	q := influxdb.Query{
-		Command: fmt.Sprintf(`CREATE DATABASE %s WITH NAME "default"`, sink.config.DbName),
-	}
-
-	if resp, err := sink.client.Query(q); err != nil {
-		// We want to return error only if it is not "already exists" error.
-		if !(resp != nil && resp.Err != nil && strings.Contains(resp.Err.Error(), "existing policy")) {
-			err := sink.createRetentionPolicy()
-			if err != nil {
-				return err
-			}
+	if sink.retentionPolicy() != "default" {
+		if err := sink.query(fmt.Sprintf(`CREATE DATABASE %q`, sink.config.DbName)); err != nil {
+			return fmt.Errorf("Database creation failed: %v", err)
+		}
+	} else if err := sink.query(fmt.Sprintf(`CREATE DATABASE %q WITH DURATION %s NAME "default"`, sink.config.DbName, sink.retentionDuration())); err != nil {
+		// The database exists with other policies
+		if !strings.Contains(err.Error(), "existing policy") {
+			return fmt.Errorf("Database creation failed: %v", err)
+		}
+		if err := sink.createRetentionPolicy(); err != nil {
+			return err
 		}
 	}
 
@@ -277,17 +577,25 @@ func (sink *InfluxDBSink) createDatabase() error {
 	return nil
 }
 
-func (sink *InfluxDBSink) createRetentionPolicy() error {
-	q := influxdb.Query{
-		Command: fmt.Sprintf(`CREATE RETENTION POLICY "default" ON %s DURATION 0d REPLICATION 1 DEFAULT`, sink.config.DbName),
+// retentionDuration returns the duration of the "default" retention policy,
+// where 0 keeps the data forever
+func (sink *InfluxDBSink) retentionDuration() string {
+	d := sink.config.RetentionDuration
+	if d == "" || d == "0" {
+		return "INF"
 	}
+	return d
+}
 
-	if resp, err := sink.client.Query(q); err != nil {
-		if !(resp != nil && resp.Err != nil && strings.Contains(resp.Err.Error(), "already exists")) {
-			return fmt.Errorf("Retention policy creation failed: %v", err)
-		}
+func (sink *InfluxDBSink) createRetentionPolicy() error {
+	err := sink.query(fmt.Sprintf(`CREATE RETENTION POLICY "default" ON %q DURATION %s REPLICATION 1 DEFAULT`, sink.config.DbName, sink.retentionDuration()))
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		err = sink.query(fmt.Sprintf(`ALTER RETENTION POLICY "default" ON %q DURATION %s DEFAULT`, sink.config.DbName, sink.retentionDuration()))
+	}
+	if err != nil {
+		return fmt.Errorf("Retention policy creation failed: %v", err)
 	}
 
-	glog.Infof("Created database %q on influxDB server at %q", sink.config.DbName, sink.config.Host)
+	glog.Infof("Created retention policy \"default\" on database %q", sink.config.DbName)
 	return nil
 }
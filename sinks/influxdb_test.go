@@ -0,0 +1,240 @@
+/*
+Copyright 2017 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeInflux records the queries and writes made to an InfluxDB stand-in
+type fakeInflux struct {
+	mu      sync.Mutex
+	queries []string
+	writes  []url.Values
+	lines   []string
+	headers []http.Header
+}
+
+func (f *fakeInflux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/ping":
+		w.WriteHeader(http.StatusNoContent)
+	case "/health":
+		w.Write([]byte(`{"status":"pass"}`))
+	case "/query":
+		r.ParseForm()
+		f.queries = append(f.queries, r.Form.Get("q"))
+		w.Write([]byte(`{"results":[{}]}`))
+	case "/write", "/api/v2/write":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.writes = append(f.writes, r.URL.Query())
+		f.headers = append(f.headers, r.Header)
+		f.lines = append(f.lines, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeInflux(t *testing.T) (*fakeInflux, *httptest.Server) {
+	f := &fakeInflux{}
+	return f, httptest.NewServer(f)
+}
+
+func TestInfluxDBSinkBatches(t *testing.T) {
+	f, srv := newFakeInflux(t)
+	defer srv.Close()
+
+	sink, err := NewInfuxdbSink(InfluxdbConfig{
+		User:                  "user",
+		Password:              "pwd",
+		Host:                  strings.TrimPrefix(srv.URL, "http://"),
+		DbName:                "k8s",
+		WithFields:            true,
+		RetentionDuration:     "30d",
+		ClusterName:           "prod",
+		Concurrency:           2,
+		DisableCounterMetrics: true,
+		BatchSize:             3,
+		FlushInterval:         time.Hour,
+		BufferSize:            10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		sink.Run(stopCh)
+		close(done)
+	}()
+
+	e := formatTestEvent()
+	for i := 0; i < 4; i++ {
+		sink.UpdateEvents(e.Event, nil)
+	}
+	// The last batch is only written when the sink stops
+	close(stopCh)
+	<-done
+
+	if len(f.queries) != 1 || f.queries[0] != `CREATE DATABASE "k8s" WITH DURATION 30d NAME "default"` {
+		t.Errorf("Unexpected queries %q", f.queries)
+	}
+	if len(f.writes) != 2 {
+		t.Fatalf("Expected 2 batches, got %d", len(f.writes))
+	}
+	for _, w := range f.writes {
+		if w.Get("db") != "k8s" || w.Get("rp") != "default" {
+			t.Errorf("Expected writes to k8s.default, got %v", w)
+		}
+	}
+	if len(f.lines) != 4 {
+		t.Fatalf("Expected 4 points without counters, got %d", len(f.lines))
+	}
+	if !strings.HasPrefix(f.lines[0], "events,cluster_name=prod,component=kubelet") {
+		t.Errorf("Unexpected point %s", f.lines[0])
+	}
+}
+
+func TestInfluxDBSinkRetentionPolicyName(t *testing.T) {
+	f, srv := newFakeInflux(t)
+	defer srv.Close()
+
+	sink, err := NewInfuxdbSink(InfluxdbConfig{
+		Host:                  strings.TrimPrefix(srv.URL, "http://"),
+		DbName:                "k8s",
+		RetentionPolicy:       "one_week",
+		DisableCounterMetrics: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.SendEvents([]EventData{formatTestEvent()}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.queries) != 1 || f.queries[0] != `CREATE DATABASE "k8s"` {
+		t.Errorf("Unexpected queries %q", f.queries)
+	}
+	if rp := f.writes[0].Get("rp"); rp != "one_week" {
+		t.Errorf("Expected writes to the one_week policy, got %q", rp)
+	}
+}
+
+func TestInfluxDBSinkLazyConnect(t *testing.T) {
+	f, srv := newFakeInflux(t)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	srv.Close()
+
+	// The sink starts while the server is down, and connects once it is up
+	sink, err := NewInfuxdbSink(InfluxdbConfig{Host: host, DbName: "k8s", WithFields: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.SendEvents([]EventData{formatTestEvent()}); err == nil {
+		t.Errorf("Expected an error while the server is down")
+	}
+	l, err := net.Listen("tcp", host)
+	if err != nil {
+		t.Skipf("Can't listen on %s again: %v", host, err)
+	}
+	srv = &httptest.Server{Listener: l, Config: &http.Server{Handler: f}}
+	srv.Start()
+	defer srv.Close()
+	if err := sink.SendEvents([]EventData{formatTestEvent()}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.queries) != 1 || f.queries[0] != `CREATE DATABASE "k8s" WITH DURATION INF NAME "default"` {
+		t.Errorf("Unexpected queries %q", f.queries)
+	}
+	if len(f.lines) != 2 || !strings.HasPrefix(f.lines[1], "k8s_event_count,") {
+		t.Errorf("Expected an event and a counter point, got %q", f.lines)
+	}
+
+	if _, err := NewInfuxdbSink(InfluxdbConfig{Host: host, RetentionDuration: "30d; DROP DATABASE k8s"}); err == nil {
+		t.Errorf("Expected an error for an invalid retention duration")
+	}
+}
+
+func TestInfluxDBSinkV2(t *testing.T) {
+	f, srv := newFakeInflux(t)
+	defer srv.Close()
+
+	sink, err := NewInfuxdbSink(InfluxdbConfig{
+		Host:                  strings.TrimPrefix(srv.URL, "http://"),
+		WithFields:            true,
+		ClusterName:           "prod",
+		Version:               2,
+		DisableCounterMetrics: true,
+		Org:                   "acme",
+		Bucket:                "events",
+		Token:                 "s3cr3t",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.HealthCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.SendEvents([]EventData{formatTestEvent()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.queries) != 0 {
+		t.Errorf("Expected no InfluxQL queries, got %q", f.queries)
+	}
+	w := f.writes[0]
+	if w.Get("org") != "acme" || w.Get("bucket") != "events" || w.Get("precision") != "ns" {
+		t.Errorf("Unexpected write parameters %v", w)
+	}
+	if auth := f.headers[0].Get("Authorization"); auth != "Token s3cr3t" {
+		t.Errorf("Expected token auth, got %q", auth)
+	}
+	if len(f.lines) != 1 || !strings.HasPrefix(f.lines[0], "events,cluster_name=prod,component=kubelet") ||
+		!strings.Contains(f.lines[0], `message="Back-off restarting failed container \"app\""`) {
+		t.Errorf("Unexpected line protocol %q", f.lines)
+	}
+}
+
+func TestInfluxDBSinkCounterPoints(t *testing.T) {
+	f, srv := newFakeInflux(t)
+	defer srv.Close()
+
+	sink, err := NewInfuxdbSink(InfluxdbConfig{
+		Host:       strings.TrimPrefix(srv.URL, "http://"),
+		WithFields: true,
+		Version:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.SendEvents([]EventData{formatTestEvent()}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.lines) != 2 || !strings.HasPrefix(f.lines[1], "k8s_event_count,") || !strings.Contains(f.lines[1], " value=3i ") {
+		t.Errorf("Expected a counter point, got %q", f.lines)
+	}
+}
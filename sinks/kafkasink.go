@@ -17,7 +17,6 @@ limitations under the License.
 package sinks
 
 import (
-	"encoding/json"
 	"github.com/Shopify/sarama"
 	"github.com/golang/glog"
 	"k8s.io/api/core/v1"
@@ -25,27 +24,45 @@ import (
 
 // KafkaSink implements the EventSinkInterface
 type KafkaSink struct {
-	Topic    string
+	Topic string
+
+	// Formatter serializes the message values, it defaults to the json
+	// format
+	Formatter Formatter
+
+	client   sarama.Client
 	producer interface{}
+	stats    sinkStats
 }
 
-// NewKafkaSinkSink will create a new KafkaSink with default options, returned as an EventSinkInterface
-func NewKafkaSink(brokers []string, topic string, async bool, retryMax int, saslUser string, saslPwd string) (EventSinkInterface, error) {
+// NewKafkaSinkSink will create a new KafkaSink with default options, returned as an EventSinkInterface.
+// version is the Kafka protocol version to use, such as 0.11.0.0, which must be
+// at least 0.11 for message headers. The sarama default is used when it is empty.
+func NewKafkaSink(brokers []string, topic string, async bool, retryMax int, saslUser string, saslPwd string, version string) (EventSinkInterface, error) {
 
-	p, err := sinkFactory(brokers, async, retryMax, saslUser, saslPwd)
+	client, p, err := sinkFactory(brokers, async, retryMax, saslUser, saslPwd, version)
 
 	if err != nil {
 		return nil, err
 	}
 
 	return &KafkaSink{
-		Topic:    topic,
-		producer: p,
+		Topic:     topic,
+		Formatter: FormatterFunc(formatJSON),
+		client:    client,
+		producer:  p,
 	}, err
 }
 
-func sinkFactory(brokers []string, async bool, retryMax int, saslUser string, saslPwd string) (interface{}, error) {
+func sinkFactory(brokers []string, async bool, retryMax int, saslUser string, saslPwd string, version string) (sarama.Client, interface{}, error) {
 	config := sarama.NewConfig()
+	if version != "" {
+		v, err := sarama.ParseKafkaVersion(version)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.Version = v
+	}
 	config.Producer.Retry.Max = retryMax
 	config.Producer.RequiredAcks = sarama.WaitForAll
 
@@ -55,13 +72,37 @@ func sinkFactory(brokers []string, async bool, retryMax int, saslUser string, sa
 		config.Net.SASL.Password = saslPwd
 	}
 
+	if !async {
+		config.Producer.Return.Successes = true
+	}
+
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var p interface{}
 	if async {
-		return sarama.NewAsyncProducer(brokers, config)
+		p, err = sarama.NewAsyncProducerFromClient(client)
+	} else {
+		p, err = sarama.NewSyncProducerFromClient(client)
 	}
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, p, nil
+}
 
-	config.Producer.Return.Successes = true
-	return sarama.NewSyncProducer(brokers, config)
+// HealthCheck implements the HealthChecker interface by refreshing the
+// metadata of the topic from the brokers.
+func (ks *KafkaSink) HealthCheck() error {
+	return ks.client.RefreshMetadata(ks.Topic)
+}
 
+// Status implements the StatusReporter interface
+func (ks *KafkaSink) Status() SinkStatus {
+	return ks.stats.status(0)
 }
 
 // UpdateEvents implements EventSinkInterface.UpdateEvents
@@ -69,16 +110,11 @@ func (ks *KafkaSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 
 	eData := NewEventData(eNew, eOld)
 
-	eJSONBytes, err := json.Marshal(eData)
+	msg, err := ks.newMessage(eData)
 	if err != nil {
 		glog.Errorf("Failed to json serialize event: %v", err)
 		return
 	}
-	msg := &sarama.ProducerMessage{
-		Topic: ks.Topic,
-		Key:   sarama.StringEncoder(eNew.InvolvedObject.Name),
-		Value: sarama.ByteEncoder(eJSONBytes),
-	}
 
 	switch p := ks.producer.(type) {
 	case sarama.SyncProducer:
@@ -86,13 +122,18 @@ func (ks *KafkaSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 		if err != nil {
 			glog.Errorf("Failed to send to: topic(%s)/partition(%d)/offset(%d)\n",
 				ks.Topic, partition, offset)
+			ks.stats.sendFailed(err)
+		} else {
+			ks.stats.sendSucceeded()
 		}
 
 	case sarama.AsyncProducer:
 		select {
 		case p.Input() <- msg:
+			ks.stats.sendSucceeded()
 		case err := <-p.Errors():
 			glog.Errorf("Failed to produce message: %v", err)
+			ks.stats.sendFailed(err)
 		}
 
 	default:
@@ -100,3 +141,59 @@ func (ks *KafkaSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 	}
 
 }
+
+// SendEvents implements the BatchSender interface. With a synchronous producer
+// it only returns once the brokers acknowledged every message; an asynchronous
+// producer can't confirm delivery, so the events are just queued.
+func (ks *KafkaSink) SendEvents(events []EventData) error {
+	p, ok := ks.producer.(sarama.SyncProducer)
+	if !ok {
+		for _, eData := range events {
+			resend(ks, eData)
+		}
+		return nil
+	}
+
+	msgs := make([]*sarama.ProducerMessage, 0, len(events))
+	for _, eData := range events {
+		msg, err := ks.newMessage(eData)
+		if err != nil {
+			glog.Errorf("Failed to json serialize event: %v", err)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if err := p.SendMessages(msgs); err != nil {
+		glog.Errorf("Failed to send %d messages to topic(%s): %v", len(msgs), ks.Topic, err)
+		ks.stats.sendFailed(err)
+		return err
+	}
+	ks.stats.sendSucceeded()
+	return nil
+}
+
+// newMessage builds the producer message for the given event data
+func (ks *KafkaSink) newMessage(eData EventData) (*sarama.ProducerMessage, error) {
+	value, err := ks.Formatter.Format(eData)
+	if err != nil {
+		return nil, err
+	}
+	msg := &sarama.ProducerMessage{
+		Topic: ks.Topic,
+		Key:   sarama.StringEncoder(eData.Event.InvolvedObject.Name),
+		Value: sarama.ByteEncoder(value),
+	}
+
+	// Attributes map to the headers of the CloudEvents Kafka binding
+	if af, ok := ks.Formatter.(AttributeFormatter); ok {
+		for k, v := range af.Attributes(eData) {
+			key := "ce_" + k
+			if k == "datacontenttype" {
+				key = "content-type"
+			}
+			msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(v)})
+		}
+	}
+	return msg, nil
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"context"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// Limits of a PutRecords request
+	kinesisMaxRecords     = 500
+	kinesisMaxBytes       = 5 * 1024 * 1024
+	kinesisMaxRecordBytes = 1024 * 1024
+
+	// kinesisMaxKeyLength is the maximum length of a partition key, in
+	// unicode characters
+	kinesisMaxKeyLength = 256
+)
+
+// KinesisSink puts events in a Kinesis data stream
+type KinesisSink struct {
+	// PartitionKey gives the partition key of an event. Events with the same
+	// key go to the same shard, in order.
+	PartitionKey Formatter
+
+	// MaxRetries bounds how many times the records that failed in a batch are
+	// retried
+	MaxRetries int
+
+	client       *kinesis.Kinesis
+	stream       string
+	formatter    Formatter
+	retryBackoff time.Duration
+	eventCh      channels.Channel
+	stats        sinkStats
+}
+
+// NewKinesisSink constructs a new KinesisSink putting events in the given
+// stream. A non-empty endpoint overrides that of Kinesis, to use a local
+// stand-in such as LocalStack.
+func NewKinesisSink(accessKeyID, secretAccessKey, region, endpoint, stream string, overflow bool, bufferSize int, formatter Formatter) (*KinesisSink, error) {
+	sess, err := newAWSSession(accessKeyID, secretAccessKey, region, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &KinesisSink{
+		client:       kinesis.New(sess),
+		stream:       stream,
+		formatter:    formatter,
+		retryBackoff: 100 * time.Millisecond,
+	}
+	if overflow {
+		k.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		k.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+	return k, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event OverflowingChannel, which should never block.
+// Messages that are buffered beyond the bufferSize specified for this
+// KinesisSink are discarded.
+func (k *KinesisSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	k.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Status implements the StatusReporter interface
+func (k *KinesisSink) Status() SinkStatus {
+	return k.stats.status(k.eventCh.Len())
+}
+
+// HealthCheck implements the HealthChecker interface by checking that the
+// stream exists and is accessible with the configured credentials.
+func (k *KinesisSink) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	_, err := k.client.DescribeStreamSummaryWithContext(ctx, &kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(k.stream),
+	})
+	return err
+}
+
+// Run sits in a loop, waiting for data to come in through k.eventCh, and
+// forwarding them to Kinesis. If multiple events have happened between loop
+// iterations, it puts all of them in as few requests as possible.
+func (k *KinesisSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-k.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := k.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-k.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			k.SendEvents(arr)
+		case <-stopCh:
+			break loop
+		}
+	}
+}
+
+// SendEvents implements the BatchSender interface. It puts the events in
+// PutRecords requests within the limits of Kinesis, and retries the records
+// that failed. A batch that still fails doesn't stop the others from being
+// put, and the errors are returned together. Events that can't be serialized
+// are logged and dropped.
+func (k *KinesisSink) SendEvents(events []EventData) error {
+	var records []awsRecord
+	for _, evt := range events {
+		r, err := k.newRecord(evt)
+		if err != nil {
+			glog.Warningf("Failed to serialize event: %v", err)
+			continue
+		}
+		records = append(records, r)
+	}
+
+	// A batch that fails doesn't keep the next batches from being put
+	var errs []error
+	for _, batch := range awsBatches(records, kinesisMaxRecords, kinesisMaxBytes, kinesisMaxRecordBytes) {
+		if err := putAWSRecords(batch, k.putRecords, k.MaxRetries, k.retryBackoff); err != nil {
+			glog.Errorf("Failed to put %d records in Kinesis stream %s: %v", len(batch), k.stream, err)
+			errs = append(errs, err)
+		}
+	}
+	if err := combineErrors(errs); err != nil {
+		k.stats.sendFailed(err)
+		return err
+	}
+	k.stats.sendSucceeded()
+	return nil
+}
+
+// newRecord formats event data as a record. Kinesis requires a partition key,
+// so events without one fall back to their involved object.
+func (k *KinesisSink) newRecord(evt EventData) (awsRecord, error) {
+	data, err := k.formatter.Format(evt)
+	if err != nil {
+		return awsRecord{}, err
+	}
+
+	var key string
+	if k.PartitionKey != nil {
+		b, err := k.PartitionKey.Format(evt)
+		if err != nil {
+			return awsRecord{}, err
+		}
+		key = string(b)
+	}
+	if key == "" {
+		ref := evt.Event.InvolvedObject
+		key = ref.Namespace + "/" + ref.Kind + "/" + ref.Name
+	}
+	if utf8.RuneCountInString(key) > kinesisMaxKeyLength {
+		key = string([]rune(key)[:kinesisMaxKeyLength])
+	}
+	return awsRecord{data: data, key: key}, nil
+}
+
+// putRecords makes a PutRecords request, and returns the records that failed
+func (k *KinesisSink) putRecords(records []awsRecord) ([]awsRecord, string, error) {
+	input := &kinesis.PutRecordsInput{StreamName: aws.String(k.stream)}
+	for _, r := range records {
+		input.Records = append(input.Records, &kinesis.PutRecordsRequestEntry{
+			Data:         r.data,
+			PartitionKey: aws.String(r.key),
+		})
+	}
+
+	out, err := k.client.PutRecords(input)
+	if err != nil {
+		return nil, "", err
+	}
+	if aws.Int64Value(out.FailedRecordCount) == 0 {
+		return nil, "", nil
+	}
+
+	// Results are in the order of the records
+	var failed []awsRecord
+	var code string
+	for i, res := range out.Records {
+		if res.ErrorCode == nil || i >= len(records) {
+			continue
+		}
+		if code == "" {
+			code = aws.StringValue(res.ErrorCode) + ": " + aws.StringValue(res.ErrorMessage)
+		}
+		failed = append(failed, records[i])
+	}
+	return failed, code, nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestKinesisSink(t *testing.T, f *fakeAWSStreams) (*KinesisSink, *httptest.Server) {
+	srv := httptest.NewServer(f)
+	k, err := NewKinesisSink("key", "secret", "us-east-1", srv.URL, "events", false, 10, mustGetFormatter("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.retryBackoff = 0
+	k.MaxRetries = 2
+	return k, srv
+}
+
+func TestKinesisSink(t *testing.T) {
+	f := &fakeAWSStreams{}
+	k, srv := newTestKinesisSink(t, f)
+	defer srv.Close()
+
+	if err := k.HealthCheck(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := newTemplateFormatter("key", "{{.Event.InvolvedObject.Namespace}}/{{.Event.InvolvedObject.Name}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.PartitionKey = key
+	if err := k.SendEvents([]EventData{formatTestEvent()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.requests) != 1 || len(f.requests[0]) != 1 {
+		t.Fatalf("Expected a single record, got %v", f.requests)
+	}
+	r := f.requests[0][0]
+	if r.PartitionKey != "prod/web-1" {
+		t.Errorf("Expected partition key prod/web-1, got %q", r.PartitionKey)
+	}
+	var data EventData
+	if err := json.Unmarshal(r.Data, &data); err != nil || data.Event.Reason != "BackOff" {
+		t.Errorf("Unexpected record data %s", r.Data)
+	}
+
+	// Without a template, the key is the involved object
+	k.PartitionKey = nil
+	if err := k.SendEvents([]EventData{formatTestEvent()}); err != nil {
+		t.Fatal(err)
+	}
+	if key := f.requests[1][0].PartitionKey; key != "prod/Pod/web-1" {
+		t.Errorf("Expected partition key prod/Pod/web-1, got %q", key)
+	}
+}
+
+func TestKinesisSinkRetriesFailedRecords(t *testing.T) {
+	// The 2nd and 3rd records of the first request fail, then the 3rd again
+	f := &fakeAWSStreams{fail: func(n int) bool { return n == 2 || n == 3 || n == 5 }}
+	k, srv := newTestKinesisSink(t, f)
+	defer srv.Close()
+
+	events := []EventData{formatTestEvent(), formatTestEvent(), formatTestEvent()}
+	for i := range events {
+		events[i].Event = events[i].Event.DeepCopy()
+		events[i].Event.InvolvedObject.Name = []string{"a", "b", "c"}[i]
+	}
+	if err := k.SendEvents(events); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.requests) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(f.requests))
+	}
+	for i, want := range [][]string{{"a", "b", "c"}, {"b", "c"}, {"c"}} {
+		var keys []string
+		for _, r := range f.requests[i] {
+			keys = append(keys, r.PartitionKey[len("prod/Pod/"):])
+		}
+		if len(keys) != len(want) {
+			t.Errorf("Expected request %d to put %v, got %v", i, want, keys)
+			continue
+		}
+		for j := range want {
+			if keys[j] != want[j] {
+				t.Errorf("Expected request %d to put %v, got %v", i, want, keys)
+			}
+		}
+	}
+
+	// Records still failing once the retries are exhausted are an error
+	f.requests = nil
+	f.fail = func(n int) bool { return true }
+	if err := k.SendEvents(events[:1]); err == nil {
+		t.Fatal("Expected an error once the retries are exhausted")
+	}
+	if len(f.requests) != 3 {
+		t.Errorf("Expected 1 request and 2 retries, got %d requests", len(f.requests))
+	}
+	if k.Status().LastError == "" {
+		t.Errorf("Expected the error in the sink status")
+	}
+}
+
+func TestKinesisSinkKeepsPuttingAfterFailedBatch(t *testing.T) {
+	// Every record of the first batch fails, on each of its attempts
+	f := &fakeAWSStreams{fail: func(n int) bool { return n <= kinesisMaxRecords }}
+	k, srv := newTestKinesisSink(t, f)
+	defer srv.Close()
+	k.MaxRetries = 0
+
+	events := make([]EventData, kinesisMaxRecords+1)
+	for i := range events {
+		events[i] = formatTestEvent()
+	}
+	if err := k.SendEvents(events); err == nil {
+		t.Fatal("Expected an error for the failed batch")
+	}
+	if len(f.requests) != 2 || len(f.requests[1]) != 1 {
+		t.Errorf("Expected the second batch to be put, got %d requests", len(f.requests))
+	}
+	if k.Status().LastError == "" {
+		t.Errorf("Expected the error in the sink status")
+	}
+}
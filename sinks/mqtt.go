@@ -0,0 +1,351 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+// DefaultMQTTTopic is the topic template of the MQTT sink. Clients can
+// subscribe to k8s/events/prod/# or k8s/events/+/Pod/BackOff.
+const DefaultMQTTTopic = "k8s/events/{{.Event.InvolvedObject.Namespace}}/{{.Event.InvolvedObject.Kind}}/{{.Event.Reason}}"
+
+// MQTTConfig holds the settings of an MQTTSink
+type MQTTConfig struct {
+	// Broker is the URL of the broker, such as tcp://localhost:1883 or
+	// ssl://broker:8883
+	Broker string
+	// ClientID defaults to eventrouter-<hostname>
+	ClientID  string
+	Username  string
+	Password  string
+	TLSConfig *tls.Config
+
+	// PersistentSession keeps the session of the client on the broker, so
+	// that messages in flight are delivered after reconnecting. It needs a
+	// ClientID that stays the same across restarts.
+	PersistentSession bool
+
+	// QoS is the quality of service of the messages: 0, 1 or 2
+	QoS    byte
+	Retain bool
+
+	// PublishTimeout bounds how long to wait for the broker to acknowledge
+	// a batch
+	PublishTimeout time.Duration
+
+	// MaxQueue bounds how many messages are kept while disconnected. The
+	// oldest are dropped beyond that.
+	MaxQueue int
+}
+
+// MQTTSink publishes events to the topics of an MQTT broker. While it is
+// disconnected, messages are queued in memory and published once it
+// reconnects.
+type MQTTSink struct {
+	// Topic gives the topic of an event
+	Topic Formatter
+
+	config    MQTTConfig
+	client    mqtt.Client
+	formatter Formatter
+	eventCh   channels.Channel
+	stats     sinkStats
+
+	// connected is signaled every time the client connects
+	connected chan struct{}
+
+	// queue holds the messages waiting for the client to connect, oldest
+	// first. It is only used by Run.
+	queue []mqttOutMsg
+
+	// retryBackoff is the initial delay between attempts to connect
+	retryBackoff time.Duration
+}
+
+// mqttOutMsg is an event to publish
+type mqttOutMsg struct {
+	topic string
+	data  []byte
+}
+
+// NewMQTTSink constructs a new MQTTSink. It only connects once Run starts.
+func NewMQTTSink(config MQTTConfig, overflow bool, bufferSize int, formatter Formatter) (*MQTTSink, error) {
+	if config.QoS > 2 {
+		return nil, fmt.Errorf("invalid MQTT QoS %d, must be 0, 1 or 2", config.QoS)
+	}
+	if config.ClientID == "" {
+		hostname, _ := os.Hostname()
+		config.ClientID = "eventrouter-" + hostname
+	}
+	topic, err := newTemplateFormatter("mqttTopic", DefaultMQTTTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MQTTSink{
+		Topic:        topic,
+		config:       config,
+		formatter:    formatter,
+		connected:    make(chan struct{}, 1),
+		retryBackoff: time.Second,
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetCleanSession(!config.PersistentSession).
+		SetAutoReconnect(true).
+		SetConnectTimeout(10 * time.Second).
+		SetOnConnectHandler(func(mqtt.Client) {
+			select {
+			case m.connected <- struct{}{}:
+			default:
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			glog.Warningf("Lost the connection to MQTT broker %s: %v", config.Broker, err)
+		})
+	if config.TLSConfig != nil {
+		opts.SetTLSConfig(config.TLSConfig)
+	}
+	m.client = mqtt.NewClient(opts)
+
+	if overflow {
+		m.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		m.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+	return m, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event OverflowingChannel, which should never block.
+// Messages that are buffered beyond the bufferSize specified for this
+// MQTTSink are discarded.
+func (m *MQTTSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	m.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Status implements the StatusReporter interface. Messages waiting for the
+// client to reconnect are not counted.
+func (m *MQTTSink) Status() SinkStatus {
+	return m.stats.status(m.eventCh.Len())
+}
+
+// HealthCheck implements the HealthChecker interface by checking that the
+// client is connected
+func (m *MQTTSink) HealthCheck() error {
+	if !m.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to MQTT broker %s", m.config.Broker)
+	}
+	return nil
+}
+
+// Run connects to the broker, and sits in a loop, waiting for data to come
+// in through m.eventCh, and publishing it. While disconnected, messages are
+// queued, and published when the client reconnects.
+func (m *MQTTSink) Run(stopCh <-chan bool) {
+	go m.connect(stopCh)
+
+loop:
+	for {
+		select {
+		case e := <-m.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := m.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-m.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			m.enqueue(m.newMessages(arr))
+			m.flushQueue()
+		case <-m.connected:
+			m.flushQueue()
+		case <-stopCh:
+			break loop
+		}
+	}
+	m.client.Disconnect(250)
+}
+
+// connect makes the first connection to the broker, retrying with backoff.
+// The client reconnects by itself afterwards.
+func (m *MQTTSink) connect(stopCh <-chan bool) {
+	backoff := m.retryBackoff
+	for {
+		t := m.client.Connect()
+		t.Wait()
+		if t.Error() == nil {
+			glog.Infof("Connected to MQTT broker %s", m.config.Broker)
+			return
+		}
+		glog.Warningf("Failed to connect to MQTT broker %s, retrying in %v: %v", m.config.Broker, backoff, t.Error())
+		select {
+		case <-time.After(backoff):
+		case <-stopCh:
+			return
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// enqueue adds messages to the queue, dropping the oldest beyond MaxQueue
+func (m *MQTTSink) enqueue(msgs []mqttOutMsg) {
+	m.queue = append(m.queue, msgs...)
+	if over := len(m.queue) - m.config.MaxQueue; m.config.MaxQueue > 0 && over > 0 {
+		glog.Warningf("Dropping %d messages queued while disconnected from MQTT broker %s", over, m.config.Broker)
+		m.queue = m.queue[over:]
+	}
+}
+
+// flushQueue publishes the queued messages when the client is connected, and
+// keeps those that failed to be published again
+func (m *MQTTSink) flushQueue() {
+	if len(m.queue) == 0 || !m.client.IsConnectionOpen() {
+		return
+	}
+	failed, err := m.publish(m.queue)
+	m.queue = failed
+	if err != nil {
+		glog.Errorf("Failed to publish messages to MQTT broker %s, %d queued again: %v", m.config.Broker, len(failed), err)
+		m.stats.sendFailed(err)
+		return
+	}
+	m.stats.sendSucceeded()
+}
+
+// SendEvents implements the BatchSender interface. Unlike Run, it doesn't
+// queue the events when the client is disconnected, but fails.
+func (m *MQTTSink) SendEvents(events []EventData) error {
+	if !m.client.IsConnectionOpen() {
+		err := fmt.Errorf("not connected to MQTT broker %s", m.config.Broker)
+		m.stats.sendFailed(err)
+		return err
+	}
+	_, err := m.publish(m.newMessages(events))
+	if err == errMQTTTimeout {
+		// The client delivers the messages that timed out by itself, so
+		// failing would only have the whole batch published again
+		glog.Warningf("Publishing to MQTT broker %s timed out, the client delivers the messages once acknowledged", m.config.Broker)
+		m.stats.sendFailed(err)
+		return nil
+	}
+	if err != nil {
+		m.stats.sendFailed(err)
+		return err
+	}
+	m.stats.sendSucceeded()
+	return nil
+}
+
+// newMessages formats event data as messages. Events that can't be
+// serialized are logged and dropped. Topic levels can't be empty or hold
+// wildcards, which are replaced with underscores, so that events of cluster
+// scoped objects get a topic like k8s/events/_/Node/Rebooted.
+func (m *MQTTSink) newMessages(events []EventData) []mqttOutMsg {
+	var msgs []mqttOutMsg
+	for _, evt := range events {
+		data, err := m.formatter.Format(evt)
+		if err != nil {
+			glog.Warningf("Failed to serialize event: %v", err)
+			continue
+		}
+		b, err := m.Topic.Format(evt)
+		if err != nil {
+			glog.Warningf("Failed to format topic: %v", err)
+			continue
+		}
+
+		levels := strings.Split(string(b), "/")
+		for i, l := range levels {
+			l = strings.NewReplacer("+", "_", "#", "_").Replace(l)
+			if l == "" {
+				l = "_"
+			}
+			levels[i] = l
+		}
+		msgs = append(msgs, mqttOutMsg{topic: strings.Join(levels, "/"), data: data})
+	}
+	return msgs
+}
+
+// errMQTTTimeout is returned by publish when the only messages not
+// acknowledged are those that timed out
+var errMQTTTimeout = errors.New("mqtt: timed out waiting for the broker")
+
+// publish publishes the messages, and waits for the broker to acknowledge
+// them. It returns those that the client failed to publish, to be published
+// again. Those that timed out aren't returned, as the client still holds them
+// and delivers them itself, after reconnecting for QoS 1 and 2.
+func (m *MQTTSink) publish(msgs []mqttOutMsg) ([]mqttOutMsg, error) {
+	tokens := make([]mqtt.Token, len(msgs))
+	for i, msg := range msgs {
+		tokens[i] = m.client.Publish(msg.topic, m.config.QoS, m.config.Retain, msg.data)
+	}
+
+	var failed []mqttOutMsg
+	var firstErr error
+	timedOut := false
+	deadline := time.Now().Add(m.config.PublishTimeout)
+	for i, t := range tokens {
+		if !t.WaitTimeout(time.Until(deadline)) {
+			timedOut = true
+			continue
+		}
+		if err := t.Error(); err != nil {
+			failed = append(failed, msgs[i])
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr == nil && timedOut {
+		firstErr = errMQTTTimeout
+	}
+	return failed, firstErr
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// fakeMQTT is a stand-in MQTT broker. It refuses connections while refuse is
+// set, and doesn't acknowledge messages while noAck is set.
+type fakeMQTT struct {
+	l        net.Listener
+	mu       sync.Mutex
+	refuse   bool
+	noAck    bool
+	connects []*packets.ConnectPacket
+	msgs     []*packets.PublishPacket
+}
+
+func newFakeMQTT(t *testing.T) *fakeMQTT {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeMQTT{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeMQTT) url() string {
+	return "tcp://" + f.l.Addr().String()
+}
+
+func (f *fakeMQTT) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := p.(type) {
+		case *packets.ConnectPacket:
+			f.mu.Lock()
+			f.connects = append(f.connects, p)
+			refuse := f.refuse
+			f.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			if refuse {
+				ack.ReturnCode = packets.ErrRefusedServerUnavailable
+			}
+			ack.Write(conn)
+			if refuse {
+				return
+			}
+		case *packets.PublishPacket:
+			f.mu.Lock()
+			f.msgs = append(f.msgs, p)
+			noAck := f.noAck
+			f.mu.Unlock()
+			if p.Qos == 1 && !noAck {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				ack.Write(conn)
+			}
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// published returns the number of messages received
+func (f *fakeMQTT) published() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.msgs)
+}
+
+// waitFor polls cond until it holds or a few seconds have passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestMQTTSink(t *testing.T, config MQTTConfig) *MQTTSink {
+	config.PublishTimeout = 5 * time.Second
+	m, err := NewMQTTSink(config, false, 10, mustGetFormatter("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.retryBackoff = 10 * time.Millisecond
+	return m
+}
+
+func TestMQTTSink(t *testing.T) {
+	f := newFakeMQTT(t)
+	defer f.l.Close()
+
+	m := newTestMQTTSink(t, MQTTConfig{
+		Broker:            f.url(),
+		ClientID:          "eventrouter-test",
+		Username:          "user",
+		Password:          "pwd",
+		PersistentSession: true,
+		QoS:               1,
+		Retain:            true,
+	})
+	stopCh := make(chan bool)
+	defer close(stopCh)
+	go m.Run(stopCh)
+	waitFor(t, "the connection", func() bool { return m.HealthCheck() == nil })
+
+	if err := m.SendEvents(natsTestEvents()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := f.connects[0]
+	if c.ClientIdentifier != "eventrouter-test" || c.Username != "user" || string(c.Password) != "pwd" || c.CleanSession {
+		t.Errorf("Expected a persistent session with user credentials, got %v", c)
+	}
+	if len(f.msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(f.msgs))
+	}
+	for i, topic := range []string{"k8s/events/prod/Pod/BackOff", "k8s/events/_/Node/NodeNotReady"} {
+		msg := f.msgs[i]
+		if msg.TopicName != topic {
+			t.Errorf("Expected topic %s, got %s", topic, msg.TopicName)
+		}
+		if msg.Qos != 1 || !msg.Retain {
+			t.Errorf("Expected a retained QoS 1 message, got %v", msg)
+		}
+	}
+	var data EventData
+	if err := json.Unmarshal(f.msgs[0].Payload, &data); err != nil || data.Event.Reason != "BackOff" {
+		t.Errorf("Unexpected message data %s", f.msgs[0].Payload)
+	}
+}
+
+func TestMQTTSinkQueuesWhileDisconnected(t *testing.T) {
+	f := newFakeMQTT(t)
+	defer f.l.Close()
+	f.refuse = true
+
+	m := newTestMQTTSink(t, MQTTConfig{Broker: f.url(), QoS: 1})
+	if err := m.SendEvents(natsTestEvents()); err == nil {
+		t.Errorf("Expected an error when not connected")
+	}
+
+	stopCh := make(chan bool)
+	defer close(stopCh)
+	go m.Run(stopCh)
+	for _, evt := range natsTestEvents() {
+		m.UpdateEvents(evt.Event, nil)
+	}
+	waitFor(t, "a refused connection", func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return len(f.connects) > 0
+	})
+	if f.published() != 0 {
+		t.Fatalf("Expected no messages while disconnected")
+	}
+
+	// The queued events are published once connected
+	f.mu.Lock()
+	f.refuse = false
+	f.mu.Unlock()
+	waitFor(t, "the queued messages", func() bool { return f.published() == 2 })
+	if m.Status().LastError != "" {
+		t.Errorf("Expected no errors, got %s", m.Status().LastError)
+	}
+}
+
+func TestMQTTSinkTimeoutsNotQueued(t *testing.T) {
+	f := newFakeMQTT(t)
+	defer f.l.Close()
+	f.noAck = true
+
+	m := newTestMQTTSink(t, MQTTConfig{Broker: f.url(), QoS: 1})
+	m.config.PublishTimeout = 50 * time.Millisecond
+	stopCh := make(chan bool)
+	defer close(stopCh)
+	go m.Run(stopCh)
+	waitFor(t, "the connection", func() bool { return m.HealthCheck() == nil })
+
+	for _, evt := range natsTestEvents() {
+		m.UpdateEvents(evt.Event, nil)
+	}
+	waitFor(t, "the timeout", func() bool { return m.Status().LastError != "" })
+
+	// The client still holds the messages that timed out, so only the new
+	// event is published
+	f.mu.Lock()
+	f.noAck = false
+	f.mu.Unlock()
+	m.UpdateEvents(natsTestEvents()[0].Event, nil)
+	waitFor(t, "the new message", func() bool { return f.published() >= 3 })
+	time.Sleep(100 * time.Millisecond)
+	if n := f.published(); n != 3 {
+		t.Errorf("Expected 3 messages, got %d", n)
+	}
+}
+
+func TestMQTTSinkInvalidQoS(t *testing.T) {
+	if _, err := NewMQTTSink(MQTTConfig{QoS: 3}, false, 10, mustGetFormatter("json")); err == nil {
+		t.Errorf("Expected an error for QoS 3")
+	}
+}
+
+func TestMQTTSinkTimeoutsNotReplayedByDiskQueue(t *testing.T) {
+	f := newFakeMQTT(t)
+	defer f.l.Close()
+	f.noAck = true
+
+	m := newTestMQTTSink(t, MQTTConfig{Broker: f.url(), QoS: 1})
+	m.config.PublishTimeout = 50 * time.Millisecond
+	stopCh := make(chan bool)
+	defer close(stopCh)
+	go m.Run(stopCh)
+	waitFor(t, "the connection", func() bool { return m.HealthCheck() == nil })
+
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := NewDiskQueue(m, dir, 1<<20, 1<<16, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.writer.Close()
+	go q.Run(stopCh)
+
+	// The batch that timed out is acknowledged rather than published again
+	for _, evt := range natsTestEvents() {
+		q.UpdateEvents(evt.Event, nil)
+	}
+	waitFor(t, "the batch to be acknowledged", func() bool { return q.Status().BufferDepth == 0 })
+	if n := f.published(); n != 2 {
+		t.Errorf("Expected 2 messages, got %d", n)
+	}
+	if m.Status().LastError == "" {
+		t.Errorf("Expected the timeout in the sink status")
+	}
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+	"github.com/nats-io/nats.go"
+	v1 "k8s.io/api/core/v1"
+)
+
+// DefaultNATSSubject is the subject template of the NATS sink. Consumers can
+// subscribe to k8s.events.prod.> or k8s.events.*.Pod.BackOff.
+const DefaultNATSSubject = "k8s.events.{{.Event.InvolvedObject.Namespace}}.{{.Event.InvolvedObject.Kind}}.{{.Event.Reason}}"
+
+// NATSSink publishes events to NATS subjects. In JetStream mode, it waits for
+// the stream to acknowledge each event, and sets the Nats-Msg-Id header so
+// that the stream drops the duplicates of retried events.
+type NATSSink struct {
+	// Subject gives the subject of an event
+	Subject Formatter
+
+	// JetStream waits for the acknowledgement of the stream of the subject
+	JetStream bool
+
+	// AckTimeout bounds how long to wait for the server to process a batch
+	AckTimeout time.Duration
+
+	// MaxRetries bounds how many times a batch is retried
+	MaxRetries int
+
+	url          string
+	options      []nats.Option
+	formatter    Formatter
+	retryBackoff time.Duration
+	eventCh      channels.Channel
+	stats        sinkStats
+
+	// mu guards conn, which is connected on first use. The client reconnects
+	// on its own after that.
+	mu   sync.Mutex
+	conn *nats.Conn
+}
+
+// NewNATSSink constructs a new NATSSink connecting to the servers at url, a
+// comma separated list like nats://nats-1:4222,nats://nats-2:4222 or
+// tls://nats:4222. credsFile is a creds file holding a user JWT and NKey
+// seed, or a file holding just an NKey seed. tlsConfig may be nil.
+func NewNATSSink(url, credsFile string, tlsConfig *tls.Config, overflow bool, bufferSize int, formatter Formatter) (*NATSSink, error) {
+	subject, err := newTemplateFormatter("natsSubject", DefaultNATSSubject)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &NATSSink{
+		Subject:    subject,
+		AckTimeout: 5 * time.Second,
+		MaxRetries: 3,
+		url:        url,
+		options: []nats.Option{
+			nats.Name("eventrouter"),
+			nats.Timeout(10 * time.Second),
+			nats.MaxReconnects(-1),
+		},
+		formatter:    formatter,
+		retryBackoff: time.Second,
+	}
+	if credsFile != "" {
+		opt, err := natsCredsOption(credsFile)
+		if err != nil {
+			return nil, err
+		}
+		n.options = append(n.options, opt)
+	}
+	if tlsConfig != nil {
+		n.options = append(n.options, nats.Secure(tlsConfig))
+	}
+
+	if overflow {
+		n.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		n.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+	return n, nil
+}
+
+// natsCredsOption authenticates with the user JWT and NKey seed of a creds
+// file, or with the seed alone of an NKey seed file
+func natsCredsOption(file string) (nats.Option, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(string(b), "BEGIN NATS USER JWT") {
+		return nats.UserCredentials(file), nil
+	}
+	opt, err := nats.NkeyOptionFromSeed(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NKey seed file %s: %v", file, err)
+	}
+	return opt, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event OverflowingChannel, which should never block.
+// Messages that are buffered beyond the bufferSize specified for this
+// NATSSink are discarded.
+func (n *NATSSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	n.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Status implements the StatusReporter interface
+func (n *NATSSink) Status() SinkStatus {
+	return n.stats.status(n.eventCh.Len())
+}
+
+// HealthCheck implements the HealthChecker interface by making a round trip
+// to the server
+func (n *NATSSink) HealthCheck() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	conn, err := n.connect()
+	if err != nil {
+		return err
+	}
+	return conn.FlushTimeout(healthCheckTimeout)
+}
+
+// Run sits in a loop, waiting for data to come in through n.eventCh, and
+// publishing them. If multiple events have happened between loop iterations,
+// they are published together and flushed once.
+func (n *NATSSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-n.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := n.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-n.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			n.SendEvents(arr)
+		case <-stopCh:
+			break loop
+		}
+	}
+	n.mu.Lock()
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+	n.mu.Unlock()
+}
+
+// SendEvents implements the BatchSender interface. A batch that fails is
+// retried with exponential backoff. In JetStream mode, only the events that
+// weren't acknowledged are retried. Events that can't be serialized or are
+// over the maximum payload of the server are logged and dropped.
+func (n *NATSSink) SendEvents(events []EventData) error {
+	var msgs []*nats.Msg
+	for _, evt := range events {
+		msg, err := n.newMessage(evt)
+		if err != nil {
+			glog.Warningf("Failed to serialize event: %v", err)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	// The lock isn't held while waiting to retry, so that health checks
+	// don't wait for the whole backoff
+	backoff := n.retryBackoff
+	for attempt := 0; ; attempt++ {
+		n.mu.Lock()
+		failed, err := n.publish(msgs)
+		n.mu.Unlock()
+		if err == nil {
+			n.stats.sendSucceeded()
+			return nil
+		}
+		if attempt >= n.MaxRetries {
+			glog.Errorf("Failed to publish %d events to NATS: %v", len(failed), err)
+			n.stats.sendFailed(err)
+			return err
+		}
+		glog.Warningf("Retrying %d events in %v: %v", len(failed), backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		msgs = failed
+	}
+}
+
+// newMessage formats event data as a message. Subjects can't have empty
+// tokens or whitespace, which are replaced with underscores, so that events
+// of cluster scoped objects get a subject like k8s.events._.Node.Rebooted.
+// In JetStream mode, the message has the ID of the event version.
+func (n *NATSSink) newMessage(evt EventData) (*nats.Msg, error) {
+	data, err := n.formatter.Format(evt)
+	if err != nil {
+		return nil, err
+	}
+	b, err := n.Subject.Format(evt)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := strings.Split(string(b), ".")
+	for i, t := range tokens {
+		t = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return '_'
+			}
+			return r
+		}, t)
+		if t == "" {
+			t = "_"
+		}
+		tokens[i] = t
+	}
+	msg := nats.NewMsg(strings.Join(tokens, "."))
+	msg.Data = data
+	if n.JetStream {
+		msg.Header.Set(nats.MsgIdHdr, eventVersionID(evt.Event))
+	}
+	return msg, nil
+}
+
+// connect returns the connection to the servers, connecting if needed
+func (n *NATSSink) connect() (*nats.Conn, error) {
+	if n.conn == nil || n.conn.IsClosed() {
+		conn, err := nats.Connect(n.url, n.options...)
+		if err != nil {
+			return nil, err
+		}
+		n.conn = conn
+	}
+	return n.conn, nil
+}
+
+// publish publishes the messages, and returns those that may not have been
+// received along with the error. A message over the maximum payload is
+// dropped on its own, so that it doesn't fail the batch every time.
+func (n *NATSSink) publish(msgs []*nats.Msg) ([]*nats.Msg, error) {
+	conn, err := n.connect()
+	if err != nil {
+		return msgs, err
+	}
+	if !n.JetStream {
+		for _, msg := range msgs {
+			if err := conn.PublishMsg(msg); err == nats.ErrMaxPayload {
+				glog.Warningf("Dropping a message of %d bytes to %s: %v", len(msg.Data), msg.Subject, err)
+			} else if err != nil {
+				return msgs, err
+			}
+		}
+		if err := conn.FlushTimeout(n.AckTimeout); err != nil {
+			return msgs, err
+		}
+		return nil, nil
+	}
+
+	js, err := conn.JetStream(nats.MaxWait(n.AckTimeout))
+	if err != nil {
+		return msgs, err
+	}
+	var failed []*nats.Msg
+	var firstErr error
+	for _, msg := range msgs {
+		_, err := js.PublishMsg(msg)
+		if err == nats.ErrMaxPayload {
+			glog.Warningf("Dropping a message of %d bytes to %s: %v", len(msg.Data), msg.Subject, err)
+			continue
+		}
+		if err != nil {
+			failed = append(failed, msg)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to publish to %s: %v", msg.Subject, err)
+			}
+		}
+	}
+	return failed, firstErr
+}
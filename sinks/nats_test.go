@@ -0,0 +1,403 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nkeys"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakeNATSConnect is the CONNECT a client sends
+type fakeNATSConnect struct {
+	User string `json:"user"`
+	Pass string `json:"pass"`
+	JWT  string `json:"jwt"`
+	Sig  string `json:"sig"`
+}
+
+// fakeNATSMsg is a message published to the fake server
+type fakeNATSMsg struct {
+	subject string
+	reply   string
+	header  string
+	data    string
+}
+
+// fakeNATS is a stand-in NATS server. ack gives the reply to the nth
+// message published with a reply subject: "503" for no responders, "" for
+// no reply at all, and otherwise a JetStream acknowledgement. JetStream
+// account info requests aren't recorded.
+type fakeNATS struct {
+	l        net.Listener
+	mu       sync.Mutex
+	connects []fakeNATSConnect
+	msgs     []fakeNATSMsg
+	ack      func(n int) string
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNATS{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeNATS) url() string {
+	return "nats://" + f.l.Addr().String()
+}
+
+func (f *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"headers\":true,\"max_payload\":1048576,\"nonce\":\"n0nce\"}\r\n")
+	br := bufio.NewReader(conn)
+	// subs maps the subscribed subjects to their sid
+	subs := map[string]string{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "CONNECT":
+			var c fakeNATSConnect
+			json.Unmarshal([]byte(line[len("CONNECT "):]), &c)
+			f.mu.Lock()
+			f.connects = append(f.connects, c)
+			f.mu.Unlock()
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "SUB":
+			subs[args[1]] = args[len(args)-1]
+		case "PUB", "HPUB":
+			var msg fakeNATSMsg
+			var hdrLen int
+			total, _ := strconv.Atoi(args[len(args)-1])
+			if args[0] == "HPUB" {
+				hdrLen, _ = strconv.Atoi(args[len(args)-2])
+				args = args[:len(args)-1]
+			}
+			msg.subject = args[1]
+			if len(args) == 4 {
+				msg.reply = args[2]
+			}
+			payload := make([]byte, total+2)
+			if _, err := io.ReadFull(br, payload); err != nil {
+				return
+			}
+			msg.header, msg.data = string(payload[:hdrLen]), string(payload[hdrLen:total])
+
+			var ack string
+			f.mu.Lock()
+			if msg.subject == "$JS.API.INFO" {
+				// The client checks that JetStream is enabled
+				ack = "{}"
+			} else {
+				f.msgs = append(f.msgs, msg)
+				if msg.reply != "" && f.ack != nil {
+					ack = f.ack(len(f.msgs))
+				}
+			}
+			f.mu.Unlock()
+
+			// Replies go to the wildcard subscription of the reply inbox
+			sid := subs[msg.reply]
+			if i := strings.LastIndex(msg.reply, "."); sid == "" && i >= 0 {
+				sid = subs[msg.reply[:i]+".*"]
+			}
+			switch ack {
+			case "":
+			case "503":
+				hdr := "NATS/1.0 503\r\n\r\n"
+				fmt.Fprintf(conn, "HMSG %s %s %d %d\r\n%s\r\n", msg.reply, sid, len(hdr), len(hdr), hdr)
+			default:
+				fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", msg.reply, sid, len(ack), ack)
+			}
+		}
+	}
+}
+
+// natsTestEvents returns an event of a pod and one of a node
+func natsTestEvents() []EventData {
+	pod := formatTestEvent()
+	pod.Event.UID = types.UID("uid-1")
+	pod.Event.ResourceVersion = "7"
+	node := NewEventData(&v1.Event{
+		InvolvedObject: v1.ObjectReference{Kind: "Node", Name: "node-1"},
+		Reason:         "NodeNotReady",
+	}, nil)
+	node.Event.UID = types.UID("uid-2")
+	node.Event.ResourceVersion = "8"
+	return []EventData{pod, node}
+}
+
+func TestNATSSink(t *testing.T) {
+	f := newFakeNATS(t)
+	defer f.l.Close()
+
+	n, err := NewNATSSink("nats://user:pwd@"+f.l.Addr().String(), "", nil, false, 10, mustGetFormatter("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.HealthCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.SendEvents(natsTestEvents()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.connects) != 1 || f.connects[0].User != "user" || f.connects[0].Pass != "pwd" {
+		t.Errorf("Expected a single connection with user credentials, got %+v", f.connects)
+	}
+	if len(f.msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(f.msgs))
+	}
+	for i, subject := range []string{"k8s.events.prod.Pod.BackOff", "k8s.events._.Node.NodeNotReady"} {
+		if f.msgs[i].subject != subject {
+			t.Errorf("Expected subject %s, got %s", subject, f.msgs[i].subject)
+		}
+		if f.msgs[i].header != "" || f.msgs[i].reply != "" {
+			t.Errorf("Expected a plain message, got %+v", f.msgs[i])
+		}
+	}
+	var data EventData
+	if err := json.Unmarshal([]byte(f.msgs[0].data), &data); err != nil || data.Event.Reason != "BackOff" {
+		t.Errorf("Unexpected message data %s", f.msgs[0].data)
+	}
+}
+
+// writeNATSCreds writes a creds file for a new user NKey, and returns the
+// key
+func writeNATSCreds(t *testing.T, dir string) (string, nkeys.KeyPair) {
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := user.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := fmt.Sprintf(`-----BEGIN NATS USER JWT-----
+eyJ0eXAiOiJqd3QiLCJhbGciOiJlZDI1NTE5In0.e30.c2ln
+------END NATS USER JWT------
+
+************************* IMPORTANT *************************
+NKEY Seed printed below can be used to sign and prove identity.
+
+-----BEGIN USER NKEY SEED-----
+%s
+------END USER NKEY SEED------
+`, seed)
+	file := filepath.Join(dir, "user.creds")
+	if err := ioutil.WriteFile(file, []byte(creds), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file, user
+}
+
+func TestNATSSinkJetStream(t *testing.T) {
+	f := newFakeNATS(t)
+	defer f.l.Close()
+	f.ack = func(n int) string {
+		if n == 1 {
+			return `{"error":{"code":503,"description":"jetstream not ready"}}`
+		}
+		return fmt.Sprintf(`{"stream":"EVENTS","seq":%d}`, n)
+	}
+
+	dir, err := ioutil.TempDir("", "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	creds, user := writeNATSCreds(t, dir)
+
+	n, err := NewNATSSink(f.url(), creds, nil, false, 10, mustGetFormatter("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.JetStream = true
+	n.retryBackoff = 0
+	if err := n.SendEvents(natsTestEvents()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry is made on the same connection
+	if len(f.connects) != 1 {
+		t.Fatalf("Expected a single connection, got %d", len(f.connects))
+	}
+	c := f.connects[0]
+	sig, _ := base64.RawURLEncoding.DecodeString(c.Sig)
+	if !strings.HasPrefix(c.JWT, "eyJ0eXAi") || user.Verify([]byte("n0nce"), sig) != nil {
+		t.Errorf("Expected the creds JWT and a signed nonce, got %+v", c)
+	}
+
+	// Only the event that wasn't acknowledged is retried, with the same ID
+	if len(f.msgs) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(f.msgs))
+	}
+	for i, id := range []string{"uid-1.7", "uid-2.8", "uid-1.7"} {
+		if !strings.Contains(f.msgs[i].header, "Nats-Msg-Id: "+id+"\r\n") {
+			t.Errorf("Expected message %d to have ID %s, got header %q", i, id, f.msgs[i].header)
+		}
+		if f.msgs[i].reply == "" {
+			t.Errorf("Expected message %d to ask for an acknowledgement", i)
+		}
+	}
+}
+
+func TestNATSSinkJetStreamNoStream(t *testing.T) {
+	f := newFakeNATS(t)
+	defer f.l.Close()
+	f.ack = func(n int) string { return "503" }
+
+	n, err := NewNATSSink(f.url(), "", nil, false, 10, mustGetFormatter("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.JetStream = true
+	n.MaxRetries = 0
+	err = n.SendEvents(natsTestEvents()[:1])
+	if err == nil || !strings.Contains(err.Error(), "failed to publish to k8s.events.prod.Pod.BackOff: nats: no response from stream") {
+		t.Errorf("Expected a missing stream error, got %v", err)
+	}
+	if n.Status().LastError == "" {
+		t.Errorf("Expected the error in the sink status")
+	}
+}
+
+func TestNATSSinkHealthCheckDuringBackoff(t *testing.T) {
+	f := newFakeNATS(t)
+	defer f.l.Close()
+	f.ack = func(n int) string { return "503" }
+
+	n, err := NewNATSSink(f.url(), "", nil, false, 10, mustGetFormatter("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.JetStream = true
+	n.MaxRetries = 1
+	n.retryBackoff = time.Second
+	done := make(chan error)
+	go func() { done <- n.SendEvents(natsTestEvents()[:1]) }()
+	waitFor(t, "the first attempt", func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return len(f.msgs) == 1
+	})
+
+	// The health check doesn't wait for the retry
+	start := time.Now()
+	if err := n.HealthCheck(); err != nil {
+		t.Errorf("Expected the server to be reachable, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the health check not to wait for the backoff, took %v", elapsed)
+	}
+	if err := <-done; err == nil {
+		t.Errorf("Expected the batch to fail")
+	}
+}
+
+func TestNATSSinkOversizedMessage(t *testing.T) {
+	for _, jetStream := range []bool{false, true} {
+		f := newFakeNATS(t)
+		f.ack = func(n int) string { return fmt.Sprintf(`{"stream":"EVENTS","seq":%d}`, n) }
+
+		n, err := NewNATSSink(f.url(), "", nil, false, 10, mustGetFormatter("json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.JetStream = jetStream
+		n.MaxRetries = 0
+
+		// The message over the maximum payload is dropped on its own
+		events := natsTestEvents()
+		big := *events[0].Event
+		big.Message = strings.Repeat("x", 1048576)
+		events[0].Event = &big
+		if err := n.SendEvents(events); err != nil {
+			t.Errorf("JetStream %v: expected the oversized message to be dropped, got %v", jetStream, err)
+		}
+		f.mu.Lock()
+		if len(f.msgs) != 1 || f.msgs[0].subject != "k8s.events._.Node.NodeNotReady" {
+			t.Errorf("JetStream %v: expected only the node event, got %d messages", jetStream, len(f.msgs))
+		}
+		f.mu.Unlock()
+		f.l.Close()
+	}
+}
+
+func TestNATSSinkNKeySeedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "user.nk")
+	if err := ioutil.WriteFile(file, []byte("SUAinvalid\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewNATSSink("nats://localhost:4222", file, nil, false, 10, mustGetFormatter("json")); err == nil {
+		t.Errorf("Expected an error for an invalid seed file")
+	}
+
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, _ := user.Seed()
+	if err := ioutil.WriteFile(file, seed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewNATSSink("nats://localhost:4222", file, nil, false, 10, mustGetFormatter("json")); err != nil {
+		t.Errorf("Expected the seed file to be accepted, got %v", err)
+	}
+}
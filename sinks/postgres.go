@@ -0,0 +1,545 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+	"github.com/lib/pq"
+	v1 "k8s.io/api/core/v1"
+)
+
+// postgresDriverName is the database/sql driver of the PostgresSink,
+// replaced in tests
+var postgresDriverName = "postgres"
+
+// postgresColumns are the columns of the table, in the order of the values of
+// postgresRow. The table is migrated by adding the ones it is missing, so
+// new columns must be nullable.
+var postgresColumns = []struct{ name, typ string }{
+	{"uid", "text NOT NULL"},
+	{"first_timestamp", "timestamptz NOT NULL"},
+	{"last_timestamp", "timestamptz"},
+	{"namespace", "text"},
+	{"kind", "text"},
+	{"name", "text"},
+	{"reason", "text"},
+	{"type", "text"},
+	{"message", "text"},
+	{"count", "integer"},
+	{"source_component", "text"},
+	{"source_host", "text"},
+	{"verb", "text"},
+	{"resource_version", "text"},
+	{"data", "jsonb"},
+}
+
+// postgresKeyColumns is the number of leading postgresColumns that make up
+// the primary key of a table partitioned by day. Other tables are keyed by
+// uid alone.
+const postgresKeyColumns = 2
+
+// postgresMaxIdentifierLen is the length PostgreSQL truncates identifiers to
+const postgresMaxIdentifierLen = 63
+
+// PostgresSink writes events to a PostgreSQL table, which it creates and
+// migrates itself. Rows are upserted on the event UID, so that the updates of
+// an event replace its row.
+type PostgresSink struct {
+	// Retention is how long rows are kept. Zero keeps them forever.
+	Retention time.Duration
+
+	// RetentionInterval is how often old rows are deleted
+	RetentionInterval time.Duration
+
+	// BatchSize bounds how many rows are written by an INSERT
+	BatchSize int
+
+	// MaxRetries bounds how many times a batch is retried
+	MaxRetries int
+
+	db             *sql.DB
+	table          string
+	partitionByDay bool
+	retryBackoff   time.Duration
+	eventCh        channels.Channel
+	stats          sinkStats
+
+	// schemaReady is set once the table is created and migrated, and
+	// partitions holds the partitions created since. They are only used by
+	// SendEvents and applyRetention, which Run calls in turn.
+	schemaReady bool
+	partitions  map[string]bool
+}
+
+// NewPostgresSink constructs a new PostgresSink writing to table in the
+// database of connStr, a URL or key=value connection string as understood by
+// lib/pq. With partitionByDay, the table is partitioned by the day of the
+// first timestamp of events, and rows are upserted on the UID and first
+// timestamp. It connects lazily, so it doesn't fail when the server is down.
+func NewPostgresSink(connStr, table string, partitionByDay bool, overflow bool, bufferSize int) (*PostgresSink, error) {
+	if !sqlIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name %q, must be letters, digits and underscores", table)
+	}
+	// PostgreSQL truncates longer identifiers, and partitions add a _YYYYMMDD
+	// suffix to the table name
+	maxLen := postgresMaxIdentifierLen
+	if partitionByDay {
+		maxLen -= len("_20060102")
+	}
+	if len(table) > maxLen {
+		return nil, fmt.Errorf("invalid table name %q, must be at most %d characters", table, maxLen)
+	}
+	db, err := sql.Open(postgresDriverName, connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PostgresSink{
+		RetentionInterval: time.Hour,
+		BatchSize:         500,
+		MaxRetries:        3,
+		db:                db,
+		table:             table,
+		partitionByDay:    partitionByDay,
+		retryBackoff:      time.Second,
+		partitions:        map[string]bool{},
+	}
+	if overflow {
+		p.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		p.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+	return p, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event OverflowingChannel, which should never block.
+// Messages that are buffered beyond the bufferSize specified for this
+// PostgresSink are discarded.
+func (p *PostgresSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	p.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Status implements the StatusReporter interface
+func (p *PostgresSink) Status() SinkStatus {
+	return p.stats.status(p.eventCh.Len())
+}
+
+// HealthCheck implements the HealthChecker interface by pinging the server
+func (p *PostgresSink) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	return p.db.PingContext(ctx)
+}
+
+// Run sits in a loop, waiting for data to come in through p.eventCh, and
+// writing it to the table. If multiple events have happened between loop
+// iterations, they are written together. Old rows are deleted every
+// RetentionInterval.
+func (p *PostgresSink) Run(stopCh <-chan bool) {
+	var retentionCh <-chan time.Time
+	if p.Retention > 0 {
+		ticker := time.NewTicker(p.RetentionInterval)
+		defer ticker.Stop()
+		retentionCh = ticker.C
+	}
+
+loop:
+	for {
+		select {
+		case e := <-p.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := p.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-p.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			p.SendEvents(arr)
+		case <-retentionCh:
+			if err := p.applyRetention(time.Now().Add(-p.Retention)); err != nil {
+				glog.Errorf("Failed to delete old events from PostgreSQL: %v", err)
+			}
+		case <-stopCh:
+			break loop
+		}
+	}
+	p.db.Close()
+}
+
+// SendEvents implements the BatchSender interface. Batches are upserted, so
+// they can be retried safely, with exponential backoff. A batch that still
+// fails doesn't stop the others from being written, and the errors are
+// returned together. Events that can't be serialized or that PostgreSQL
+// rejects are logged and dropped.
+func (p *PostgresSink) SendEvents(events []EventData) error {
+	// An INSERT can't update the same row twice, so only the last version
+	// of each event is kept
+	var rows [][]interface{}
+	index := map[string]int{}
+	for _, evt := range events {
+		row, err := postgresRow(evt)
+		if err != nil {
+			glog.Warningf("Failed to serialize event: %v", err)
+			continue
+		}
+		key := p.rowKey(row)
+		if i, ok := index[key]; ok {
+			rows[i] = row
+			continue
+		}
+		index[key] = len(rows)
+		rows = append(rows, row)
+	}
+
+	var errs []error
+	for len(rows) > 0 {
+		n := len(rows)
+		if p.BatchSize > 0 && n > p.BatchSize {
+			n = p.BatchSize
+		}
+		if err := p.sendBatch(rows[:n]); err != nil {
+			errs = append(errs, err)
+		}
+		rows = rows[n:]
+	}
+	if err := combineErrors(errs); err != nil {
+		p.stats.sendFailed(err)
+		return err
+	}
+	p.stats.sendSucceeded()
+	return nil
+}
+
+// sendBatch writes a batch of rows. When the data of a row is rejected, such
+// as a message with a NUL character, the batch is split in halves until the
+// rows that fail are isolated, and those are dropped.
+func (p *PostgresSink) sendBatch(rows [][]interface{}) error {
+	err := p.writeBatch(rows)
+	if !postgresDataError(err) {
+		return err
+	}
+	if len(rows) == 1 {
+		glog.Errorf("Dropping event %v rejected by PostgreSQL: %v", rows[0][0], err)
+		return nil
+	}
+
+	var errs []error
+	for _, half := range [][][]interface{}{rows[:len(rows)/2], rows[len(rows)/2:]} {
+		if err := p.sendBatch(half); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+// writeBatch writes a batch of rows, retrying it with backoff on failure.
+// Errors in the data of the rows aren't retried. The schema is checked again
+// when the table, a column or a partition is missing, in case they were
+// dropped.
+func (p *PostgresSink) writeBatch(rows [][]interface{}) error {
+	backoff := p.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := p.ensureSchema(rows)
+		if err == nil {
+			_, err = p.db.Exec(p.upsertStatement(len(rows)), postgresArgs(rows)...)
+			if err == nil || postgresDataError(err) {
+				return err
+			}
+			if p.schemaError(err) {
+				p.schemaReady = false
+				p.partitions = map[string]bool{}
+			}
+		}
+
+		if attempt >= p.MaxRetries {
+			glog.Errorf("Failed to write %d events to PostgreSQL: %v", len(rows), err)
+			return err
+		}
+		glog.Warningf("Retrying %d events in %v: %v", len(rows), backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// schemaError returns whether an error is caused by a missing table, column
+// or partition
+func (p *PostgresSink) schemaError(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch pqErr.Code.Name() {
+	case "undefined_table", "undefined_column":
+		return true
+	case "check_violation":
+		// There is no partition for the row
+		return p.partitionByDay
+	}
+	return false
+}
+
+// postgresDataError returns whether an error is caused by the values of the
+// rows, which fail the same way when retried. Check violations are left out,
+// as they are how a missing partition fails.
+func postgresDataError(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch pqErr.Code.Class() {
+	case "22":
+		return true
+	case "23":
+		return pqErr.Code.Name() != "check_violation"
+	}
+	return false
+}
+
+// postgresRow returns the values of the columns of an event
+func postgresRow(e EventData) ([]interface{}, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	evt := e.Event
+	// The first timestamp is part of the key of partitioned tables, so it
+	// must not change across the updates of an event
+	first := evt.FirstTimestamp.Time
+	if first.IsZero() {
+		first = evt.EventTime.Time
+	}
+	if first.IsZero() {
+		first = evt.CreationTimestamp.Time
+	}
+	last := evt.LastTimestamp.Time
+	if last.IsZero() {
+		last = first
+	}
+
+	return []interface{}{
+		string(evt.UID),
+		first.UTC(),
+		last.UTC(),
+		evt.InvolvedObject.Namespace,
+		evt.InvolvedObject.Kind,
+		evt.InvolvedObject.Name,
+		evt.Reason,
+		evt.Type,
+		evt.Message,
+		evt.Count,
+		evt.Source.Component,
+		evt.Source.Host,
+		e.Verb,
+		evt.ResourceVersion,
+		string(data),
+	}, nil
+}
+
+// postgresArgs flattens rows into the arguments of a statement
+func postgresArgs(rows [][]interface{}) []interface{} {
+	args := make([]interface{}, 0, len(rows)*len(postgresColumns))
+	for _, row := range rows {
+		args = append(args, row...)
+	}
+	return args
+}
+
+// keyColumns returns the number of leading columns in the primary key
+func (p *PostgresSink) keyColumns() int {
+	if p.partitionByDay {
+		return postgresKeyColumns
+	}
+	return 1
+}
+
+// rowKey returns the primary key of a row, as a string
+func (p *PostgresSink) rowKey(row []interface{}) string {
+	return fmt.Sprint(row[:p.keyColumns()]...)
+}
+
+// upsertStatement returns a multi-row INSERT of n rows, which replaces the
+// rows that exist
+func (p *PostgresSink) upsertStatement(n int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "INSERT INTO %s (", pq.QuoteIdentifier(p.table))
+	for i, c := range postgresColumns {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(c.name)
+	}
+	b.WriteString(") VALUES ")
+	for r := 0; r < n; r++ {
+		if r > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for i := range postgresColumns {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "$%d", r*len(postgresColumns)+i+1)
+		}
+		b.WriteByte(')')
+	}
+
+	keys := postgresColumns[:p.keyColumns()]
+	b.WriteString(" ON CONFLICT (")
+	for i, c := range keys {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(c.name)
+	}
+	b.WriteString(") DO UPDATE SET ")
+	for i, c := range postgresColumns[len(keys):] {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s = EXCLUDED.%s", c.name, c.name)
+	}
+	return b.String()
+}
+
+// ensureSchema creates the table if needed and adds the columns it is
+// missing, and creates the partitions of the days of the rows
+func (p *PostgresSink) ensureSchema(rows [][]interface{}) error {
+	table := pq.QuoteIdentifier(p.table)
+	if !p.schemaReady {
+		var b strings.Builder
+		fmt.Fprintf(&b, "CREATE TABLE IF NOT EXISTS %s (", table)
+		for _, c := range postgresColumns {
+			fmt.Fprintf(&b, "%s %s, ", c.name, c.typ)
+		}
+		if p.partitionByDay {
+			b.WriteString("PRIMARY KEY (uid, first_timestamp)) PARTITION BY RANGE (first_timestamp)")
+		} else {
+			b.WriteString("PRIMARY KEY (uid))")
+		}
+		if _, err := p.db.Exec(b.String()); err != nil {
+			return fmt.Errorf("failed to create table %s: %v", p.table, err)
+		}
+
+		for _, c := range postgresColumns[postgresKeyColumns:] {
+			if _, err := p.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, c.name, c.typ)); err != nil {
+				return fmt.Errorf("failed to add column %s to table %s: %v", c.name, p.table, err)
+			}
+		}
+		p.schemaReady = true
+	}
+
+	if !p.partitionByDay {
+		return nil
+	}
+	for _, row := range rows {
+		day := row[1].(time.Time).Truncate(24 * time.Hour)
+		name := p.partitionName(day)
+		if p.partitions[name] {
+			continue
+		}
+		stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+			pq.QuoteIdentifier(name), table, day.Format(time.RFC3339), day.Add(24*time.Hour).Format(time.RFC3339))
+		if _, err := p.db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create partition %s: %v", name, err)
+		}
+		p.partitions[name] = true
+	}
+	return nil
+}
+
+// partitionName returns the name of the partition of a day, like
+// events_20191231
+func (p *PostgresSink) partitionName(day time.Time) string {
+	return p.table + "_" + day.Format("20060102")
+}
+
+// applyRetention deletes the rows of events last seen before cutoff. When the
+// table is partitioned, it drops the partitions of the days before cutoff
+// instead. Partitions are by first timestamp, so this also drops the rows of
+// events first seen before cutoff but seen again since.
+func (p *PostgresSink) applyRetention(cutoff time.Time) error {
+	table := pq.QuoteIdentifier(p.table)
+	if !p.partitionByDay {
+		res, err := p.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE last_timestamp < $1", table), cutoff.UTC())
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			glog.Infof("Deleted %d events older than %v from %s", n, cutoff, p.table)
+		}
+		return nil
+	}
+
+	rows, err := p.db.Query("SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = $1::regclass", table)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, p.table+"_") {
+			continue
+		}
+		day, err := time.Parse("20060102", strings.TrimPrefix(name, p.table+"_"))
+		if err != nil || day.Add(24*time.Hour).After(cutoff) {
+			continue
+		}
+		if _, err := p.db.Exec("DROP TABLE IF EXISTS " + pq.QuoteIdentifier(name)); err != nil {
+			return err
+		}
+		delete(p.partitions, name)
+		glog.Infof("Dropped partition %s of events older than %v", name, cutoff)
+	}
+	return nil
+}
@@ -0,0 +1,426 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakePostgres is a database/sql driver recording the statements it runs.
+// It checks their syntax and placeholders, so that database/sql checks the
+// number of arguments. fail gives the error of a statement, if any, and
+// partitions are the names returned by queries.
+type fakePostgres struct {
+	mu         sync.Mutex
+	stmts      []fakeSQLStmt
+	fail       func(query string, args []driver.Value) error
+	partitions []string
+}
+
+// fakeSQLStmt is a statement run by fakePostgres
+type fakeSQLStmt struct {
+	query string
+	args  []driver.Value
+}
+
+var fakePostgresDB = &fakePostgres{}
+
+func init() {
+	sql.Register("fakepostgres", fakePostgresDB)
+}
+
+func (f *fakePostgres) Open(name string) (driver.Conn, error) { return fakePostgresConn{f}, nil }
+
+func (f *fakePostgres) run(query string, args []driver.Value) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stmts = append(f.stmts, fakeSQLStmt{query, args})
+	if f.fail != nil {
+		return f.fail(query, args)
+	}
+	return nil
+}
+
+// reset forgets the statements run so far, and returns them
+func (f *fakePostgres) reset() []fakeSQLStmt {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stmts := f.stmts
+	f.stmts, f.fail, f.partitions = nil, nil, nil
+	return stmts
+}
+
+var (
+	fakeSQLPlaceholder = regexp.MustCompile(`\$([0-9]+)`)
+	fakeSQLInsert      = regexp.MustCompile(`^INSERT INTO "[A-Za-z0-9_]+" \(([a-z_, ]+)\) VALUES (.*?)(?: ON CONFLICT \(([a-z_, ]+)\) DO UPDATE SET .*)?$`)
+)
+
+// checkFakeSQL checks the quotes, parentheses and placeholders of a
+// statement, and the shape of INSERTs, and returns the number of
+// placeholders
+func checkFakeSQL(query string) (int, error) {
+	var depth int
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+			if depth < 0 {
+				return 0, fmt.Errorf("unbalanced parentheses in %s", query)
+			}
+		}
+	}
+	if quote != 0 || depth != 0 {
+		return 0, fmt.Errorf("unterminated quote or parenthesis in %s", query)
+	}
+
+	// Placeholders must be numbered from $1 without gaps
+	seen := map[int]bool{}
+	for _, m := range fakeSQLPlaceholder.FindAllStringSubmatch(query, -1) {
+		n, _ := strconv.Atoi(m[1])
+		seen[n] = true
+	}
+	for i := 1; i <= len(seen); i++ {
+		if !seen[i] {
+			return 0, fmt.Errorf("placeholder $%d missing in %s", i, query)
+		}
+	}
+
+	if strings.HasPrefix(query, "INSERT") {
+		m := fakeSQLInsert.FindStringSubmatch(query)
+		if m == nil {
+			return 0, fmt.Errorf("invalid INSERT %s", query)
+		}
+		columns := len(strings.Split(m[1], ","))
+		for _, tuple := range strings.Split(strings.Trim(m[2], "()"), "), (") {
+			if n := len(strings.Split(tuple, ",")); n != columns {
+				return 0, fmt.Errorf("%d values for %d columns in %s", n, columns, query)
+			}
+		}
+	}
+	return len(seen), nil
+}
+
+type fakePostgresConn struct{ f *fakePostgres }
+
+func (c fakePostgresConn) Prepare(query string) (driver.Stmt, error) {
+	n, err := checkFakeSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	return fakePostgresStmt{c.f, query, n}, nil
+}
+func (c fakePostgresConn) Close() error              { return nil }
+func (c fakePostgresConn) Begin() (driver.Tx, error) { return nil, errors.New("no transactions") }
+
+type fakePostgresStmt struct {
+	f        *fakePostgres
+	query    string
+	numInput int
+}
+
+func (s fakePostgresStmt) Close() error  { return nil }
+func (s fakePostgresStmt) NumInput() int { return s.numInput }
+func (s fakePostgresStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.f.run(s.query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+func (s fakePostgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.f.run(s.query, args); err != nil {
+		return nil, err
+	}
+	return &fakePostgresRows{names: s.f.partitions}, nil
+}
+
+type fakePostgresRows struct{ names []string }
+
+func (r *fakePostgresRows) Columns() []string { return []string{"relname"} }
+func (r *fakePostgresRows) Close() error      { return nil }
+func (r *fakePostgresRows) Next(dest []driver.Value) error {
+	if len(r.names) == 0 {
+		return io.EOF
+	}
+	dest[0], r.names = r.names[0], r.names[1:]
+	return nil
+}
+
+func newTestPostgresSink(t *testing.T, partitionByDay bool) *PostgresSink {
+	fakePostgresDB.reset()
+	postgresDriverName = "fakepostgres"
+	defer func() { postgresDriverName = "postgres" }()
+	p, err := NewPostgresSink("postgres://localhost/events", "events", partitionByDay, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.retryBackoff = 0
+	return p
+}
+
+// postgresTestEvents returns two versions of an event, and another event
+func postgresTestEvents() []EventData {
+	events := natsTestEvents()
+	first := metav1.NewTime(time.Date(2019, 12, 31, 23, 0, 0, 0, time.UTC))
+	for _, e := range events {
+		e.Event.FirstTimestamp = first
+		e.Event.LastTimestamp = first
+	}
+	updated := *events[0].Event
+	updated.Count = 5
+	updated.LastTimestamp = metav1.NewTime(first.Add(2 * time.Hour))
+	return append(events, NewEventData(&updated, events[0].Event))
+}
+
+func TestPostgresSink(t *testing.T) {
+	p := newTestPostgresSink(t, false)
+	if err := p.SendEvents(postgresTestEvents()); err != nil {
+		t.Fatal(err)
+	}
+	// The schema is checked only once
+	if err := p.SendEvents(postgresTestEvents()[:1]); err != nil {
+		t.Fatal(err)
+	}
+	stmts := fakePostgresDB.reset()
+
+	if !strings.HasPrefix(stmts[0].query, `CREATE TABLE IF NOT EXISTS "events" (uid text NOT NULL, first_timestamp timestamptz NOT NULL,`) ||
+		!strings.HasSuffix(stmts[0].query, "data jsonb, PRIMARY KEY (uid))") {
+		t.Errorf("Unexpected CREATE TABLE statement %s", stmts[0].query)
+	}
+	migrations := len(postgresColumns) - postgresKeyColumns
+	for _, s := range stmts[1 : 1+migrations] {
+		if !strings.HasPrefix(s.query, `ALTER TABLE "events" ADD COLUMN IF NOT EXISTS `) {
+			t.Errorf("Expected a migration, got %s", s.query)
+		}
+	}
+	if len(stmts) != 3+migrations {
+		t.Fatalf("Expected 2 inserts, got %d statements", len(stmts)-1-migrations)
+	}
+
+	// The two versions of the pod event are merged
+	insert := stmts[1+migrations]
+	if len(insert.args) != 2*len(postgresColumns) {
+		t.Fatalf("Expected 2 rows, got %d values", len(insert.args))
+	}
+	if !strings.Contains(insert.query, "($16, $17,") || !strings.HasSuffix(insert.query, "ON CONFLICT (uid) DO UPDATE SET first_timestamp = EXCLUDED.first_timestamp, last_timestamp = EXCLUDED.last_timestamp, namespace = EXCLUDED.namespace, kind = EXCLUDED.kind, name = EXCLUDED.name, reason = EXCLUDED.reason, type = EXCLUDED.type, message = EXCLUDED.message, count = EXCLUDED.count, source_component = EXCLUDED.source_component, source_host = EXCLUDED.source_host, verb = EXCLUDED.verb, resource_version = EXCLUDED.resource_version, data = EXCLUDED.data") {
+		t.Errorf("Unexpected INSERT statement %s", insert.query)
+	}
+	row := insert.args[:len(postgresColumns)]
+	if row[0] != "uid-1" || row[2] != time.Date(2020, 1, 1, 1, 0, 0, 0, time.UTC) || row[4] != "Pod" || row[9] != int64(5) || row[12] != "UPDATED" {
+		t.Errorf("Expected the updated pod event, got %v", row)
+	}
+	var data EventData
+	if err := json.Unmarshal([]byte(row[14].(string)), &data); err != nil || data.Event.Count != 5 {
+		t.Errorf("Unexpected data %v", row[14])
+	}
+}
+
+func TestPostgresSinkPartitions(t *testing.T) {
+	p := newTestPostgresSink(t, true)
+	if err := p.SendEvents(postgresTestEvents()); err != nil {
+		t.Fatal(err)
+	}
+	stmts := fakePostgresDB.reset()
+
+	if !strings.HasSuffix(stmts[0].query, "PRIMARY KEY (uid, first_timestamp)) PARTITION BY RANGE (first_timestamp)") {
+		t.Errorf("Unexpected CREATE TABLE statement %s", stmts[0].query)
+	}
+	partition := stmts[len(stmts)-2].query
+	if partition != `CREATE TABLE IF NOT EXISTS "events_20191231" PARTITION OF "events" FOR VALUES FROM ('2019-12-31T00:00:00Z') TO ('2020-01-01T00:00:00Z')` {
+		t.Errorf("Unexpected partition %s", partition)
+	}
+	if insert := stmts[len(stmts)-1].query; !strings.Contains(insert, "ON CONFLICT (uid, first_timestamp) DO UPDATE SET last_timestamp = ") {
+		t.Errorf("Unexpected INSERT statement %s", insert)
+	}
+
+	// Only the partitions of the days before the cutoff are dropped
+	fakePostgresDB.partitions = []string{"events_20191230", "events_20191231", "events_default"}
+	if err := p.applyRetention(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	stmts = fakePostgresDB.reset()
+	if len(stmts) != 3 || stmts[1].query != `DROP TABLE IF EXISTS "events_20191230"` || stmts[2].query != `DROP TABLE IF EXISTS "events_20191231"` {
+		t.Errorf("Unexpected retention statements %v", stmts)
+	}
+	if len(p.partitions) != 0 {
+		t.Errorf("Expected the dropped partition to be forgotten, got %v", p.partitions)
+	}
+}
+
+func TestPostgresSinkRetention(t *testing.T) {
+	p := newTestPostgresSink(t, false)
+	cutoff := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := p.applyRetention(cutoff); err != nil {
+		t.Fatal(err)
+	}
+	stmts := fakePostgresDB.reset()
+	if len(stmts) != 1 || stmts[0].query != `DELETE FROM "events" WHERE last_timestamp < $1` || stmts[0].args[0] != cutoff {
+		t.Errorf("Unexpected retention statements %v", stmts)
+	}
+}
+
+func TestPostgresSinkRetries(t *testing.T) {
+	p := newTestPostgresSink(t, false)
+	failures := []error{&pq.Error{Code: "42P01", Message: `relation "events" does not exist`}, errors.New("connection reset by peer")}
+	fakePostgresDB.fail = func(query string, args []driver.Value) error {
+		if strings.HasPrefix(query, "INSERT") && len(failures) > 0 {
+			err := failures[0]
+			failures = failures[1:]
+			return err
+		}
+		return nil
+	}
+	if err := p.SendEvents(postgresTestEvents()); err != nil {
+		t.Fatal(err)
+	}
+	// The schema is checked again after the missing table, but not after
+	// the connection error
+	var creates, inserts int
+	for _, s := range fakePostgresDB.reset() {
+		if strings.HasPrefix(s.query, "CREATE TABLE") {
+			creates++
+		} else if strings.HasPrefix(s.query, "INSERT") {
+			inserts++
+		}
+	}
+	if creates != 2 || inserts != 3 {
+		t.Errorf("Expected 3 attempts and 2 schema checks, got %d CREATE and %d INSERT", creates, inserts)
+	}
+
+	fakePostgresDB.fail = func(query string, args []driver.Value) error { return errors.New("permission denied") }
+	p.MaxRetries = 1
+	if err := p.SendEvents(postgresTestEvents()); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Expected the permission error, got %v", err)
+	}
+	if p.Status().LastError == "" {
+		t.Errorf("Expected the error in the sink status")
+	}
+	fakePostgresDB.reset()
+}
+
+func TestPostgresSinkDropsRejectedRows(t *testing.T) {
+	p := newTestPostgresSink(t, false)
+	// Like PostgreSQL, the fake rejects the NUL character in text
+	fakePostgresDB.fail = func(query string, args []driver.Value) error {
+		for _, a := range args {
+			if s, ok := a.(string); ok && strings.ContainsRune(s, 0) {
+				return &pq.Error{Code: "22021", Message: "invalid byte sequence for encoding \"UTF8\": 0x00"}
+			}
+		}
+		return nil
+	}
+
+	events := []EventData{}
+	for i, msg := range []string{"a", "b", "bad\x00", "d"} {
+		e := formatTestEvent()
+		e.Event.UID = types.UID(fmt.Sprintf("uid-%d", i))
+		e.Event.Message = msg
+		events = append(events, e)
+	}
+	if err := p.SendEvents(events); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch is split until the bad row is alone, without retries
+	written := map[string]bool{}
+	var inserts int
+	for _, s := range fakePostgresDB.reset() {
+		if !strings.HasPrefix(s.query, "INSERT") {
+			continue
+		}
+		inserts++
+		if strings.ContainsRune(fmt.Sprint(s.args), 0) {
+			continue
+		}
+		for i := 0; i < len(s.args); i += len(postgresColumns) {
+			written[s.args[i].(string)] = true
+		}
+	}
+	if inserts != 5 {
+		t.Errorf("Expected 5 INSERTs, got %d", inserts)
+	}
+	if len(written) != 3 || written["uid-2"] {
+		t.Errorf("Expected all rows but the bad one, got %v", written)
+	}
+}
+
+func TestFakePostgresChecksStatements(t *testing.T) {
+	fakePostgresDB.reset()
+	db, err := sql.Open("fakepostgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT INTO "events" (uid, count) VALUES ($1, $2)`, []interface{}{"uid-1"}},
+		{`INSERT INTO "events" (uid, count) VALUES ($1, $2), ($3)`, []interface{}{"uid-1", 1, "uid-2"}},
+		{`DELETE FROM "events" WHERE last_timestamp < $2`, []interface{}{1, 2}},
+		{`CREATE TABLE IF NOT EXISTS "events" (uid text`, nil},
+	} {
+		if _, err := db.Exec(stmt.query, stmt.args...); err == nil {
+			t.Errorf("Expected an error for %s", stmt.query)
+		}
+	}
+}
+
+func TestPostgresSinkInvalidTable(t *testing.T) {
+	if _, err := NewPostgresSink("", "events; DROP TABLE x", false, false, 10); err == nil {
+		t.Errorf("Expected an error for an invalid table name")
+	}
+
+	// Partition names must fit in the 63 bytes of a PostgreSQL identifier
+	table := strings.Repeat("e", 55)
+	if _, err := NewPostgresSink("", table, true, false, 10); err == nil {
+		t.Errorf("Expected an error for a table name too long to partition")
+	}
+	if _, err := NewPostgresSink("", table[:54], true, false, 10); err != nil {
+		t.Errorf("Expected a table name of 54 characters to be accepted, got %v", err)
+	}
+	if _, err := NewPostgresSink("", table, false, false, 10); err != nil {
+		t.Errorf("Expected a table name of 55 characters to be accepted without partitions, got %v", err)
+	}
+	if _, err := NewPostgresSink("", strings.Repeat("e", 64), false, false, 10); err == nil {
+		t.Errorf("Expected an error for a table name over 63 characters")
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Protobuf wire types
+const (
+	protoVarint = 0
+	protoBytes  = 2
+)
+
+// formatProtobuf encodes the event data as an EventData message of
+// schema/eventdata.proto. The message is written field by field, so the
+// field numbers here must match the published schema.
+func formatProtobuf(e EventData) ([]byte, error) {
+	b := proto.NewBuffer(nil)
+	protoString(b, 1, e.Verb)
+	protoMessage(b, 2, protoEvent(e.Event))
+	protoMessage(b, 3, protoEvent(e.OldEvent))
+	return b.Bytes(), nil
+}
+
+// protoEvent encodes an Event message, or returns nil for a nil event
+func protoEvent(e *v1.Event) []byte {
+	if e == nil {
+		return nil
+	}
+	b := proto.NewBuffer(nil)
+	protoString(b, 1, string(e.UID))
+	protoString(b, 2, e.Name)
+	protoString(b, 3, e.Namespace)
+	protoString(b, 4, e.ResourceVersion)
+	protoString(b, 5, e.Type)
+	protoString(b, 6, e.Reason)
+	protoString(b, 7, e.Message)
+	protoVarintField(b, 8, uint64(int64(e.Count)))
+	protoVarintField(b, 9, uint64(unixMillis(e.FirstTimestamp.Time)))
+	protoVarintField(b, 10, uint64(unixMillis(e.LastTimestamp.Time)))
+	protoVarintField(b, 11, uint64(unixMillis(e.EventTime.Time)))
+
+	ref := proto.NewBuffer(nil)
+	protoString(ref, 1, e.InvolvedObject.Kind)
+	protoString(ref, 2, e.InvolvedObject.Namespace)
+	protoString(ref, 3, e.InvolvedObject.Name)
+	protoString(ref, 4, string(e.InvolvedObject.UID))
+	protoString(ref, 5, e.InvolvedObject.APIVersion)
+	protoString(ref, 6, e.InvolvedObject.ResourceVersion)
+	protoString(ref, 7, e.InvolvedObject.FieldPath)
+	protoMessage(b, 12, ref.Bytes())
+
+	src := proto.NewBuffer(nil)
+	protoString(src, 1, e.Source.Component)
+	protoString(src, 2, e.Source.Host)
+	protoMessage(b, 13, src.Bytes())
+
+	protoString(b, 14, e.ReportingController)
+	protoString(b, 15, e.ReportingInstance)
+	protoMap(b, 16, e.Labels)
+	protoMap(b, 17, e.Annotations)
+
+	// An empty message must still be distinguishable from a missing one
+	if len(b.Bytes()) == 0 {
+		return []byte{}
+	}
+	return b.Bytes()
+}
+
+// protoString writes a string field, leaving out the proto3 default
+func protoString(b *proto.Buffer, field uint64, s string) {
+	if s == "" {
+		return
+	}
+	b.EncodeVarint(field<<3 | protoBytes)
+	b.EncodeStringBytes(s)
+}
+
+// protoVarintField writes an integer field, leaving out the proto3 default
+func protoVarintField(b *proto.Buffer, field uint64, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.EncodeVarint(field<<3 | protoVarint)
+	b.EncodeVarint(v)
+}
+
+// protoMessage writes an embedded message, leaving it out when nil
+func protoMessage(b *proto.Buffer, field uint64, msg []byte) {
+	if msg == nil {
+		return
+	}
+	b.EncodeVarint(field<<3 | protoBytes)
+	b.EncodeRawBytes(msg)
+}
+
+// protoMap writes a map<string, string> field as its sorted entries
+func protoMap(b *proto.Buffer, field uint64, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		entry := proto.NewBuffer(nil)
+		protoString(entry, 1, k)
+		protoString(entry, 2, m[k])
+		protoMessage(b, field, entry.Bytes())
+	}
+}
+
+// unixMillis returns the milliseconds since the epoch, or 0 for a zero time
+func unixMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
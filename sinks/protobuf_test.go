@@ -0,0 +1,107 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	v1 "k8s.io/api/core/v1"
+)
+
+// decodeProto splits a message into the raw values of its fields. Varints
+// are returned as their value, length-delimited fields as their bytes.
+func decodeProto(t *testing.T, msg []byte) map[uint64][]interface{} {
+	fields := map[uint64][]interface{}{}
+	for len(msg) > 0 {
+		key, n := proto.DecodeVarint(msg)
+		if n == 0 {
+			t.Fatal("invalid field key")
+		}
+		msg = msg[n:]
+		v, n := proto.DecodeVarint(msg)
+		if n == 0 {
+			t.Fatal("invalid field value")
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case protoVarint:
+			fields[key>>3] = append(fields[key>>3], v)
+		case protoBytes:
+			if uint64(len(msg)) < v {
+				t.Fatal("truncated field")
+			}
+			fields[key>>3] = append(fields[key>>3], msg[:v])
+			msg = msg[v:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+func TestProtobufFormat(t *testing.T) {
+	e := formatTestEvent()
+	e.Event.Labels = map[string]string{"team": "web", "app": "shop"}
+	msg, err := mustGetFormatter("protobuf").Format(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := decodeProto(t, msg)
+	if string(data[1][0].([]byte)) != "ADDED" {
+		t.Errorf("Expected verb ADDED, got %s", data[1][0])
+	}
+	if _, ok := data[3]; ok {
+		t.Errorf("Expected no old event for an added event")
+	}
+
+	evt := decodeProto(t, data[2][0].([]byte))
+	if string(evt[6][0].([]byte)) != "BackOff" {
+		t.Errorf("Expected reason BackOff, got %s", evt[6][0])
+	}
+	if evt[8][0].(uint64) != 3 {
+		t.Errorf("Expected count 3, got %d", evt[8][0])
+	}
+	want := time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	if int64(evt[10][0].(uint64)) != want {
+		t.Errorf("Expected last timestamp %d, got %d", want, evt[10][0])
+	}
+	if _, ok := evt[9]; ok {
+		t.Errorf("Expected an unset first timestamp to be left out")
+	}
+
+	ref := decodeProto(t, evt[12][0].([]byte))
+	if string(ref[1][0].([]byte)) != "Pod" || string(ref[3][0].([]byte)) != "web-1" {
+		t.Errorf("Unexpected involved object %v", ref)
+	}
+
+	if len(evt[16]) != 2 {
+		t.Fatalf("Expected 2 labels, got %d", len(evt[16]))
+	}
+	first := decodeProto(t, evt[16][0].([]byte))
+	if string(first[1][0].([]byte)) != "app" || string(first[2][0].([]byte)) != "shop" {
+		t.Errorf("Expected sorted label entries, got %s=%s", first[1][0], first[2][0])
+	}
+
+	// An empty old event is still present on updates
+	msg, _ = mustGetFormatter("protobuf").Format(EventData{Verb: "UPDATED", Event: e.Event, OldEvent: &v1.Event{}})
+	if old, ok := decodeProto(t, msg)[3]; !ok || len(old[0].([]byte)) != 0 {
+		t.Errorf("Expected an empty old event, got %v", old)
+	}
+}
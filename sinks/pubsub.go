@@ -0,0 +1,229 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+	"google.golang.org/api/option"
+	v1 "k8s.io/api/core/v1"
+)
+
+// PubSubSink publishes events to a Google Cloud Pub/Sub topic with the
+// Pub/Sub client library, which batches them according to its publish
+// settings. When PUBSUB_EMULATOR_HOST is set, the library publishes to the
+// emulator without credentials instead.
+type PubSubSink struct {
+	client      *pubsub.Client
+	topic       *pubsub.Topic
+	orderingKey bool
+	formatter   Formatter
+	eventCh     channels.Channel
+	stats       sinkStats
+}
+
+// NewPubSubSink constructs a new PubSubSink publishing to the given topic.
+// Credentials are read from the service account key file when one is given,
+// and otherwise found like the other Google Cloud clients do, which includes
+// the workload identity on GKE. An empty endpoint uses the default one.
+func NewPubSubSink(endpoint, project, topic, credentialsFile string, settings pubsub.PublishSettings, orderingKey bool, overflow bool, bufferSize int, formatter Formatter) (*PubSubSink, error) {
+	var opts []option.ClientOption
+	if credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	client, err := pubsub.NewClient(context.Background(), project, opts...)
+	if err != nil {
+		return nil, err
+	}
+	t := client.Topic(topic)
+	t.PublishSettings = settings
+	t.EnableMessageOrdering = orderingKey
+
+	var eventCh channels.Channel
+	if overflow {
+		eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return &PubSubSink{
+		client:      client,
+		topic:       t,
+		orderingKey: orderingKey,
+		formatter:   formatter,
+		eventCh:     eventCh,
+	}, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event OverflowingChannel, which should never block.
+// Messages that are buffered beyond the bufferSize specified for this
+// PubSubSink are discarded.
+func (p *PubSubSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	p.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Status implements the StatusReporter interface
+func (p *PubSubSink) Status() SinkStatus {
+	return p.stats.status(p.eventCh.Len())
+}
+
+// HealthCheck implements the HealthChecker interface by checking that the
+// topic exists, which also checks the credentials
+func (p *PubSubSink) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	ok, err := p.topic.Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("topic %v does not exist", p.topic)
+	}
+	return nil
+}
+
+// Run sits in a loop, waiting for data to come in through p.eventCh, and
+// publishing it. The topic is stopped once stopCh is closed, which publishes
+// the messages it still holds.
+func (p *PubSubSink) Run(stopCh <-chan bool) {
+	defer p.topic.Stop()
+loop:
+	for {
+		select {
+		case e := <-p.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := p.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-p.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			p.SendEvents(arr)
+		case <-stopCh:
+			break loop
+		}
+	}
+}
+
+// SendEvents implements the BatchSender interface. It hands the events to
+// the topic, which batches them into publish requests and retries failed
+// ones, and waits for all of them to be published. A message that fails,
+// like one over the request size limit, doesn't hold back the others, and
+// the errors are returned together. Events that can't be serialized are
+// logged and dropped.
+func (p *PubSubSink) SendEvents(events []EventData) error {
+	ctx := context.Background()
+	results := make([]*pubsub.PublishResult, 0, len(events))
+	keys := make([]string, 0, len(events))
+	for _, evt := range events {
+		msg, err := p.newMessage(evt)
+		if err != nil {
+			glog.Warningf("Failed to serialize event: %v", err)
+			continue
+		}
+		results = append(results, p.topic.Publish(ctx, msg))
+		keys = append(keys, msg.OrderingKey)
+	}
+
+	var errs []error
+	seen := map[string]bool{}
+	failed := 0
+	for i, r := range results {
+		if _, err := r.Get(ctx); err != nil {
+			failed++
+			// The topic pauses the ordering key of a failed message, so that
+			// the later messages of the key aren't published out of order
+			if keys[i] != "" {
+				p.topic.ResumePublish(keys[i])
+			}
+			if !seen[err.Error()] {
+				seen[err.Error()] = true
+				errs = append(errs, err)
+			}
+		}
+	}
+	if failed > 0 {
+		err := fmt.Errorf("failed to publish %d of %d messages to %v: %v", failed, len(results), p.topic, combineErrors(errs))
+		glog.Error(err)
+		p.stats.sendFailed(err)
+		return err
+	}
+	p.stats.sendSucceeded()
+	return nil
+}
+
+// newMessage formats event data as a message, with the attributes of the
+// event and of the format
+func (p *PubSubSink) newMessage(evt EventData) (*pubsub.Message, error) {
+	data, err := p.formatter.Format(evt)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := map[string]string{}
+	for k, v := range map[string]string{
+		"namespace": evt.Event.InvolvedObject.Namespace,
+		"kind":      evt.Event.InvolvedObject.Kind,
+		"reason":    evt.Event.Reason,
+		"type":      evt.Event.Type,
+	} {
+		if v != "" {
+			attrs[k] = v
+		}
+	}
+	// Attributes map to those of the CloudEvents Pub/Sub binding
+	if af, ok := p.formatter.(AttributeFormatter); ok {
+		for k, v := range af.Attributes(evt) {
+			if k == "datacontenttype" {
+				attrs["content-type"] = v
+			} else {
+				attrs["ce-"+k] = v
+			}
+		}
+	}
+
+	msg := &pubsub.Message{Data: data, Attributes: attrs}
+	if p.orderingKey {
+		ref := evt.Event.InvolvedObject
+		msg.OrderingKey = ref.Namespace + "/" + ref.Kind + "/" + ref.Name
+	}
+	return msg, nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+)
+
+// newTestPubSubSink returns a sink publishing to an in-memory emulator, and
+// the emulator. The topic isn't created when create is false.
+func newTestPubSubSink(t *testing.T, orderingKey, create bool) (*PubSubSink, *pstest.Server) {
+	srv := pstest.NewServer()
+	os.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+	defer os.Unsetenv("PUBSUB_EMULATOR_HOST")
+
+	p, err := NewPubSubSink("", "acme", "events", "", pubsub.DefaultPublishSettings, orderingKey, false, 10, mustGetFormatter("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if create {
+		if _, err := p.client.CreateTopic(context.Background(), "events"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p, srv
+}
+
+func TestPubSubSinkEmulator(t *testing.T) {
+	p, srv := newTestPubSubSink(t, true, false)
+	defer srv.Close()
+	defer p.topic.Stop()
+
+	if err := p.HealthCheck(); err == nil {
+		t.Errorf("Expected an error for a missing topic")
+	}
+	if _, err := p.client.CreateTopic(context.Background(), "events"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.HealthCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SendEvents([]EventData{formatTestEvent()}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("Expected a single message, got %d", len(msgs))
+	}
+	msg := msgs[0]
+	want := map[string]string{"namespace": "prod", "kind": "Pod", "reason": "BackOff", "type": "Warning"}
+	for k, v := range want {
+		if msg.Attributes[k] != v {
+			t.Errorf("Expected attribute %s=%s, got %q", k, v, msg.Attributes[k])
+		}
+	}
+	if msg.OrderingKey != "prod/Pod/web-1" {
+		t.Errorf("Expected ordering key prod/Pod/web-1, got %q", msg.OrderingKey)
+	}
+	var data EventData
+	if err := json.Unmarshal(msg.Data, &data); err != nil || data.Event.Reason != "BackOff" {
+		t.Errorf("Unexpected message data %s", msg.Data)
+	}
+}
+
+func TestPubSubSinkOversizedMessage(t *testing.T) {
+	p, srv := newTestPubSubSink(t, true, true)
+	defer srv.Close()
+	defer p.topic.Stop()
+
+	// The message over the request size limit fails on its own, and doesn't
+	// pause the ordering key of the next one
+	big := formatTestEvent()
+	evt := *big.Event
+	evt.Message = strings.Repeat("x", pubsub.MaxPublishRequestBytes)
+	big.Event = &evt
+	err := p.SendEvents([]EventData{big, formatTestEvent()})
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 messages") {
+		t.Errorf("Expected the oversized message to fail, got %v", err)
+	}
+	if p.Status().LastError == "" {
+		t.Errorf("Expected the error in the sink status")
+	}
+	if err := p.SendEvents([]EventData{formatTestEvent()}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.Messages(); len(msgs) != 2 {
+		t.Errorf("Expected the 2 other messages, got %d", len(msgs))
+	}
+}
+
+func TestPubSubSinkRun(t *testing.T) {
+	p, srv := newTestPubSubSink(t, false, true)
+	defer srv.Close()
+
+	stopCh := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		p.Run(stopCh)
+		close(done)
+	}()
+	e := formatTestEvent()
+	for i := 0; i < 3; i++ {
+		p.UpdateEvents(e.Event, nil)
+	}
+	waitFor(t, "the messages", func() bool { return len(srv.Messages()) == 3 })
+	close(stopCh)
+	<-done
+
+	// The topic is stopped with the sink
+	if err := p.SendEvents([]EventData{e}); err == nil {
+		t.Errorf("Expected an error once the sink is stopped")
+	}
+}
+
+func TestPubSubSinkCredentialsFile(t *testing.T) {
+	if _, err := NewPubSubSink("", "acme", "events", "/nonexistent/key.json", pubsub.DefaultPublishSettings, false, false, 10, mustGetFormatter("json")); err == nil {
+		t.Errorf("Expected an error for a missing credentials file")
+	}
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/go-redis/redis"
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+// DefaultRedisStream is the stream key template of the Redis sink. A key
+// like eventrouter:{{.Event.InvolvedObject.Namespace}} gives a stream per
+// namespace.
+const DefaultRedisStream = "eventrouter:events"
+
+// The ways to lay out the fields of a stream entry
+const (
+	// RedisFieldsJSON puts the formatted event in a single event field
+	RedisFieldsJSON = "json"
+
+	// RedisFieldsColumns puts the main fields of the event in fields of
+	// their own, like logfmt, along with the uid and resourceVersion
+	RedisFieldsColumns = "columns"
+)
+
+// RedisConfig holds the settings of the Redis connection
+type RedisConfig struct {
+	// Addrs are the addresses of the server, of the nodes of a cluster, or
+	// of the sentinels
+	Addrs []string
+
+	// MasterName is the name of the master monitored by the sentinels at
+	// Addrs. It enables Sentinel mode.
+	MasterName string
+
+	// Cluster enables Cluster mode, with Addrs as the seed nodes
+	Cluster bool
+
+	Password  string
+	DB        int
+	TLSConfig *tls.Config
+}
+
+// RedisSink appends events to Redis Streams with XADD, so that consumer
+// groups can read them in real time. Each batch is pipelined.
+type RedisSink struct {
+	// Stream gives the key of the stream of an event
+	Stream Formatter
+
+	// Fields is RedisFieldsJSON or RedisFieldsColumns
+	Fields string
+
+	// MaxLen trims the streams to about that many entries, with MAXLEN ~.
+	// Zero doesn't trim them.
+	MaxLen int64
+
+	// BatchSize bounds how many entries are sent in a pipeline
+	BatchSize int
+
+	// MaxRetries bounds how many times the entries that failed are retried
+	MaxRetries int
+
+	client       redis.UniversalClient
+	formatter    Formatter
+	retryBackoff time.Duration
+	eventCh      channels.Channel
+	stats        sinkStats
+}
+
+// NewRedisSink constructs a new RedisSink. It connects lazily, so it doesn't
+// fail when the server is down.
+func NewRedisSink(config RedisConfig, overflow bool, bufferSize int, formatter Formatter) (*RedisSink, error) {
+	if len(config.Addrs) == 0 {
+		return nil, fmt.Errorf("no Redis address")
+	}
+	if config.MasterName != "" && config.Cluster {
+		return nil, fmt.Errorf("redis Sentinel and Cluster modes are exclusive")
+	}
+	stream, err := newTemplateFormatter("redisStream", DefaultRedisStream)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RedisSink{
+		Stream:       stream,
+		Fields:       RedisFieldsJSON,
+		MaxLen:       100000,
+		BatchSize:    500,
+		MaxRetries:   3,
+		formatter:    formatter,
+		retryBackoff: time.Second,
+	}
+
+	// The clients don't retry by default, which is what we want: retrying a
+	// whole pipeline would add the entries that went through again, so the
+	// sink retries the failed entries itself.
+	switch {
+	case config.MasterName != "":
+		r.client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    config.MasterName,
+			SentinelAddrs: config.Addrs,
+			Password:      config.Password,
+			DB:            config.DB,
+			TLSConfig:     config.TLSConfig,
+		})
+	case config.Cluster:
+		r.client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     config.Addrs,
+			Password:  config.Password,
+			TLSConfig: config.TLSConfig,
+		})
+	default:
+		r.client = redis.NewClient(&redis.Options{
+			Addr:      config.Addrs[0],
+			Password:  config.Password,
+			DB:        config.DB,
+			TLSConfig: config.TLSConfig,
+		})
+	}
+
+	if overflow {
+		r.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		r.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+	return r, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event OverflowingChannel, which should never block.
+// Messages that are buffered beyond the bufferSize specified for this
+// RedisSink are discarded.
+func (r *RedisSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	r.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Status implements the StatusReporter interface
+func (r *RedisSink) Status() SinkStatus {
+	return r.stats.status(r.eventCh.Len())
+}
+
+// HealthCheck implements the HealthChecker interface by pinging the server
+func (r *RedisSink) HealthCheck() error {
+	done := make(chan error, 1)
+	go func() { done <- r.client.Ping().Err() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(healthCheckTimeout):
+		return fmt.Errorf("timed out pinging Redis")
+	}
+}
+
+// Run sits in a loop, waiting for data to come in through r.eventCh, and
+// appending it to the streams. If multiple events have happened between loop
+// iterations, they are sent in the same pipeline.
+func (r *RedisSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-r.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := r.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-r.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			r.SendEvents(arr)
+		case <-stopCh:
+			break loop
+		}
+	}
+	r.client.Close()
+}
+
+// SendEvents implements the BatchSender interface. The entries that fail
+// are retried with exponential backoff. A batch that still fails doesn't stop
+// the others from being sent, and the errors are returned together. Entries
+// may be added twice when the connection breaks after the server received
+// them. Events that can't be serialized are logged and dropped.
+func (r *RedisSink) SendEvents(events []EventData) error {
+	var args []*redis.XAddArgs
+	for _, evt := range events {
+		a, err := r.newEntry(evt)
+		if err != nil {
+			glog.Warningf("Failed to serialize event: %v", err)
+			continue
+		}
+		args = append(args, a)
+	}
+
+	// A batch that fails doesn't keep the next batches from being sent
+	var errs []error
+	for len(args) > 0 {
+		n := len(args)
+		if r.BatchSize > 0 && n > r.BatchSize {
+			n = r.BatchSize
+		}
+		if err := r.sendBatch(args[:n]); err != nil {
+			errs = append(errs, err)
+		}
+		args = args[n:]
+	}
+	if err := combineErrors(errs); err != nil {
+		r.stats.sendFailed(err)
+		return err
+	}
+	r.stats.sendSucceeded()
+	return nil
+}
+
+// sendBatch pipelines a batch of entries, retrying those that failed
+func (r *RedisSink) sendBatch(args []*redis.XAddArgs) error {
+	backoff := r.retryBackoff
+	for attempt := 0; ; attempt++ {
+		pipe := r.client.Pipeline()
+		cmds := make([]*redis.StringCmd, len(args))
+		for i, a := range args {
+			cmds[i] = pipe.XAdd(a)
+		}
+		_, err := pipe.Exec()
+		if err == nil {
+			return nil
+		}
+
+		var failed []*redis.XAddArgs
+		for i, cmd := range cmds {
+			if cmd.Err() != nil {
+				failed = append(failed, args[i])
+			}
+		}
+		if attempt >= r.MaxRetries {
+			glog.Errorf("Failed to add %d entries to Redis streams: %v", len(failed), err)
+			return err
+		}
+		glog.Warningf("Retrying %d entries in %v: %v", len(failed), backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		args = failed
+	}
+}
+
+// newEntry returns the XADD arguments of an event
+func (r *RedisSink) newEntry(evt EventData) (*redis.XAddArgs, error) {
+	stream, err := r.Stream.Format(evt)
+	if err != nil {
+		return nil, err
+	}
+	a := &redis.XAddArgs{
+		Stream:       string(stream),
+		MaxLenApprox: r.MaxLen,
+		Values:       map[string]interface{}{},
+	}
+
+	switch r.Fields {
+	case RedisFieldsColumns:
+		for _, f := range eventFields(evt) {
+			a.Values[f.key] = f.value
+		}
+		a.Values["uid"] = string(evt.Event.UID)
+		a.Values["resourceVersion"] = evt.Event.ResourceVersion
+	default:
+		data, err := r.formatter.Format(evt)
+		if err != nil {
+			return nil, err
+		}
+		a.Values["event"] = data
+	}
+	return a, nil
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis is a stand-in Redis server. fail gives the error of the nth XADD
+// command, if any.
+type fakeRedis struct {
+	l     net.Listener
+	mu    sync.Mutex
+	auth  []string
+	xadds [][]string
+	fail  func(n int) string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// readRESPCommand reads a command sent as an array of bulk strings
+func readRESPCommand(br *bufio.Reader) ([]string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = br.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		args, err := readRESPCommand(br)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			f.auth = append(f.auth, args[1:]...)
+			fmt.Fprintf(conn, "+OK\r\n")
+		case "PING":
+			fmt.Fprintf(conn, "+PONG\r\n")
+		case "XADD":
+			f.xadds = append(f.xadds, args)
+			if msg := f.fail(len(f.xadds)); msg != "" {
+				fmt.Fprintf(conn, "-%s\r\n", msg)
+			} else {
+				id := fmt.Sprintf("1-%d", len(f.xadds))
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(id), id)
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		f.mu.Unlock()
+	}
+}
+
+// redisEntryFields returns the fields of an XADD command
+func redisEntryFields(args []string) map[string]string {
+	i := 0
+	for i < len(args) && args[i] != "*" {
+		i++
+	}
+	fields := map[string]string{}
+	for i++; i+1 < len(args); i += 2 {
+		fields[args[i]] = args[i+1]
+	}
+	return fields
+}
+
+func newTestRedisSink(t *testing.T, f *fakeRedis) *RedisSink {
+	r, err := NewRedisSink(RedisConfig{Addrs: []string{f.l.Addr().String()}, Password: "pwd"}, false, 10, mustGetFormatter("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.retryBackoff = 0
+	return r
+}
+
+func TestRedisSink(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.l.Close()
+	f.fail = func(n int) string { return "" }
+
+	r := newTestRedisSink(t, f)
+	defer r.client.Close()
+	var err error
+	if r.Stream, err = newTemplateFormatter("redisStream", "events:{{.Event.InvolvedObject.Namespace}}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.HealthCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SendEvents(natsTestEvents()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.auth) != 1 || f.auth[0] != "pwd" {
+		t.Errorf("Expected a single authenticated connection, got %v", f.auth)
+	}
+	if len(f.xadds) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(f.xadds))
+	}
+	want := []string{"xadd", "events:prod", "maxlen", "~", "100000", "*", "event"}
+	if got := f.xadds[0][:len(want)]; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if f.xadds[1][1] != "events:" {
+		t.Errorf("Expected stream events: for a cluster scoped object, got %s", f.xadds[1][1])
+	}
+	var data EventData
+	if err := json.Unmarshal([]byte(redisEntryFields(f.xadds[0])["event"]), &data); err != nil || data.Event.Reason != "BackOff" {
+		t.Errorf("Unexpected entry %v", f.xadds[0])
+	}
+}
+
+func TestRedisSinkColumns(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.l.Close()
+	f.fail = func(n int) string { return "" }
+
+	r := newTestRedisSink(t, f)
+	defer r.client.Close()
+	r.Fields = RedisFieldsColumns
+	r.MaxLen = 0
+	if err := r.SendEvents(natsTestEvents()[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.xadds[0][2] != "*" {
+		t.Errorf("Expected no trimming, got %v", f.xadds[0])
+	}
+	fields := redisEntryFields(f.xadds[0])
+	want := map[string]string{"verb": "ADDED", "namespace": "prod", "kind": "Pod", "name": "web-1", "reason": "BackOff", "uid": "uid-1", "resourceVersion": "7"}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("Expected field %s=%s, got %q", k, v, fields[k])
+		}
+	}
+	if _, ok := fields["event"]; ok {
+		t.Errorf("Expected no event field in columns mode")
+	}
+}
+
+func TestRedisSinkRetriesFailedEntries(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.l.Close()
+	f.fail = func(n int) string {
+		if n == 2 {
+			return "LOADING Redis is loading the dataset in memory"
+		}
+		return ""
+	}
+
+	r := newTestRedisSink(t, f)
+	defer r.client.Close()
+	if err := r.SendEvents(natsTestEvents()); err != nil {
+		t.Fatal(err)
+	}
+	// Only the entry that failed is retried
+	if len(f.xadds) != 3 || f.xadds[2][1] != DefaultRedisStream {
+		t.Fatalf("Expected the second entry to be retried, got %v", f.xadds)
+	}
+	if redisEntryFields(f.xadds[2])["event"] != redisEntryFields(f.xadds[1])["event"] {
+		t.Errorf("Expected the retried entry to match the one that failed")
+	}
+
+	// The error is reported once the retries are exhausted
+	f.mu.Lock()
+	f.fail = func(n int) string { return "OOM command not allowed when used memory > 'maxmemory'" }
+	f.mu.Unlock()
+	r.MaxRetries = 1
+	if err := r.SendEvents(natsTestEvents()); err == nil || !strings.Contains(err.Error(), "OOM") {
+		t.Errorf("Expected the OOM error, got %v", err)
+	}
+	if len(f.xadds) != 7 {
+		t.Errorf("Expected 2 attempts of 2 entries, got %d entries", len(f.xadds)-3)
+	}
+	if r.Status().LastError == "" {
+		t.Errorf("Expected the error in the sink status")
+	}
+}
+
+func TestRedisSinkKeepsSendingAfterFailedBatch(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.l.Close()
+	f.fail = func(n int) string {
+		if n == 1 {
+			return "OOM command not allowed when used memory > 'maxmemory'"
+		}
+		return ""
+	}
+
+	r := newTestRedisSink(t, f)
+	defer r.client.Close()
+	r.BatchSize = 1
+	r.MaxRetries = 0
+	if err := r.SendEvents(natsTestEvents()); err == nil || !strings.Contains(err.Error(), "OOM") {
+		t.Errorf("Expected the OOM error, got %v", err)
+	}
+	// The second batch is still sent
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.xadds) != 2 {
+		t.Errorf("Expected 2 entries, got %d", len(f.xadds))
+	}
+}
@@ -19,52 +19,210 @@ package sinks
 import (
 	"encoding/json"
 	"fmt"
-	"os"
+	"net/http"
+	"time"
 
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
 	apiclient "github.com/rockset/rockset-go-client"
 	models "github.com/rockset/rockset-go-client/lib/go"
 	v1 "k8s.io/api/core/v1"
 )
 
+// rocksetRetryTypes are the document error types worth retrying
+var rocksetRetryTypes = map[string]bool{
+	"RESOURCEEXCEEDED":    true,
+	"RATE_LIMIT_EXCEEDED": true,
+	"INTERNALERROR":       true,
+	"NOT_READY":           true,
+}
+
 /*
 RocksetSink is a sink that uploads the kubernetes events as json object
 and converts them to documents inside of a Rockset collection.
 
 Rockset can later be used with
 many different connectors such as Tableau or Redash to use this data.
+
+Events are buffered and added in batches. The _id of a document is the event
+UID and resource version, so that a redelivered event replaces its document
+instead of duplicating it. Throttled requests and documents are retried with
+exponential backoff.
 */
 type RocksetSink struct {
 	client                *apiclient.RockClient
 	rocksetCollectionName string
 	rocksetWorkspaceName  string
+
+	batchSize    int
+	maxRetries   int
+	retryBackoff time.Duration
+
+	eventCh channels.Channel
+	stats   sinkStats
 }
 
-// NewRocksetSink will create a new RocksetSink with default options, returned as
-// an EventSinkInterface
-func NewRocksetSink(rocksetAPIKey string, rocksetCollectionName string, rocksetWorkspaceName string) EventSinkInterface {
-	client := apiclient.Client(rocksetAPIKey, "https://api.rs2.usw2.rockset.com")
-	return &RocksetSink{
+// NewRocksetSink will create a new RocksetSink sending to the given API
+// server, or the default region when it is empty. Events are only sent once
+// Run has been started.
+func NewRocksetSink(rocksetAPIKey string, rocksetAPIServer string, rocksetCollectionName string, rocksetWorkspaceName string, overflow bool, bufferSize int, batchSize int, maxRetries int) *RocksetSink {
+	client := apiclient.Client(rocksetAPIKey, rocksetAPIServer)
+	rs := &RocksetSink{
 		client:                client,
 		rocksetCollectionName: rocksetCollectionName,
 		rocksetWorkspaceName:  rocksetWorkspaceName,
+		batchSize:             batchSize,
+		maxRetries:            maxRetries,
+		retryBackoff:          time.Second,
 	}
+
+	if overflow {
+		rs.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		rs.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+	return rs
 }
 
-// UpdateEvents implements the EventSinkInterface
+// UpdateEvents implements the EventSinkInterface. It only buffers the event,
+// which is sent by Run.
 func (rs *RocksetSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
-	eData := NewEventData(eNew, eOld)
+	rs.eventCh.In() <- NewEventData(eNew, eOld)
+}
 
-	if eJSONBytes, err := json.Marshal(eData); err == nil {
-		var m map[string]interface{}
-		json.Unmarshal(eJSONBytes, &m)
-		docs := []interface{}{
-			m,
+// Status implements the StatusReporter interface
+func (rs *RocksetSink) Status() SinkStatus {
+	return rs.stats.status(rs.eventCh.Len())
+}
+
+// Run sits in a loop, waiting for data to come in through rs.eventCh, and
+// adding it to the collection in batches of up to batchSize documents.
+func (rs *RocksetSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-rs.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := rs.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-rs.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			for len(arr) > 0 {
+				n := rs.batchSize
+				if n <= 0 || n > len(arr) {
+					n = len(arr)
+				}
+				rs.SendEvents(arr[:n])
+				arr = arr[n:]
+			}
+		case <-stopCh:
+			break loop
 		}
-		dinfo := models.AddDocumentsRequest{
-			Data: docs,
+	}
+}
+
+// SendEvents implements the BatchSender interface. It adds the events to the
+// collection in one request, retrying the request when it is throttled or
+// fails on the server, and retrying the documents rejected with a transient
+// error. Documents rejected for other reasons are logged and dropped.
+func (rs *RocksetSink) SendEvents(events []EventData) error {
+	docs := make([]interface{}, 0, len(events))
+	for _, eData := range events {
+		doc, err := rocksetDocument(eData)
+		if err != nil {
+			glog.Errorf("Failed to json serialize event: %v", err)
+			continue
 		}
-		rs.client.Documents.Add(rs.rocksetWorkspaceName, rs.rocksetCollectionName, dinfo)
-	} else {
-		fmt.Fprintf(os.Stderr, "Failed to json serialize event: %v", err)
+		docs = append(docs, doc)
+	}
+
+	backoff := rs.retryBackoff
+	for attempt := 0; len(docs) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var retry bool
+		var err error
+		docs, retry, err = rs.add(docs)
+		if err == nil && len(docs) == 0 {
+			rs.stats.sendSucceeded()
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%d documents were throttled", len(docs))
+			retry = true
+		}
+		if !retry || attempt >= rs.maxRetries {
+			glog.Errorf("Failed to add %d documents to Rockset collection %s: %v", len(docs), rs.rocksetCollectionName, err)
+			rs.stats.sendFailed(err)
+			return err
+		}
+		glog.Warningf("Retrying %d documents for Rockset collection %s: %v", len(docs), rs.rocksetCollectionName, err)
+	}
+	return nil
+}
+
+// add makes one AddDocuments request. It returns the documents to retry, and
+// on error whether the whole request may be retried.
+func (rs *RocksetSink) add(docs []interface{}) ([]interface{}, bool, error) {
+	resp, httpResp, err := rs.client.Documents.Add(rs.rocksetWorkspaceName, rs.rocksetCollectionName, models.AddDocumentsRequest{Data: docs})
+	if err != nil {
+		// Network errors, throttling and server errors are transient
+		retry := httpResp == nil || httpResp.StatusCode == http.StatusTooManyRequests || httpResp.StatusCode >= 500
+		if gerr, ok := err.(models.GenericSwaggerError); ok && len(gerr.Body()) > 0 {
+			err = fmt.Errorf("%v: %s", err, gerr.Body())
+		}
+		return docs, retry, err
+	}
+
+	var failed []interface{}
+	for i, status := range resp.Data {
+		if status.Status != "ERROR" || i >= len(docs) {
+			continue
+		}
+		var errType, msg string
+		if status.Error_ != nil {
+			errType, msg = status.Error_.Type_, status.Error_.Message
+		}
+		if rocksetRetryTypes[errType] {
+			failed = append(failed, docs[i])
+			continue
+		}
+		glog.Errorf("Rockset rejected document %s: %s %s", status.Id, errType, msg)
+	}
+	return failed, false, nil
+}
+
+// rocksetDocument converts event data to a document, with an _id unique to
+// the version of the event
+func rocksetDocument(eData EventData) (map[string]interface{}, error) {
+	b, err := json.Marshal(eData)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
 	}
+	doc["_id"] = eventVersionID(eData.Event)
+	return doc, nil
 }
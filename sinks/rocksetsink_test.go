@@ -0,0 +1,174 @@
+/*
+Copyright 2019 The Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakeRockset is a stand-in Rockset API answering AddDocuments requests
+// with the given handler
+type fakeRockset struct {
+	mu       sync.Mutex
+	requests [][]map[string]interface{}
+	respond  func(n int, docs []map[string]interface{}) (int, interface{})
+}
+
+func (f *fakeRockset) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/v1/orgs/self/ws/commons/collections/events/docs" {
+		http.NotFound(w, r)
+		return
+	}
+	if auth := r.Header.Get("Authorization"); auth != "ApiKey key" {
+		http.Error(w, "bad key "+auth, http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	f.requests = append(f.requests, req.Data)
+	code, body := f.respond(len(f.requests), req.Data)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func rocksetTestEvents(n int) []EventData {
+	var events []EventData
+	for i := 0; i < n; i++ {
+		e := formatTestEvent()
+		e.Event.UID = types.UID(fmt.Sprintf("uid-%d", i))
+		e.Event.ResourceVersion = "42"
+		events = append(events, e)
+	}
+	return events
+}
+
+func newTestRocksetSink(f *fakeRockset) (*RocksetSink, *httptest.Server) {
+	srv := httptest.NewServer(f)
+	rs := NewRocksetSink("key", srv.URL, "events", "commons", false, 10, 2, 3)
+	rs.retryBackoff = 0
+	return rs, srv
+}
+
+func added(docs []map[string]interface{}) map[string]interface{} {
+	var statuses []map[string]interface{}
+	for _, d := range docs {
+		statuses = append(statuses, map[string]interface{}{"_id": d["_id"], "status": "ADDED"})
+	}
+	return map[string]interface{}{"data": statuses}
+}
+
+func TestRocksetSinkBatches(t *testing.T) {
+	stopCh := make(chan bool)
+	f := &fakeRockset{respond: func(n int, docs []map[string]interface{}) (int, interface{}) {
+		if n == 2 {
+			close(stopCh)
+		}
+		return http.StatusOK, added(docs)
+	}}
+	rs, srv := newTestRocksetSink(f)
+	defer srv.Close()
+
+	for _, e := range rocksetTestEvents(3) {
+		rs.UpdateEvents(e.Event, nil)
+	}
+	rs.Run(stopCh)
+
+	if len(f.requests[0]) != 2 || len(f.requests[1]) != 1 {
+		t.Fatalf("Expected batches of 2 and 1 documents, got %d and %d", len(f.requests[0]), len(f.requests[1]))
+	}
+	doc := f.requests[0][0]
+	if doc["_id"] != "uid-0.42" || doc["verb"] != "ADDED" {
+		t.Errorf("Unexpected document %v", doc)
+	}
+	if rs.Status().LastError != "" {
+		t.Errorf("Expected no error, got %s", rs.Status().LastError)
+	}
+}
+
+func TestRocksetSinkRetries(t *testing.T) {
+	f := &fakeRockset{respond: func(n int, docs []map[string]interface{}) (int, interface{}) {
+		switch n {
+		case 1:
+			return http.StatusTooManyRequests, map[string]string{"message": "slow down", "type": "RATE_LIMIT_EXCEEDED"}
+		case 2:
+			resp := added(docs)
+			statuses := resp["data"].([]map[string]interface{})
+			statuses[0]["status"] = "ERROR"
+			statuses[0]["error"] = map[string]string{"type": "RESOURCEEXCEEDED", "message": "throttled"}
+			statuses[1]["status"] = "ERROR"
+			statuses[1]["error"] = map[string]string{"type": "INVALIDINPUT", "message": "bad document"}
+			return http.StatusOK, resp
+		default:
+			return http.StatusOK, added(docs)
+		}
+	}}
+	rs, srv := newTestRocksetSink(f)
+	defer srv.Close()
+
+	if err := rs.SendEvents(rocksetTestEvents(2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.requests) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(f.requests))
+	}
+	// Only the throttled document is retried
+	if len(f.requests[2]) != 1 || f.requests[2][0]["_id"] != "uid-0.42" {
+		t.Errorf("Expected uid-0.42 to be retried, got %v", f.requests[2])
+	}
+}
+
+func TestRocksetSinkErrors(t *testing.T) {
+	f := &fakeRockset{respond: func(n int, docs []map[string]interface{}) (int, interface{}) {
+		return http.StatusServiceUnavailable, map[string]string{"message": "down"}
+	}}
+	rs, srv := newTestRocksetSink(f)
+	defer srv.Close()
+
+	if err := rs.SendEvents(rocksetTestEvents(1)); err == nil {
+		t.Fatal("Expected an error once retries are exhausted")
+	}
+	if len(f.requests) != 4 {
+		t.Errorf("Expected 1 request and 3 retries, got %d requests", len(f.requests))
+	}
+
+	// Client errors are not retried
+	f.requests = nil
+	f.respond = func(n int, docs []map[string]interface{}) (int, interface{}) {
+		return http.StatusBadRequest, map[string]string{"message": "invalid"}
+	}
+	if err := rs.SendEvents(rocksetTestEvents(1)); err == nil {
+		t.Fatal("Expected an error for a rejected request")
+	}
+	if len(f.requests) != 1 {
+		t.Errorf("Expected a single request, got %d", len(f.requests))
+	}
+	if rs.Status().LastError == "" {
+		t.Errorf("Expected the error in the sink status")
+	}
+}
@@ -2,15 +2,14 @@ package sinks
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"time"
 
 	"k8s.io/api/core/v1"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/eapache/channels"
 	"github.com/golang/glog"
@@ -30,14 +29,17 @@ type S3Sink struct {
 	// uploader is the uploader client from aws which makes the API call to aws for upload
 	uploader *s3manager.Uploader
 
+	// client is the s3 client used to check that the bucket is reachable
+	client *s3.S3
+
 	// bucket is the s3 bucket name where the events data would be stored
 	bucket string
 
 	// bucketDir is the first level directory in the bucket where the events would be stored
 	bucketDir string
 
-	// outPutFormat is the format in which the data is stored in the s3 file
-	outputFormat string
+	// formatter serializes the events stored in the s3 file
+	formatter Formatter
 
 	// lastUploadTimestamp stores the timestamp when the last upload to s3 happened
 	lastUploadTimestamp int64
@@ -51,17 +53,15 @@ type S3Sink struct {
 
 	// bodyBuf stores all the event captured data in a buffer before upload
 	bodyBuf *bytes.Buffer
-}
 
-// NewS3Sink is the factory method constructing a new S3Sink
-func NewS3Sink(awsAccessKeyID string, s3SinkSecretAccessKey string, s3SinkRegion string, s3SinkBucket string, s3SinkBucketDir string, s3SinkUploadInterval int, overflow bool, bufferSize int, outputFormat string) (*S3Sink, error) {
-	awsConfig := &aws.Config{
-		Region:      aws.String(s3SinkRegion),
-		Credentials: credentials.NewStaticCredentials(awsAccessKeyID, s3SinkSecretAccessKey, ""),
-	}
+	// stats records the outcome of the uploads for the admin endpoints
+	stats sinkStats
+}
 
-	awsConfig = awsConfig.WithCredentialsChainVerboseErrors(true)
-	sess, err := session.NewSession(awsConfig)
+// NewS3Sink is the factory method constructing a new S3Sink. A non-empty
+// endpoint overrides that of S3, to use a local stand-in such as LocalStack.
+func NewS3Sink(awsAccessKeyID string, s3SinkSecretAccessKey string, s3SinkRegion string, s3SinkEndpoint string, s3SinkBucket string, s3SinkBucketDir string, s3SinkUploadInterval int, overflow bool, bufferSize int, formatter Formatter) (*S3Sink, error) {
+	sess, err := newAWSSession(awsAccessKeyID, s3SinkSecretAccessKey, s3SinkRegion, s3SinkEndpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -70,10 +70,11 @@ func NewS3Sink(awsAccessKeyID string, s3SinkSecretAccessKey string, s3SinkRegion
 
 	s := &S3Sink{
 		uploader:       uploader,
+		client:         s3.New(sess),
 		bucket:         s3SinkBucket,
 		bucketDir:      s3SinkBucketDir,
 		uploadInterval: time.Second * time.Duration(s3SinkUploadInterval),
-		outputFormat:   outputFormat,
+		formatter:      formatter,
 		bodyBuf:        bytes.NewBuffer(make([]byte, 0, 4096)),
 	}
 
@@ -94,6 +95,23 @@ func (s *S3Sink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 	s.eventCh.In() <- NewEventData(eNew, eOld)
 }
 
+// Status implements the StatusReporter interface
+func (s *S3Sink) Status() SinkStatus {
+	return s.stats.status(s.eventCh.Len())
+}
+
+// HealthCheck implements the HealthChecker interface by checking that the
+// bucket exists and is accessible with the configured credentials.
+func (s *S3Sink) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	_, err := s.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.bucket),
+	})
+	return err
+}
+
 // Run sits in a loop, waiting for data to come in through h.eventCh,
 // and forwarding them to the HTTP sink. If multiple events have happened
 // between loop iterations, it puts all of them in one request instead of
@@ -136,25 +154,13 @@ loop:
 func (s *S3Sink) drainEvents(events []EventData) {
 	var written int64
 	for _, evt := range events {
-		switch s.outputFormat {
-		case "rfc5424":
-			w, err := evt.WriteRFC5424(s.bodyBuf)
-			written += w
-			if err != nil {
-				glog.Warningf("Could not write to event request body (wrote %v) bytes: %v", written, err)
-				return
-			}
-		case "flatjson":
-			w, err := evt.WriteFlattenedJSON(s.bodyBuf)
-			written += w
-			if err != nil {
-				glog.Warningf("Could not write to event request body (wrote %v) bytes: %v", written, err)
-				return
-			}
-		default:
-			err := errors.New("Invalid Sink Output Format specified")
-			panic(err.Error())
+		b, err := s.formatter.Format(evt)
+		if err != nil {
+			glog.Warningf("Could not write to event request body (wrote %v) bytes: %v", written, err)
+			return
 		}
+		w, _ := s.bodyBuf.Write(b)
+		written += int64(w)
 		s.bodyBuf.Write([]byte{'\n'})
 		written++
 	}
@@ -193,8 +199,11 @@ func (s *S3Sink) upload() {
 	})
 	if err != nil {
 		glog.Errorf("Error uploading %s to s3, %v", key, err)
+		s.stats.sendFailed(err)
+	} else {
+		glog.Infof("Uploaded at %s", key)
+		s.stats.sendSucceeded()
 	}
-	glog.Infof("Uploaded at %s", key)
 	s.lastUploadTimestamp = now.UnixNano()
 
 	s.bodyBuf.Truncate(0)
@@ -0,0 +1,110 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// schemaRegistryContentType is the content type of the Confluent schema
+// registry API
+const schemaRegistryContentType = "application/vnd.schemaregistry.v1+json"
+
+// registryFormatter registers the schema of a SchemaFormatter with a
+// Confluent compatible schema registry, and frames every message in the
+// registry wire format: a zero magic byte, the schema id as a 4 byte big
+// endian integer, then the encoded event.
+type registryFormatter struct {
+	inner SchemaFormatter
+	id    int32
+}
+
+// NewSchemaRegistryFormatter wraps a SchemaFormatter so that its schema is
+// registered under the given subject. The schema is registered right away,
+// so that formatting never waits on the registry, and an error is returned if
+// the registry is unreachable or rejects the schema. User info in the
+// registry URL is sent as basic auth.
+func NewSchemaRegistryFormatter(inner SchemaFormatter, registryURL, subject string) (Formatter, error) {
+	id, err := registerSchema(&http.Client{Timeout: 30 * time.Second}, strings.TrimSuffix(registryURL, "/"), subject, inner.Schema())
+	if err != nil {
+		return nil, fmt.Errorf("failed to register schema for subject %s: %v", subject, err)
+	}
+	return &registryFormatter{inner: inner, id: id}, nil
+}
+
+// Format implements the Formatter interface
+func (f *registryFormatter) Format(e EventData) ([]byte, error) {
+	body, err := f.inner.Format(e)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(out[1:], uint32(f.id))
+	return append(out, body...), nil
+}
+
+// registerSchema registers a schema under subject and returns its id.
+// Registering a schema that already exists returns its id.
+func registerSchema(httpClient *http.Client, registryURL, subject, schema string) (int32, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	u, err := url.Parse(registryURL + "/subjects/" + url.PathEscape(subject) + "/versions")
+	if err != nil {
+		return 0, err
+	}
+	// Keep the credentials out of the URL, which shows up in errors
+	user := u.User
+	u.User = nil
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", schemaRegistryContentType)
+	req.Header.Set("Accept", schemaRegistryContentType)
+	if user != nil {
+		pwd, _ := user.Password()
+		req.SetBasicAuth(user.Username(), pwd)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", resp.Status, respBody)
+	}
+
+	var result struct {
+		ID int32 `json:"id"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return 0, fmt.Errorf("invalid schema registry response: %v", err)
+	}
+	return result.ID, nil
+}
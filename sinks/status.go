@@ -0,0 +1,101 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SinkStatus describes the state of a sink as reported on the admin
+// endpoints. LastSuccess is nil until the sink first succeeds.
+type SinkStatus struct {
+	Name        string     `json:"name"`
+	Healthy     bool       `json:"healthy"`
+	BufferDepth int        `json:"buffer_depth"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	CircuitOpen bool       `json:"circuit_open"`
+}
+
+// StatusReporter is implemented by sinks that can report on their own state.
+// Sinks that don't implement it are always considered healthy.
+type StatusReporter interface {
+	Status() SinkStatus
+}
+
+// sinkStats records the outcome of the most recent sends of a sink. It is safe
+// for concurrent use, since the admin endpoints read it while the sink writes.
+type sinkStats struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastErr     error
+}
+
+// sendSucceeded records a successful send, clearing any previous error.
+func (s *sinkStats) sendSucceeded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSuccess = time.Now()
+	s.lastErr = nil
+}
+
+// sendFailed records a failed send. The sink stays unhealthy until the next
+// successful send.
+func (s *sinkStats) sendFailed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = err
+}
+
+// status builds a SinkStatus from the recorded sends and the given buffer
+// depth.
+func (s *sinkStats) status(bufferDepth int) SinkStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := SinkStatus{
+		Healthy:     s.lastErr == nil,
+		BufferDepth: bufferDepth,
+	}
+	if !s.lastSuccess.IsZero() {
+		lastSuccess := s.lastSuccess
+		st.LastSuccess = &lastSuccess
+	}
+	if s.lastErr != nil {
+		st.LastError = s.lastErr.Error()
+	}
+	return st
+}
+
+// combineErrors merges the errors of the batches sent by SendEvents, so that
+// the batches after a failed one are still sent. It returns nil when there are
+// no errors.
+func combineErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Errorf("%d batches failed: %s", len(errs), strings.Join(msgs, "; "))
+}
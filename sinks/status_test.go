@@ -0,0 +1,39 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSinkStatusLastSuccess(t *testing.T) {
+	var s sinkStats
+	s.sendFailed(errors.New("connection refused"))
+	b, _ := json.Marshal(s.status(0))
+	if strings.Contains(string(b), "last_success") {
+		t.Errorf("Expected no last_success before the first success, got %s", b)
+	}
+
+	s.sendSucceeded()
+	st := s.status(0)
+	if st.LastSuccess == nil || st.LastSuccess.IsZero() {
+		t.Errorf("Expected the time of the last success, got %v", st.LastSuccess)
+	}
+}
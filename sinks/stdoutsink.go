@@ -31,33 +31,35 @@ import (
 type StdoutSink struct {
 	// TODO: create a channel and buffer for scaling
 	namespace string
+	formatter Formatter
 }
 
-
 // NewStdoutSink will create a new StdoutSink with default options, returned as
-// an EventSinkInterface
-func NewStdoutSink(namespace string) EventSinkInterface {
+// an EventSinkInterface. When namespace is set, the formatted event is nested
+// under that key of a JSON object. Formats that don't produce JSON, such as
+// logfmt, are printed as is.
+func NewStdoutSink(namespace string, formatter Formatter) EventSinkInterface {
 	return &StdoutSink{
-		namespace: namespace}
+		namespace: namespace,
+		formatter: formatter}
 }
 
 // UpdateEvents implements the EventSinkInterface
 func (gs *StdoutSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 	eData := NewEventData(eNew, eOld)
-	
-	if len(gs.namespace) > 0 {
-		namespacedData := map[string]interface{}{}
-		namespacedData[gs.namespace] = eData
-		if eJSONBytes, err := json.Marshal(namespacedData); err == nil {
-			fmt.Println(string(eJSONBytes))
-		} else {
-			fmt.Fprintf(os.Stderr, "Failed to json serialize event: %v", err)
-		}
-	} else {
-		if eJSONBytes, err := json.Marshal(eData); err == nil {
-			fmt.Println(string(eJSONBytes))
-		} else {
-			fmt.Fprintf(os.Stderr, "Failed to json serialize event: %v", err)
+
+	b, err := gs.formatter.Format(eData)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to serialize event: %v\n", err)
+		return
+	}
+	if len(gs.namespace) > 0 && json.Valid(b) {
+		namespacedData := map[string]json.RawMessage{}
+		namespacedData[gs.namespace] = b
+		if b, err = json.Marshal(namespacedData); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to json serialize event: %v\n", err)
+			return
 		}
 	}
+	fmt.Println(string(b))
 }
@@ -0,0 +1,61 @@
+/*
+Copyright 2017 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// captureStdout returns what f prints to stdout
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	f()
+	w.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestStdoutSinkNamespace(t *testing.T) {
+	e := formatTestEvent().Event
+
+	tmpl, err := NewFormatter(FormatConfig{Name: "tmpl", Type: "template", Template: `{"reason":{{json .Event.Reason}}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := captureStdout(t, func() { NewStdoutSink("event", tmpl).UpdateEvents(e, nil) })
+	if want := `{"event":{"reason":"BackOff"}}` + "\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Formats that don't produce JSON can't be nested and are printed as is
+	got = captureStdout(t, func() { NewStdoutSink("event", mustGetFormatter("logfmt")).UpdateEvents(e, nil) })
+	if want := "time=2019-09-01T12:00:00Z verb=ADDED type=Warning reason=BackOff kind=Pod namespace=prod name=web-1 component=kubelet host=node-1 count=3 message=\"Back-off restarting failed container \\\"app\\\"\"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -45,9 +45,11 @@ func main() {
 
 	evt := makeFakeEvent(podRef, v1.EventTypeWarning, "CreateInCluster", "Fake pod creation event")
 
-	sink := sinks.NewRocksetSink("key", "collection", "commons")
+	sink := sinks.NewRocksetSink("key", "", "collection", "commons", true, 1, 1, 0)
 
-	sink.UpdateEvents(evt, nil)
+	if err := sink.SendEvents([]sinks.EventData{sinks.NewEventData(evt, nil)}); err != nil {
+		panic(err.Error())
+	}
 }
 
 func makeFakeEvent(ref *v1.ObjectReference, eventtype, reason, message string) *v1.Event {